@@ -0,0 +1,423 @@
+package chord
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// RingProblemType - the kind of problem found when checking a ring
+type RingProblemType int
+
+const (
+	// BrokenLink - the predecessor of a node's successor is not the node
+	BrokenLink RingProblemType = iota
+	// Loop - following successors loops back to a node other than the seed,
+	// or goes round the ring more than once before reaching the seed
+	Loop
+	// Gap - a live node sits between a node and its successor on the ring,
+	// but was skipped by the successors
+	Gap
+	// Duplicate - the same ID is claimed at two addresses, or the same
+	// address and virtual node claims two IDs
+	Duplicate
+	// StaleFinger - a finger does not point at the successor of its start
+	StaleFinger
+	// Unreachable - a node on the ring could not be asked about itself
+	Unreachable
+)
+
+// RingProblemTypeToString - string representations of ring problem types
+var RingProblemTypeToString = map[RingProblemType]string{
+	BrokenLink:  "BrokenLink",
+	Loop:        "Loop",
+	Gap:         "Gap",
+	Duplicate:   "Duplicate",
+	StaleFinger: "StaleFinger",
+	Unreachable: "Unreachable",
+}
+
+// RingProblem - a single problem found when checking a ring.  Node is the
+// node with the problem, Expected is what it should be pointing at and Found
+// is what it is pointing at.  Finger is only set for stale fingers, and Err
+// only for unreachable nodes.
+type RingProblem struct {
+	Type     RingProblemType
+	Node     models.Node
+	Expected models.Node
+	Found    models.Node
+	Finger   uint64
+	Err      error
+}
+
+// ToString - string representation of a ring problem
+func (p RingProblem) ToString() string {
+	switch p.Type {
+	case BrokenLink:
+		return fmt.Sprintf("%s: %s has predecessor %s, expected %s",
+			RingProblemTypeToString[p.Type], shortNode(p.Node),
+			shortNode(p.Found), shortNode(p.Expected))
+	case Loop:
+		return fmt.Sprintf("%s: %s has successor %s, which loops back",
+			RingProblemTypeToString[p.Type], shortNode(p.Node),
+			shortNode(p.Found))
+	case Gap:
+		return fmt.Sprintf("%s: %s has successor %s, skipping %s",
+			RingProblemTypeToString[p.Type], shortNode(p.Node),
+			shortNode(p.Found), shortNode(p.Expected))
+	case Duplicate:
+		return fmt.Sprintf("%s: %s clashes with %s",
+			RingProblemTypeToString[p.Type], shortNode(p.Node),
+			shortNode(p.Found))
+	case StaleFinger:
+		return fmt.Sprintf("%s: %s finger %d is %s, expected %s",
+			RingProblemTypeToString[p.Type], shortNode(p.Node), p.Finger,
+			shortNode(p.Found), shortNode(p.Expected))
+	case Unreachable:
+		return fmt.Sprintf("%s: %s, %v",
+			RingProblemTypeToString[p.Type], shortNode(p.Node), p.Err)
+	}
+	return "unknown ring problem"
+}
+
+// shortNode - a short string representation of a node, without its key
+func shortNode(n models.Node) string {
+	if n.Addr == "" {
+		return "<none>"
+	}
+	return fmt.Sprintf("%s/%d(%s)", n.Addr, n.VNode,
+		hex.EncodeToString(n.ID[:4]))
+}
+
+// RingReport - the outcome of checking a ring.  Nodes are in the order they
+// were walked from the seed, and Complete is set when following successors
+// led back to the seed.
+type RingReport struct {
+	Seed     models.Node
+	Nodes    []models.Node
+	Complete bool
+	Problems []RingProblem
+}
+
+// Consistent - was the whole ring walked without finding any problems
+func (r RingReport) Consistent() bool {
+	return r.Complete && len(r.Problems) == 0
+}
+
+// ringWalk - the state built up while checking a ring
+type ringWalk struct {
+	caller Caller
+	// how long to wait on each request of the walk
+	timeout time.Duration
+	report  *RingReport
+	visited map[models.Identifier]int
+	preds   map[models.Identifier]models.Node
+	// every node heard of, by ID and by address and virtual node
+	byID   map[models.Identifier]models.Node
+	byAddr map[string]models.Node
+	// clashes already reported, so each is only reported once
+	clashes map[string]bool
+}
+
+// note - remember a node we heard of, reporting it if it clashes with the
+// first node we heard of with the same ID, or address and virtual node
+func (w *ringWalk) note(node models.Node) {
+	if node.Addr == "" {
+		return
+	}
+	addr := fmt.Sprintf("%s/%d", node.Addr, node.VNode)
+	if other, ok := w.byID[node.ID]; !ok {
+		w.byID[node.ID] = node
+	} else if other.Addr != node.Addr || other.VNode != node.VNode {
+		w.clash(node, other)
+	}
+	if other, ok := w.byAddr[addr]; !ok {
+		w.byAddr[addr] = node
+	} else if other.ID != node.ID {
+		w.clash(node, other)
+	}
+}
+
+// clash - report node and other as duplicates, unless they already were
+func (w *ringWalk) clash(node, other models.Node) {
+	key := shortNode(node) + " " + shortNode(other)
+	if w.clashes[key] {
+		return
+	}
+	w.clashes[key] = true
+	w.problem(RingProblem{Type: Duplicate, Node: node, Found: other})
+}
+
+func (w *ringWalk) problem(p RingProblem) {
+	glog.Infof("ring check found %s", p.ToString())
+	w.report.Problems = append(w.report.Problems, p)
+}
+
+// successor - the node after the i'th walked node
+func (w *ringWalk) successor(i int) (models.Node, bool) {
+	nodes := w.report.Nodes
+	if i+1 < len(nodes) {
+		return nodes[i+1], true
+	}
+	if w.report.Complete {
+		return nodes[0], true
+	}
+	return models.Node{}, false
+}
+
+// owner - the walked node which should be the successor of id
+func (w *ringWalk) owner(id models.Identifier) models.Node {
+	nodes := make([]models.Node, len(w.report.Nodes))
+	copy(nodes, w.report.Nodes)
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Compare(nodes[j]) < 0
+	})
+	for _, node := range nodes {
+		if node.CompareID(id) >= 0 {
+			return node
+		}
+	}
+	return nodes[0]
+}
+
+// CheckRing - walk the ring from seed by following successors, and check it
+// is well formed.  Every node's successor must have it as predecessor, the
+// successors must go round the ring exactly once back to the seed without
+// skipping any live node we hear of, no node may appear twice, and every
+// finger must point at the successor of its start.  Nodes heard of but not
+// walked are pinged to tell gaps from dead nodes.  Each request of the walk
+// waits up to timeout.  An error is only returned when the walk could not be
+// completed.
+func CheckRing(seed models.Node, caller Caller, timeout time.Duration) (RingReport, error) {
+	var (
+		report = RingReport{Seed: seed}
+		w      = &ringWalk{
+			caller:  caller,
+			timeout: timeout,
+			report:  &report,
+			visited: make(map[models.Identifier]int),
+			preds:   make(map[models.Identifier]models.Node),
+			byID:    make(map[models.Identifier]models.Node),
+			byAddr:  make(map[string]models.Node),
+			clashes: make(map[string]bool),
+		}
+		current = seed
+	)
+
+	w.note(seed)
+	for {
+		if len(report.Nodes) >= MaxRingWalk {
+			return report, errors.New("ring walk never led back to the seed")
+		}
+		w.visited[current.ID] = len(report.Nodes)
+		report.Nodes = append(report.Nodes, current)
+
+		predecessor, successor, err := w.neighbours(current)
+		if err != nil {
+			w.problem(RingProblem{Type: Unreachable, Node: current, Err: err})
+			return report, errors.Wrap(err, "failed to walk the ring: ")
+		}
+		w.preds[current.ID] = predecessor
+		w.note(predecessor)
+		w.note(successor)
+
+		if i, ok := w.visited[successor.ID]; ok {
+			if i != 0 {
+				w.problem(RingProblem{Type: Loop, Node: current, Found: successor})
+				return report, errors.New("ring walk looped back before the seed")
+			}
+			report.Complete = true
+			break
+		}
+		current = successor
+	}
+
+	w.checkLinks()
+	w.checkWraps()
+	w.checkFingers()
+	w.checkGaps()
+	return report, nil
+}
+
+// context - a context for one request of the walk
+func (w *ringWalk) context() (context.Context, context.CancelFunc) {
+	return timeoutContext(w.timeout)
+}
+
+// neighbours - ask node for its predecessor, and its successor
+func (w *ringWalk) neighbours(node models.Node) (models.Node, models.Node, error) {
+	rn, err := NewRemoteNode(node)
+	if err != nil {
+		return models.Node{}, models.Node{}, errors.Wrap(err, "failed to create remote node: ")
+	}
+	ctx, cancel := w.context()
+	defer cancel()
+	predecessor, err := rn.GetPredecessor(ctx, w.caller)
+	if err != nil {
+		return models.Node{}, models.Node{}, errors.Wrap(err, "failed to get predecessor: ")
+	}
+	successor, err := rn.Successor(ctx, models.FingerStart(node.ID, 1), w.caller)
+	if err != nil {
+		return models.Node{}, models.Node{}, errors.Wrap(err, "failed to get successor: ")
+	}
+	return predecessor, successor, nil
+}
+
+// checkLinks - the predecessor of every walked node's successor should be
+// the node, a node alone on the ring has no predecessor
+func (w *ringWalk) checkLinks() {
+	if len(w.report.Nodes) == 1 {
+		return
+	}
+	for i, node := range w.report.Nodes {
+		successor, ok := w.successor(i)
+		if !ok {
+			continue
+		}
+		if predecessor := w.preds[successor.ID]; predecessor.Addr == "" ||
+			predecessor.ID != node.ID {
+			w.problem(RingProblem{
+				Type:     BrokenLink,
+				Node:     successor,
+				Expected: node,
+				Found:    predecessor,
+			})
+		}
+	}
+}
+
+// checkWraps - following successors should pass the top of the identifier
+// space exactly once, otherwise the nodes are out of order and the ring
+// loops round more than once
+func (w *ringWalk) checkWraps() {
+	if !w.report.Complete || len(w.report.Nodes) == 1 {
+		return
+	}
+	wraps := 0
+	for i, node := range w.report.Nodes {
+		if successor, _ := w.successor(i); successor.Compare(node) <= 0 {
+			wraps++
+		}
+	}
+	if wraps != 1 {
+		last := w.report.Nodes[len(w.report.Nodes)-1]
+		w.problem(RingProblem{Type: Loop, Node: last, Found: w.report.Seed})
+	}
+}
+
+// checkFingers - every finger of every walked node should point at the
+// walked node which is the successor of the finger's start
+func (w *ringWalk) checkFingers() {
+	if !w.report.Complete {
+		return
+	}
+	for _, node := range w.report.Nodes {
+		rn, err := NewRemoteNode(node)
+		if err != nil {
+			w.problem(RingProblem{Type: Unreachable, Node: node, Err: err})
+			continue
+		}
+		ctx, cancel := w.context()
+		fingers, err := rn.GetFingerTable(ctx, w.caller)
+		cancel()
+		if err != nil {
+			w.problem(RingProblem{Type: Unreachable, Node: node, Err: err})
+			continue
+		}
+		for _, finger := range fingers {
+			if finger.Successor.Addr == "" {
+				continue
+			}
+			w.note(finger.Successor)
+			expected := w.owner(models.FingerStart(node.ID, finger.I))
+			if finger.Successor.ID != expected.ID {
+				w.problem(RingProblem{
+					Type:     StaleFinger,
+					Node:     node,
+					Expected: expected,
+					Found:    finger.Successor,
+					Finger:   finger.I,
+				})
+			}
+		}
+	}
+}
+
+// checkGaps - every live node we heard of which was not walked has been
+// skipped by the node before it on the ring
+func (w *ringWalk) checkGaps() {
+	if !w.report.Complete {
+		return
+	}
+	for id, node := range w.byID {
+		if _, ok := w.visited[id]; ok {
+			continue
+		}
+		rn, err := NewRemoteNode(node)
+		if err != nil {
+			continue
+		}
+		ctx, cancel := w.context()
+		err = rn.Ping(ctx, w.caller)
+		cancel()
+		if err != nil {
+			glog.Infof("ring check skipping dead node %s: %v",
+				shortNode(node), err)
+			continue
+		}
+		for i, walked := range w.report.Nodes {
+			successor, _ := w.successor(i)
+			if models.Between(walked.ID, id, successor.ID) {
+				w.problem(RingProblem{
+					Type:     Gap,
+					Node:     walked,
+					Expected: node,
+					Found:    successor,
+				})
+				break
+			}
+		}
+	}
+}
+
+// RepairRing - fix the broken links and gaps found by a ring check, by
+// telling the successor on each side of the problem who its predecessor
+// should be.  Stabilization takes care of the rest.  Every problem is tried
+// until ctx is done, the number repaired and the first error are returned.
+func RepairRing(ctx context.Context, report RingReport, caller Caller) (int, error) {
+	var (
+		repaired  int
+		repairErr error
+	)
+	for _, p := range report.Problems {
+		var successor, predecessor models.Node
+		switch p.Type {
+		case BrokenLink:
+			successor, predecessor = p.Node, p.Expected
+		case Gap:
+			successor, predecessor = p.Found, p.Expected
+		default:
+			continue
+		}
+
+		rn, err := NewRemoteNode(successor)
+		if err == nil {
+			err = rn.SetPredecessor(ctx, predecessor, caller)
+		}
+		if err != nil {
+			glog.Infof("failed to repair %s: %v", p.ToString(), err)
+			if repairErr == nil {
+				repairErr = errors.Wrap(err, "failed to repair ring: ")
+			}
+			continue
+		}
+		repaired++
+	}
+	return repaired, repairErr
+}
@@ -6,4 +6,10 @@ const (
 	// MaxFingerTableSize - the maximum number of entries in a finger table which
 	// is the number of bits in the hash, 8 bits per byte, 20 bytes in hash
 	MaxFingerTableSize int = models.M
+	// MaxLookupHops - the most hops an iterative lookup takes before giving
+	// up, a lookup should never need more hops than there are fingers
+	MaxLookupHops int = models.M
+	// MaxRingWalk - the most nodes a ring check walks before giving up on
+	// the successors ever leading back to the seed
+	MaxRingWalk int = 1 << 16
 )
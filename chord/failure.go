@@ -0,0 +1,124 @@
+package chord
+
+import (
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// FailureDetector - pings the nodes a local node knows about, and removes
+// the ones that stop answering from the ring state of the local node
+type FailureDetector struct {
+	ln *LocalNode
+	// timeout - how long to wait on a ping before counting it as failed,
+	// zero waits as long as the ping takes
+	timeout time.Duration
+	// maxFailures - how many pings in a row a node may fail before it is
+	// considered dead
+	maxFailures uint
+
+	failures map[models.Identifier]uint
+	mu       *sync.Mutex
+}
+
+// NewFailureDetector - create a new failure detector for the local node
+func NewFailureDetector(ln *LocalNode, timeout time.Duration, maxFailures uint) *FailureDetector {
+	if maxFailures == 0 {
+		maxFailures = 1
+	}
+	return &FailureDetector{
+		ln:          ln,
+		timeout:     timeout,
+		maxFailures: maxFailures,
+		failures:    make(map[models.Identifier]uint),
+		mu:          new(sync.Mutex),
+	}
+}
+
+// ping - ping the node, and return true if it has now failed maxFailures
+// pings in a row
+func (fd *FailureDetector) ping(node models.Node) bool {
+	rn, err := NewRemoteNode(node)
+	if err == nil {
+		ctx, cancel := timeoutContext(fd.timeout)
+		err = rn.Ping(ctx, fd.ln.caller)
+		cancel()
+	}
+
+	fd.mu.Lock()
+	defer fd.mu.Unlock()
+	if err == nil {
+		delete(fd.failures, node.ID)
+		return false
+	}
+	fd.failures[node.ID]++
+	glog.Infof("ping to id=%s failed (%d/%d): %v\n",
+		hex.EncodeToString(node.ID[:]), fd.failures[node.ID], fd.maxFailures, err)
+	if fd.failures[node.ID] < fd.maxFailures {
+		return false
+	}
+	delete(fd.failures, node.ID)
+	return true
+}
+
+// CheckPredecessor - ping our predecessor, and clear it if it is dead so
+// that the next node to notify us can take its place
+func (fd *FailureDetector) CheckPredecessor() error {
+	predecessor, err := fd.ln.GetPredecessor()
+	if err != nil {
+		return errors.Wrap(err, "failed to get predecessor: ")
+	}
+	if predecessor.Addr == "" || fd.ln.CompareID(predecessor.ID) == 0 {
+		return nil
+	}
+	if fd.ping(predecessor) {
+		fd.ln.clearPredecessor(predecessor)
+	}
+	return nil
+}
+
+// CheckFingers - ping every distinct node in our finger table and successor
+// list, and evict the ones that are dead
+func (fd *FailureDetector) CheckFingers() error {
+	nodes := make(map[models.Identifier]models.Node)
+	for i := uint64(1); i <= models.M; i++ {
+		finger, err := fd.ln.fingerTable.GetIth(i)
+		if err != nil {
+			return errors.Wrap(err, "failed to get finger: ")
+		}
+		if finger.Successor.Addr != "" {
+			nodes[finger.Successor.ID] = finger.Successor
+		}
+	}
+	for _, node := range fd.ln.GetSuccessorList() {
+		nodes[node.ID] = node
+	}
+	delete(nodes, fd.ln.ID)
+
+	var (
+		wg   sync.WaitGroup
+		dead = make(chan models.Node, len(nodes))
+	)
+	for _, node := range nodes {
+		wg.Add(1)
+		go func(node models.Node) {
+			defer wg.Done()
+			if fd.ping(node) {
+				dead <- node
+			}
+		}(node)
+	}
+	wg.Wait()
+	close(dead)
+
+	for node := range dead {
+		if err := fd.ln.evict(node); err != nil {
+			return errors.Wrap(err, "failed to evict node: ")
+		}
+	}
+	return nil
+}
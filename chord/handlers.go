@@ -7,8 +7,10 @@ import (
 	"encoding/hex"
 
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
 )
 
 // SuccessorHandler - the handler to handle all server calls to get successor for this local node
@@ -29,22 +31,22 @@ func (ln *LocalNode) SuccessorHandler(ctx context.Context, r *protocol.Request)
 	err := dec.Decode(in)
 	if err != nil {
 		glog.Infof("decode successor request error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid successor request")
 	}
 
 	// this point we have the ID, time to call successor on ln
-	node, err := ln.Successor(in.ID)
+	node, err := ln.Successor(ctx, in.ID)
+	if err != nil {
+		glog.Infof("successor failed: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Unavailable, "failed to find successor")
+	}
 	glog.Infof("successor found: %s\n",
 		node.ToString())
 
 	enc := gob.NewEncoder(out)
 	if err := enc.Encode(node); err != nil {
 		glog.Infof("encode successor response error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode successor")
 	}
 	// write the response to the bytes of the response data
 	response.Data = out.Bytes()
@@ -55,6 +57,46 @@ func (ln *LocalNode) SuccessorHandler(ctx context.Context, r *protocol.Request)
 	return response
 }
 
+// ClosestPrecedingNodeHandler - the handler to handle a single hop of an
+// iterative lookup, answering with our successor and our closest node
+// preceding the id
+func (ln *LocalNode) ClosestPrecedingNodeHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		body = bytes.NewBuffer(r.Data)
+		in   = &models.ClosestPrecedingRequest{}
+		out  = &bytes.Buffer{}
+	)
+
+	if err := gob.NewDecoder(body).Decode(in); err != nil {
+		glog.Infof("decode closest preceding request error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid closest preceding request")
+	}
+
+	failed := map[models.Identifier]bool{}
+	for _, id := range in.Failed {
+		failed[id] = true
+	}
+
+	closest, err := ln.closestPrecedingNode(in.ID, failed)
+	if err != nil {
+		glog.Infof("closest preceding node failed: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Unavailable, "failed to find closest preceding node")
+	}
+
+	if err := gob.NewEncoder(out).Encode(models.ClosestPrecedingResponse{
+		Successor: ln.liveSuccessor(failed),
+		Closest:   closest,
+	}); err != nil {
+		glog.Infof("encode closest preceding response error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode closest preceding node")
+	}
+
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   out.Bytes(),
+	}
+}
+
 // GetPredecessorHandler - the handler to handle all server calls to get predecessor for this local node
 func (ln *LocalNode) GetPredecessorHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var (
@@ -67,9 +109,7 @@ func (ln *LocalNode) GetPredecessorHandler(ctx context.Context, r *protocol.Requ
 	predecessor, _ := ln.GetPredecessor()
 	if err := enc.Encode(predecessor); err != nil {
 		glog.Infof("encode successor response error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode predecessor")
 	}
 	// write the response to the bytes of the response data
 	response.Data = out.Bytes()
@@ -98,9 +138,7 @@ func (ln *LocalNode) SetPredecessorHandler(ctx context.Context, r *protocol.Requ
 	err := dec.Decode(in)
 	if err != nil {
 		glog.Infof("decode successor request error: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid predecessor")
 	}
 
 	glog.Infof("Set Predecessor Handler is getting set to: %s", in)
@@ -109,9 +147,7 @@ func (ln *LocalNode) SetPredecessorHandler(ctx context.Context, r *protocol.Requ
 	err = ln.SetPredecessor(*in)
 	if err != nil {
 		glog.Infof("set predecessor failed: %v\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Conflict, err.Error())
 	}
 
 	newPredecessor, _ := ln.GetPredecessor()
@@ -122,6 +158,97 @@ func (ln *LocalNode) SetPredecessorHandler(ctx context.Context, r *protocol.Requ
 	return response
 }
 
+// SuccessorListHandler - the handler to handle all server calls to get the successor list for this local node
+func (ln *LocalNode) SuccessorListHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		response = protocol.Response{
+			Status: protocol.Success,
+		}
+		out = new(bytes.Buffer)
+	)
+	enc := gob.NewEncoder(out)
+	successors := ln.GetSuccessorList()
+	if err := enc.Encode(successors); err != nil {
+		glog.Infof("encode successor list response error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode successor list")
+	}
+	// write the response to the bytes of the response data
+	response.Data = out.Bytes()
+
+	glog.Infof("response for successor list handler: %d successors\n",
+		len(successors))
+
+	return response
+}
+
+// SuccessorLeaveHandler - the handler to handle our successor leaving the ring
+func (ln *LocalNode) SuccessorLeaveHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		body = bytes.NewBuffer(r.Data)
+		in   = &models.LeaveRequest{}
+	)
+
+	if err := gob.NewDecoder(body).Decode(in); err != nil {
+		glog.Infof("decode leave request error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid leave request")
+	}
+	if err := callerIsLeaving(ctx, in.Leaving); err != nil {
+		glog.Infof("successor leave refused: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Forbidden, err.Error())
+	}
+
+	if err := ln.successorLeft(in.Leaving, in.Replacement); err != nil {
+		glog.Infof("successor leave failed: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Conflict, err.Error())
+	}
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
+
+// PredecessorLeaveHandler - the handler to handle our predecessor leaving the ring
+func (ln *LocalNode) PredecessorLeaveHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var (
+		body = bytes.NewBuffer(r.Data)
+		in   = &models.LeaveRequest{}
+	)
+
+	if err := gob.NewDecoder(body).Decode(in); err != nil {
+		glog.Infof("decode leave request error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid leave request")
+	}
+	if err := callerIsLeaving(ctx, in.Leaving); err != nil {
+		glog.Infof("predecessor leave refused: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Forbidden, err.Error())
+	}
+
+	if err := ln.predecessorLeft(in.Leaving, in.Replacement); err != nil {
+		glog.Infof("predecessor leave failed: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Conflict, err.Error())
+	}
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
+
+// callerIsLeaving - only the server hosting the leaving virtual node may
+// say it is leaving, its id has to be bound to the key of the caller
+func callerIsLeaving(ctx context.Context, leaving models.Node) error {
+	caller := protocol.CallerFromContext(ctx)
+	if !caller.Verified || caller.PublicKey == nil {
+		return errors.New("caller is not verified")
+	}
+	if leaving.PublicKey != nil && !leaving.PublicKey.Equal(caller.PublicKey) {
+		return errors.New("leaving node has another key than the caller")
+	}
+	if err := crypto.VerifyVirtualKeyID(leaving.ID, caller.PublicKey, leaving.VNode); err != nil {
+		return errors.New("leaving node is not hosted by the caller")
+	}
+	return nil
+}
+
 // FingerTableHandler - the handler to handle all server calls to get the finger table for the local node
 func (ln *LocalNode) FingerTableHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	// get the request, pull out the ID from the request body
@@ -133,10 +260,9 @@ func (ln *LocalNode) FingerTableHandler(ctx context.Context, r *protocol.Request
 	)
 
 	enc := gob.NewEncoder(out)
-	if err := enc.Encode(ln.fingerTable); err != nil {
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+	if err := enc.Encode(ln.fingerTable.Fingers()); err != nil {
+		glog.Infof("encode finger table response error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode finger table")
 	}
 	// write the response to the bytes of the response data
 	response.Data = out.Bytes()
@@ -0,0 +1,166 @@
+package chord
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Host - the virtual nodes hosted by a single server.  Each virtual node has
+// its own ID and finger table, so a server is responsible for several smaller
+// ranges of the ring instead of one large one, which evens out how keys are
+// spread over servers.
+type Host struct {
+	nodes []*LocalNode
+}
+
+// NewHost - create count virtual nodes on the server, none of which are part
+// of a ring until the host joins one
+func NewHost(s *protocol.Server, addr string, count, successorListSize, replicationFactor uint) (*Host, error) {
+	if count < 1 {
+		return nil, errors.New("a host needs at least one virtual node")
+	}
+	h := &Host{}
+	for i := uint(0); i < count; i++ {
+		ln, err := NewLocalNode(s, addr, i, successorListSize, replicationFactor)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create virtual node: ")
+		}
+		ln.host = h
+		h.nodes = append(h.nodes, ln)
+	}
+	return h, nil
+}
+
+// Nodes - the virtual nodes of this host
+func (h *Host) Nodes() []*LocalNode {
+	return h.nodes
+}
+
+// Join - join all of the virtual nodes to the ring, the first through peer
+// and the rest through the first.  The virtual nodes talk to each other over
+// the network like any other nodes, so the server has to be serving already.
+// If peer is empty the first virtual node starts a new ring.
+// A virtual node failing to join does not stop the rest from joining, the
+// first error is returned once all of them have tried.
+func (h *Host) Join(peer models.Node) error {
+	var joinErr error
+	for i, ln := range h.nodes {
+		if i > 0 {
+			peer = h.nodes[0].ToNode()
+		}
+		if peer.Addr == "" {
+			glog.Infof("virtual node id=%s starting a new ring",
+				hex.EncodeToString(ln.ID[:]))
+			continue
+		}
+		if err := ln.Initialize(peer); err != nil {
+			glog.Infof("virtual node id=%s failed to join: %v\n",
+				hex.EncodeToString(ln.ID[:]), err)
+			if joinErr == nil {
+				joinErr = errors.Wrap(err, "failed to join virtual node: ")
+			}
+		}
+	}
+	return joinErr
+}
+
+// Leave - have all of the virtual nodes leave the ring.  A virtual node
+// failing to leave does not stop the rest from leaving, the errors of all
+// the ones that failed are returned together.  Leaving gives up once ctx is
+// done.
+func (h *Host) Leave(ctx context.Context) error {
+	failed := []string{}
+	for _, ln := range h.nodes {
+		if err := ln.Leave(ctx); err != nil {
+			glog.Infof("virtual node id=%s failed to leave: %v\n",
+				hex.EncodeToString(ln.ID[:]), err)
+			failed = append(failed, fmt.Sprintf("id=%s: %v",
+				hex.EncodeToString(ln.ID[:]), err))
+		}
+	}
+	if len(failed) > 0 {
+		return errors.Errorf("failed to leave %d virtual nodes: %s",
+			len(failed), strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// SuccessorList - the successor list of the virtual node in charge of key
+func (h *Host) SuccessorList(key [20]byte) []models.Node {
+	return h.owner(key).GetSuccessorList()
+}
+
+// Ranges - the ranges of the ring the virtual nodes are in charge of, a
+// virtual node which does not know its predecessor yet has no range
+func (h *Host) Ranges() []models.KeyRangeRequest {
+	ranges := []models.KeyRangeRequest{}
+	for _, ln := range h.nodes {
+		predecessor, _ := ln.GetPredecessor()
+		if predecessor.Addr == "" {
+			continue
+		}
+		ranges = append(ranges, models.KeyRangeRequest{
+			Low:  predecessor.ID,
+			High: ln.ID,
+		})
+	}
+	return ranges
+}
+
+// owner - the virtual node whose range contains key, falling back to the
+// first virtual node when none of them know their predecessor yet
+func (h *Host) owner(key models.Identifier) *LocalNode {
+	for _, ln := range h.nodes {
+		predecessor, _ := ln.GetPredecessor()
+		if predecessor.Addr != "" &&
+			models.BetweenRightIncl(predecessor.ID, key, ln.ID) {
+			return ln
+		}
+	}
+	return h.nodes[0]
+}
+
+// local - the virtual node of this host with the given id, nil if there is
+// none, or no host at all
+func (h *Host) local(id models.Identifier) *LocalNode {
+	if h == nil {
+		return nil
+	}
+	for _, ln := range h.nodes {
+		if ln.CompareID(id) == 0 {
+			return ln
+		}
+	}
+	return nil
+}
+
+// node - the virtual node a request should be handled by, either the one it
+// was sent to, or the one closest preceding the key of the request as that
+// one will be the fewest hops away from the answer
+func (h *Host) node(to, key models.Identifier) *LocalNode {
+	if ln := h.local(to); ln != nil {
+		return ln
+	}
+	closest := h.nodes[0]
+	for _, ln := range h.nodes[1:] {
+		if models.BetweenRightIncl(closest.ID, ln.ID, key) {
+			closest = ln
+		}
+	}
+	return closest
+}
+
+// Dispatch - wrap a local node handler, such as (*LocalNode).SuccessorHandler,
+// so that requests are handled by the right virtual node
+func (h *Host) Dispatch(fn func(*LocalNode, context.Context, *protocol.Request) protocol.Response) protocol.Handler {
+	return func(ctx context.Context, r *protocol.Request) protocol.Response {
+		return fn(h.node(r.Header.To, r.Header.Key), ctx, r)
+	}
+}
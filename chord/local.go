@@ -4,16 +4,37 @@ import (
 	"bytes"
 	"context"
 	"crypto/rsa"
-	"crypto/sha1"
 	"encoding/hex"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/file"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
 	"github.com/pkg/errors"
 )
 
+// RequestTimeout - how long a node waits on each request it makes of the
+// ring on its own account, while stabilizing, fixing fingers and moving
+// keys.  A key moved between nodes has to arrive whole within it.
+var RequestTimeout = 10 * time.Second
+
+// requestContext - a context for one request made on the node's own account
+func requestContext() (context.Context, context.CancelFunc) {
+	return timeoutContext(RequestTimeout)
+}
+
+// timeoutContext - a context which is done after timeout, a zero timeout
+// never gives up
+func timeoutContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
 // LocalNode - Implementation of ChordNode which holds the
 // datastructure representing a local chord node.
 type LocalNode struct {
@@ -23,37 +44,68 @@ type LocalNode struct {
 
 	predecessor      models.Node
 	predecessorMutex *sync.RWMutex
-	server           *protocol.Server
+	// successorList - the next successorListSize nodes on the ring, the
+	// first entry is the successor, the rest are fallbacks for when it fails
+	successorList     []models.Node
+	successorListSize uint
+	successorListMu   *sync.RWMutex
+	// replicationFactor - the number of nodes holding a copy of every key,
+	// ours and our replicas
+	replicationFactor uint
+	server            *protocol.Server
+	// caller - who requests to other nodes are made as, the server the
+	// node is hosted by
+	caller Caller
+	// dataPath - where the keys this node is in charge of are stored
+	dataPath string
+	// host - the virtual nodes hosted by the same server, nil if this node
+	// is not part of one
+	host *Host
 }
 
-// NewLocalNode - Creation of the new local node
-func NewLocalNode(s *protocol.Server, addr string, peer models.Node) (*LocalNode, error) {
+// NewLocalNode - Creation of the new local node, vnode is which of the
+// server's virtual nodes this is, successorListSize is the number of
+// successors this node will keep track of, and replicationFactor the number
+// of nodes holding a copy of every key.  The node is not part of a ring
+// until it is initialized against a peer.
+func NewLocalNode(s *protocol.Server, addr string, vnode, successorListSize, replicationFactor uint) (*LocalNode, error) {
+	if vnode >= models.MaxVirtualNodes {
+		return nil, errors.New("too many virtual nodes")
+	}
+	// our id is bound to our public key and virtual node index
+	id, err := crypto.VirtualKeyID(s.PrivateKey.Public().(*rsa.PublicKey), vnode)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive node id: ")
+	}
+	caller, err := NodeCaller(s.Network(), s.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
 	// make a new finger table for this node
 	n := models.Node{
-		Addr: addr,
-		ID: models.Identifier(
-			sha1.Sum([]byte(addr)),
-		),
+		Addr:      addr,
+		ID:        models.Identifier(id),
 		PublicKey: s.PrivateKey.Public().(*rsa.PublicKey),
+		VNode:     vnode,
 	}
 
-	var (
-		fingerTable = models.NewFingerTable()
-		err         error
-	)
+	fingerTable := models.NewFingerTable()
 	// set initial finger table to have self for the whole range
 	ln := &LocalNode{
-		&n, fingerTable, models.Node{}, new(sync.RWMutex), s,
+		Node:              &n,
+		fingerTable:       fingerTable,
+		predecessorMutex:  new(sync.RWMutex),
+		successorList:     []models.Node{},
+		successorListSize: successorListSize,
+		successorListMu:   new(sync.RWMutex),
+		replicationFactor: replicationFactor,
+		server:            s,
+		caller:            caller,
+		dataPath:          s.DataPath(),
 	}
 	fingerTable.SetIth(1, models.NewInterval(n, n), n, ln.ToNode())
 	glog.Infof("bootstrapping fingertable: %s", fingerTable.ToString())
-	// create a new local node
-
-	if &peer != nil {
-		// run the initialization process
-		err = ln.Initialize(peer)
-	}
-	return ln, err
+	return ln, nil
 }
 
 // UserRegistrationHandler - this handler handles all user registrations.  A user
@@ -70,13 +122,20 @@ func (ln LocalNode) ToNode() models.Node {
 		Addr:      ln.Addr,
 		ID:        ln.ID,
 		PublicKey: ln.server.PrivateKey.Public().(*rsa.PublicKey),
+		VNode:     ln.VNode,
 	}
 }
 
 // Stabilize - stabilize the chord ring, makes sure we are actually predecessor
 func (ln *LocalNode) Stabilize() error {
+	// make sure our successor is still alive, falling back to the next
+	// successor in our list if it isn't
+	if err := ln.refreshSuccessorList(); err != nil {
+		glog.Infof("failed to refresh successor list: %s", err)
+	}
+
 	// call successor's predecessor function to see we we are still the predecessor
-	currentSuccessor, err := ln.Successor(ln.ID)
+	currentSuccessor, err := ln.GetSuccessor()
 	if err != nil {
 		glog.Infof("failed to get successor for stabilize: %s", err)
 		return errors.Wrap(err, "failed to get successor: ")
@@ -98,13 +157,15 @@ func (ln *LocalNode) Stabilize() error {
 			glog.Infof("--------------here is predecessor: %s", predecessor)
 			for {
 				// lookup the public key for the predecessor
-				predecessorRN, err := NewRemoteNode(predecessor.Addr, predecessor.PublicKey)
+				predecessorRN, err := NewRemoteNode(predecessor)
 				if err != nil {
 					glog.Infof("error creating new remote node for predecessor: %v\n", err)
 					break
 				}
 
-				nextPredecessor, err := predecessorRN.GetPredecessor(ln.server.PrivateKey)
+				ctx, cancel := requestContext()
+				nextPredecessor, err := predecessorRN.GetPredecessor(ctx, ln.caller)
+				cancel()
 				if err != nil {
 					glog.Infof("error getting new predecessor on remote node: %v\n", err)
 					break
@@ -113,12 +174,9 @@ func (ln *LocalNode) Stabilize() error {
 				if nextPredecessor.Addr == "" {
 					// predecessor was our last one in the chain
 					ln.SetSuccessor(predecessor)
-					newPredecessorRN, err := NewRemoteNode(predecessor.Addr, predecessor.PublicKey)
-					if err != nil {
-						glog.Infof("error creating new remote node for predecessor: %v\n", err)
-						break
+					if err := ln.notify(predecessor); err != nil {
+						glog.Infof("error notifying new successor: %v\n", err)
 					}
-					newPredecessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey)
 					break
 				}
 				predecessor = nextPredecessor
@@ -126,13 +184,15 @@ func (ln *LocalNode) Stabilize() error {
 		}
 	} else {
 
-		successorRN, err := NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
+		successorRN, err := NewRemoteNode(currentSuccessor)
 		if err != nil {
 			glog.Infof("error creating new remote node for successor: %v\n", err)
 			return errors.Wrap(err, "error creating new remote node for successor: ")
 		}
 
-		currentSuccessorPredecessor, err := successorRN.GetPredecessor(ln.server.PrivateKey)
+		ctx, cancel := requestContext()
+		currentSuccessorPredecessor, err := successorRN.GetPredecessor(ctx, ln.caller)
+		cancel()
 		glog.Infof("stabilize for id=%s, successor id=%s thinks id=%s is predecessor\n",
 			hex.EncodeToString(ln.ID[:]),
 			hex.EncodeToString(currentSuccessor.ID[:]),
@@ -144,11 +204,16 @@ func (ln *LocalNode) Stabilize() error {
 			return errors.Wrap(err, "error setting new predecessor on remote node:")
 		}
 
-		lnID := models.KeyToID(ln.ID)
-		succPredID := models.KeyToID(currentSuccessorPredecessor.ID)
-		succID := models.KeyToID(currentSuccessor.ID)
+		if currentSuccessorPredecessor.Addr == "" {
+			// successor has no predecessor, so we are it
+			if err := ln.notify(currentSuccessor); err != nil {
+				glog.Infof("error setting successor's predecessor to self: %v\n", err)
+				return errors.Wrap(err, "error setting successor's predecessor to self: ")
+			}
+			return nil
+		}
 
-		if succPredID == lnID {
+		if ln.CompareID(currentSuccessorPredecessor.ID) == 0 {
 			// no update! We are still the predecessor
 			glog.Infof("self is still predecessor of successor - %s == %s\n",
 				hex.EncodeToString(ln.ID[:]),
@@ -157,122 +222,327 @@ func (ln *LocalNode) Stabilize() error {
 			return nil
 		}
 
-		if succPredID < succID {
-			if succPredID < lnID && lnID < succID {
-				// change the successor to use ln as predecessor
-				successorRN, err = NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for successor: %v\n", err)
-					errors.Wrap(err, "error creating new remote node for successor: ")
-				}
-				glog.Info("!!! succPredID < lnID -> CORRECTING HERE")
-				if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error resetting successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
+		if models.Between(ln.ID, currentSuccessorPredecessor.ID, currentSuccessor.ID) {
+			// change ln successor to new successor pred
+			glog.Infof("self is no longer predecessor of successor - %s < %s\n",
+				hex.EncodeToString(ln.ID[:]),
+				hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
+			)
 
-				glog.Infof("stabilize for id=%s, corrected successor id=%s thinks id=%s is predecessor now\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessor.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-			} else {
-				// change ln successor to new successor pred
-				glog.Infof("self is no longer predecessor of successor - %s < %s\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				ln.SetSuccessor(currentSuccessorPredecessor)
-				glog.Infof("self is setting successor to id=%s\n",
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				newSuccessorRN, err := NewRemoteNode(currentSuccessorPredecessor.Addr, currentSuccessorPredecessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for new successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for new  successor: ")
-				}
+			ln.SetSuccessor(currentSuccessorPredecessor)
+			glog.Infof("self is setting successor to id=%s\n",
+				hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
+			)
 
-				// set the new successor's predecessor to ourselves
-				if err := newSuccessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error setting new successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-				glog.Infof("self is setting predecessor of the new successor id=%s to self\n",
-					hex.EncodeToString(ln.ID[:]),
-				)
+			// set the new successor's predecessor to ourselves
+			if err := ln.notify(currentSuccessorPredecessor); err != nil {
+				glog.Infof("error setting new successor's predecessor to self: %v\n", err)
+				return errors.Wrap(err, "error setting new successor's predecessor to self: ")
 			}
+			glog.Infof("self is setting predecessor of the new successor id=%s to self\n",
+				hex.EncodeToString(ln.ID[:]),
+			)
 		} else {
-			if succPredID < lnID || lnID < succID {
-				// use new succ pred
-				// change ln successor to new successor pred
-				glog.Infof("self is no longer predecessor of successor - %s < %s\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				glog.Infof("!!! lnID < succPredID && succPredID < succID : %d < %d && %d < %d",
-					lnID, succPredID, succPredID, succID,
-				)
-				ln.SetSuccessor(currentSuccessorPredecessor)
-				glog.Infof("self is setting successor to id=%s\n",
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-
-				newSuccessorRN, err := NewRemoteNode(currentSuccessorPredecessor.Addr, currentSuccessorPredecessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for new successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for new  successor: ")
-				}
+			// we are between the successor's predecessor and the successor,
+			// change the successor to use ln as predecessor
+			if err := ln.notify(currentSuccessor); err != nil {
+				glog.Infof("error resetting successor's predecessor to self: %v\n", err)
+				return errors.Wrap(err, "error setting new successor's predecessor to self: ")
+			}
 
-				// set the new successor's predecessor to ourselves
-				if err := newSuccessorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error setting new successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
-				glog.Infof("self is setting predecessor of the new successor id=%s to self\n",
-					hex.EncodeToString(ln.ID[:]),
-				)
+			glog.Infof("stabilize for id=%s, corrected successor id=%s thinks id=%s is predecessor now\n",
+				hex.EncodeToString(ln.ID[:]),
+				hex.EncodeToString(currentSuccessor.ID[:]),
+				hex.EncodeToString(ln.ID[:]),
+			)
+		}
+	}
 
-			} else {
-				// change the successor to use ln as predecessor
-				successorRN, err = NewRemoteNode(currentSuccessor.Addr, currentSuccessor.PublicKey)
-				if err != nil {
-					glog.Infof("error creating new remote node for successor: %v\n", err)
-					return errors.Wrap(err, "error creating new remote node for successor: ")
-				}
-				glog.Info("!!!CORRECTING HERE")
-				glog.Infof("!!! lnID < succPredID && succPredID < succID : %d < %d && %d < %d",
-					lnID, succPredID, succPredID, succID,
-				)
-				if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-					glog.Infof("error resetting successor's predecessor to self", err)
-					return errors.Wrap(err, "error setting new successor's predecessor to self: ")
-				}
+	// if not, set this node's successor to the predecessor, and update the new
+	// successor with us as it's predecessor, notify takes care of migrating
+	// the values we are now in charge of
+	return nil
+}
 
-				glog.Infof("stabilize for id=%s, corrected successor id=%s thinks id=%s is predecessor now\n",
-					hex.EncodeToString(ln.ID[:]),
-					hex.EncodeToString(currentSuccessor.ID[:]),
-					hex.EncodeToString(currentSuccessorPredecessor.ID[:]),
-				)
-			}
+// notify - tell successor that we are its predecessor.  When the successor
+// accepts, we are now in charge of the keys between its old predecessor and
+// ourselves, so pull them over from the successor.
+func (ln *LocalNode) notify(successor models.Node) error {
+	successorRN, err := NewRemoteNode(successor)
+	if err != nil {
+		glog.Infof("error creating new remote node for successor: %v\n", err)
+		return errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+
+	ctx, cancel := requestContext()
+	oldPredecessor, err := successorRN.GetPredecessor(ctx, ln.caller)
+	cancel()
+	if err != nil {
+		glog.Infof("error getting predecessor on remote node: %v\n", err)
+		return errors.Wrap(err, "error getting predecessor on remote node: ")
+	}
+
+	ctx, cancel = requestContext()
+	err = successorRN.SetPredecessor(ctx, ln.ToNode(), ln.caller)
+	cancel()
+	if err != nil {
+		glog.Infof("error setting new predecessor on remote node: %v\n", err)
+		return errors.Wrap(err, "error setting new predecessor on remote node: ")
+	}
+
+	if ln.CompareID(oldPredecessor.ID) == 0 {
+		// we were already the predecessor, nothing changed hands
+		return nil
+	}
+
+	// if the successor had no predecessor it was in charge of the whole ring
+	low := oldPredecessor.ID
+	if oldPredecessor.Addr == "" {
+		low = successor.ID
+	}
+	return ln.migrateKeys(successor, low)
+}
+
+// migrateKeys - move every blob in (low, ln] from successor to our data
+// path, owner/secret header included
+func (ln *LocalNode) migrateKeys(successor models.Node, low models.Identifier) error {
+	if successor.CompareID(ln.ID) == 0 || successor.Addr == ln.Addr {
+		// virtual nodes of the same server share our data path, the keys
+		// are already where they need to be
+		return nil
+	}
+
+	successorRN, err := NewRemoteNode(successor)
+	if err != nil {
+		return errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+
+	ctx, cancel := requestContext()
+	keys, err := successorRN.ListKeys(ctx, low, ln.ID, ln.caller)
+	cancel()
+	if err != nil {
+		glog.Infof("error listing keys on successor: %v\n", err)
+		return errors.Wrap(err, "error listing keys on successor: ")
+	}
+	glog.Infof("migrating %d keys from successor id=%s",
+		len(keys), hex.EncodeToString(successor.ID[:]))
+
+	for _, key := range keys {
+		if err := ln.migrateKey(successorRN, key); err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	// if not, set this node's successor to the predecessor, and update the new
-	// successor with us as it's predecessor
+// migrateKey - move key from successor to our data path, giving up on it
+// after RequestTimeout
+func (ln *LocalNode) migrateKey(successorRN *RemoteNode, key models.Identifier) error {
+	ctx, cancel := requestContext()
+	defer cancel()
 
-	// TODO: migrate values we are now in charge of!
+	blob, err := successorRN.TransferKey(ctx, key, ln.caller)
+	if err != nil {
+		glog.Infof("error transferring key=%s: %v\n", hex.EncodeToString(key[:]), err)
+		return errors.Wrap(err, "error transferring key: ")
+	}
+	// the blob is streamed straight to storage, which only replaces
+	// the key once all of it has arrived
+	err = file.Post(ln.dataPath, key, blob)
+	blob.Close()
+	if err != nil {
+		glog.Infof("error storing key=%s: %v\n", hex.EncodeToString(key[:]), err)
+		return errors.Wrap(err, "error storing key: ")
+	}
+	// the successor is no longer in charge of the key, but being the node
+	// right after us it is the first of our replicas, and keeps its copy
+	// unless there are no replicas
+	if ln.replicationFactor > 1 {
+		return nil
+	}
+	if err := successorRN.DeleteReplica(ctx, key, ln.caller); err != nil {
+		glog.Infof("error removing key=%s from successor: %v\n",
+			hex.EncodeToString(key[:]), err)
+		return errors.Wrap(err, "error removing key from successor: ")
+	}
 	return nil
 }
 
-// SetSuccessor - Set the successor for this local node, which is the 1st ith
+// FixFingers - refresh the finger table, the i'th entry is set to the
+// successor of ln + 2^(i-1), which is what keeps lookups at O(log N) hops
+func (ln *LocalNode) FixFingers() error {
+	for i := uint64(2); i <= models.M; i++ {
+		start := models.FingerStart(ln.ID, i)
+		end := ln.ID
+		if i < models.M {
+			end = models.FingerStart(ln.ID, i+1)
+		}
+		interval := models.Interval{
+			Low:  start,
+			High: end,
+		}
+
+		previous, err := ln.fingerTable.GetIth(i - 1)
+		if err != nil {
+			return errors.Wrap(err, "failed to fix fingers: ")
+		}
+
+		// if start falls between us and the previous finger's successor,
+		// that node is this finger's successor as well, no lookup needed
+		covered := models.BetweenRightIncl(ln.ID, start, previous.Successor.ID)
+
+		successor := previous.Successor
+		if !covered || previous.Successor.Addr == "" {
+			ctx, cancel := requestContext()
+			successor, err = ln.Successor(ctx, start)
+			cancel()
+			if err != nil {
+				glog.Infof("failed to find successor for finger %d: %v\n", i, err)
+				continue
+			}
+		}
+
+		if err := ln.fingerTable.SetIth(i, interval, successor, ln.ToNode()); err != nil {
+			return errors.Wrap(err, "failed to fix fingers: ")
+		}
+	}
+	glog.Infof("fixed fingers: %s", ln.fingerTable.ToString())
+	return nil
+}
+
+// GetSuccessor - Get the successor for this local node, which is the 1st ith
 // entry in the finger table
+func (ln *LocalNode) GetSuccessor() (models.Node, error) {
+	successor, err := ln.fingerTable.GetIth(1)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to get successor: ")
+	}
+	return successor.Successor, nil
+}
+
+// SetSuccessor - Set the successor for this local node, which is the 1st ith
+// entry in the finger table, as well as the head of the successor list
 func (ln *LocalNode) SetSuccessor(node models.Node) error {
+	ln.successorListMu.Lock()
+	if len(ln.successorList) == 0 || ln.successorList[0].CompareID(node.ID) != 0 {
+		list := []models.Node{}
+		if ln.CompareID(node.ID) != 0 {
+			list = append(list, node)
+		}
+		for _, n := range ln.successorList {
+			if n.CompareID(node.ID) != 0 && uint(len(list)) < ln.successorListSize {
+				list = append(list, n)
+			}
+		}
+		ln.successorList = list
+	}
+	ln.successorListMu.Unlock()
 	return ln.fingerTable.SetIth(1, models.NewInterval(ln.ToNode(), node), node, ln.ToNode())
 }
 
+// GetSuccessorList - Get a copy of the successor list for this local node
+func (ln *LocalNode) GetSuccessorList() []models.Node {
+	ln.successorListMu.RLock()
+	defer ln.successorListMu.RUnlock()
+	list := make([]models.Node, len(ln.successorList))
+	copy(list, ln.successorList)
+	return list
+}
+
+// liveSuccessor - our first successor which is not in failed, or ourself
+// if every successor we know of has failed
+func (ln *LocalNode) liveSuccessor(failed map[models.Identifier]bool) models.Node {
+	if successor, err := ln.GetSuccessor(); err == nil && !failed[successor.ID] {
+		return successor
+	}
+	for _, successor := range ln.GetSuccessorList() {
+		if !failed[successor.ID] {
+			return successor
+		}
+	}
+	return ln.ToNode()
+}
+
+// removeSuccessor - drop a failed node from the successor list, if the node
+// was our successor, the next node in the list is promoted to successor
+func (ln *LocalNode) removeSuccessor(node models.Node) error {
+	ln.successorListMu.Lock()
+	list := []models.Node{}
+	for _, n := range ln.successorList {
+		if n.CompareID(node.ID) != 0 {
+			list = append(list, n)
+		}
+	}
+	ln.successorList = list
+	next := ln.ToNode()
+	if len(list) > 0 {
+		next = list[0]
+	}
+	ln.successorListMu.Unlock()
+
+	successor, err := ln.GetSuccessor()
+	if err != nil {
+		return errors.Wrap(err, "failed to remove successor: ")
+	}
+	if successor.CompareID(node.ID) != 0 {
+		return nil
+	}
+	glog.Infof("successor id=%s failed, promoting id=%s",
+		hex.EncodeToString(node.ID[:]), hex.EncodeToString(next.ID[:]))
+	return ln.SetSuccessor(next)
+}
+
+// refreshSuccessorList - ask our successor for its successor list, and build
+// ours from it.  If the successor can not be reached, it is removed and the
+// next node in the list is tried.
+func (ln *LocalNode) refreshSuccessorList() error {
+	for {
+		successor, err := ln.GetSuccessor()
+		if err != nil {
+			return errors.Wrap(err, "failed to refresh successor list: ")
+		}
+		if ln.CompareID(successor.ID) == 0 {
+			// we are our own successor, nobody to ask
+			return nil
+		}
+
+		successorRN, err := NewRemoteNode(successor)
+		if err != nil {
+			return errors.Wrap(err, "error creating new remote node for successor: ")
+		}
+
+		ctx, cancel := requestContext()
+		successors, err := successorRN.GetSuccessorList(ctx, ln.caller)
+		cancel()
+		if err != nil {
+			glog.Infof("successor id=%s unreachable: %v\n",
+				hex.EncodeToString(successor.ID[:]), err)
+			if err := ln.removeSuccessor(successor); err != nil {
+				return errors.Wrap(err, "failed to remove successor: ")
+			}
+			continue
+		}
+
+		list := []models.Node{successor}
+		for _, n := range successors {
+			if uint(len(list)) >= ln.successorListSize {
+				break
+			}
+			if ln.CompareID(n.ID) == 0 || successor.CompareID(n.ID) == 0 {
+				// the list wrapped around the ring
+				break
+			}
+			list = append(list, n)
+		}
+
+		ln.successorListMu.Lock()
+		ln.successorList = list
+		ln.successorListMu.Unlock()
+		glog.Infof("successor list refreshed: %d entries", len(list))
+		return nil
+	}
+}
+
 // Initialize - initialize the chord node
 func (ln *LocalNode) Initialize(peer models.Node) error {
 	// create a new remote node and transport
@@ -281,7 +551,7 @@ func (ln *LocalNode) Initialize(peer models.Node) error {
 
 	glog.Infof("initializing chord node against remote: %s\n", peer.ToString())
 
-	rn, err := NewRemoteNode(peer.Addr, peer.PublicKey)
+	rn, err := NewRemoteNode(peer)
 	if err != nil {
 		glog.Infof("failed initializing chord node against remote: %v\n", err)
 		return errors.New(
@@ -289,7 +559,9 @@ func (ln *LocalNode) Initialize(peer models.Node) error {
 	}
 
 	// call successor on remote node with our ID to figure out our successor
-	successor, err := rn.Successor(ln.ID, ln.server.PrivateKey)
+	ctx, cancel := requestContext()
+	successor, err := rn.Successor(ctx, ln.ID, ln.caller)
+	cancel()
 
 	if err != nil {
 		glog.Infof("failed initializing chord node against remote: %v\n", err)
@@ -303,17 +575,11 @@ func (ln *LocalNode) Initialize(peer models.Node) error {
 	ln.SetSuccessor(successor)
 	glog.Infof("finger table updated: %s\n", ln.fingerTable.ToString())
 
-	// set the successor's new predecessor
-	successorRN, err := NewRemoteNode(successor.Addr, successor.PublicKey)
-	if err != nil {
-		glog.Infof("error creating new remote node for successor: %v\n", err)
-		errors.Wrap(err, "error creating new remote node for successor: ")
-	}
-
+	// set the successor's new predecessor, and take over our keys
 	glog.Infof("!!! should only initialize once")
-	if err := successorRN.SetPredecessor(ln.ToNode(), ln.server.PrivateKey); err != nil {
-		glog.Infof("error setting new predecessor on remote node: %v\n", err)
-		errors.Wrap(err, "error setting new predecessor on remote node:")
+	if err := ln.notify(successor); err != nil {
+		glog.Infof("error notifying successor: %v\n", err)
+		return errors.Wrap(err, "error notifying successor: ")
 	}
 
 	return nil
@@ -322,70 +588,102 @@ func (ln *LocalNode) Initialize(peer models.Node) error {
 // ClosestPrecedingNode - Find the node that directly preceeds ID
 // closest preceeding node
 func (ln *LocalNode) ClosestPrecedingNode(id models.Identifier) (models.Node, error) {
-	// convert hash to big int
-	lnID := models.KeyToID(ln.ID)
-	nID := models.KeyToID(id)
+	return ln.closestPrecedingNode(id, map[models.Identifier]bool{})
+}
+
+// closestPrecedingNode - Find the node that directly preceeds ID from the
+// finger table and successor list, skipping any node known to have failed
+func (ln *LocalNode) closestPrecedingNode(id models.Identifier, failed map[models.Identifier]bool) (models.Node, error) {
+	// precedes - is node within ln and id
+	precedes := func(node models.Node) bool {
+		if node.Addr == "" || failed[node.ID] {
+			return false
+		}
+		return models.Between(ln.ID, node.ID, id)
+	}
 
 	for i := models.M; i >= 1; i-- {
 		ith, err := ln.fingerTable.GetIth(uint64(i))
-		ithSuccessorID := models.KeyToID(ith.Successor.ID)
-
 		if err != nil {
 			return models.Node{}, errors.Wrap(err, "failed to get closest preceding: ")
 		}
 
-		if ith.Successor.Addr == "" {
-			continue
+		if precedes(ith.Successor) {
+			glog.Infof("closest preceding node to id=%s is %s", hex.EncodeToString(id[:]), ith.Successor.ToString())
+			return ith.Successor, nil
 		}
+	}
 
-		// if ith.Successor is within lnID and nID
-		if lnID < nID {
-			if lnID < ithSuccessorID && ithSuccessorID < nID {
-				glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ith.Successor.ToString())
-				return ith.Successor, nil
-			}
-		} else {
-			if lnID < ithSuccessorID || ithSuccessorID < nID {
-				glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ith.Successor.ToString())
-				return ith.Successor, nil
-			}
+	// fall back on the successor list, furthest successor first
+	successors := ln.GetSuccessorList()
+	for i := len(successors) - 1; i >= 0; i-- {
+		if precedes(successors[i]) {
+			glog.Infof("closest preceding node to id=%s is %s", hex.EncodeToString(id[:]), successors[i].ToString())
+			return successors[i], nil
 		}
 	}
-	glog.Infof("closest preceding node to id=%s is %s", models.KeyToID(id), ln.ToString())
+	glog.Infof("closest preceding node to id=%s is %s", hex.EncodeToString(id[:]), ln.ToString())
 	return ln.ToNode(), nil
 }
 
 // Successor - This is what this is all about, given an Key we will return
-// the node that is responsible for that Key
-func (ln *LocalNode) Successor(id models.Identifier) (models.Node, error) {
-	// does the key fall within ln's ID and the first entry of the finger table
-	// if the key is greater than ln.ID and less than ln.successor.ID, return
-	// ln.successor
-	nPrime, err := ln.ClosestPrecedingNode(id)
-	if err != nil {
-		return nPrime, errors.Wrap(err, "failed to get successor: ")
-	}
-	glog.Infof("successor called: based on finger table, goto: %s", nPrime.ToString())
-	glog.Infof("finger table: %s", ln.fingerTable.ToString())
-	// if we are the nPrime, return self
-	if bytes.Compare(nPrime.ID[:], ln.ID[:]) == 0 {
-		return ln.ToNode(), nil
-	}
+// the node that is responsible for that Key, giving up on the nodes it asks
+// once ctx is done
+func (ln *LocalNode) Successor(ctx context.Context, id models.Identifier) (models.Node, error) {
+	// nodes that failed to answer during this lookup
+	var failed = map[models.Identifier]bool{}
+
+	for {
+		// does the key fall within ln's ID and the first entry of the finger table
+		// if the key is greater than ln.ID and less than ln.successor.ID, return
+		// ln.successor
+		nPrime, err := ln.closestPrecedingNode(id, failed)
+		if err != nil {
+			return nPrime, errors.Wrap(err, "failed to get successor: ")
+		}
+		glog.Infof("successor called: based on finger table, goto: %s", nPrime.ToString())
+		glog.Infof("finger table: %s", ln.fingerTable.ToString())
+		// if we are the nPrime, id falls between us and our successor, so our
+		// successor is responsible for it
+		if bytes.Compare(nPrime.ID[:], ln.ID[:]) == 0 {
+			return ln.GetSuccessor()
+		}
 
-	// call whoever we think is closest
-	rn, err := NewRemoteNode(nPrime.Addr, nPrime.PublicKey)
-	if err != nil {
-		return models.Node{}, errors.Wrap(err, "failure creating new remote node: ")
-	}
+		// virtual nodes on our own server are asked directly, going over the
+		// network would tie up another of the server's workers for nothing
+		if sibling := ln.host.local(nPrime.ID); sibling != nil {
+			return sibling.Successor(ctx, id)
+		}
 
-	glog.Infof("contacting node: %s\n", nPrime.ToString())
-	node, err := rn.Successor(id, ln.server.PrivateKey)
-	if err != nil {
-		return models.Node{}, errors.Wrap(err, "failure getting successor from remote node: ")
-	}
-	glog.Infof("recieved successor from remote rpc call: %s\n", node.ToString())
+		// call whoever we think is closest
+		rn, err := NewRemoteNode(nPrime)
+		if err != nil {
+			return models.Node{}, errors.Wrap(err, "failure creating new remote node: ")
+		}
 
-	return node, nil
+		glog.Infof("contacting node: %s\n", nPrime.ToString())
+		node, err := rn.Successor(ctx, id, ln.caller)
+		if err != nil {
+			if ctx.Err() != nil {
+				// we ran out of time, which says nothing about nPrime
+				return models.Node{}, errors.Wrap(ctx.Err(), "failed to get successor: ")
+			}
+			// fall back to the next closest node we know of
+			glog.Infof("failure getting successor from remote node %s: %v\n",
+				nPrime.ToString(), err)
+			failed[nPrime.ID] = true
+			// a node which answered, even with an error, is still alive
+			if _, answered := errors.Cause(err).(*protocol.ResponseError); !answered {
+				if err := ln.removeSuccessor(nPrime); err != nil {
+					return models.Node{}, errors.Wrap(err, "failure removing failed successor: ")
+				}
+			}
+			continue
+		}
+		glog.Infof("recieved successor from remote rpc call: %s\n", node.ToString())
+
+		return node, nil
+	}
 }
 
 // GetPredecessor - Get the predecessor node for this local node
@@ -401,34 +699,149 @@ func (ln *LocalNode) SetPredecessor(n models.Node) error {
 	ln.predecessorMutex.Lock()
 	defer ln.predecessorMutex.Unlock()
 
-	lnID := models.KeyToID(ln.ID)
-	nID := models.KeyToID(n.ID)
-	pID := models.KeyToID(ln.predecessor.ID)
-
-	if ln.predecessor.Addr == "" {
+	if ln.predecessor.Addr == "" || ln.predecessor.ID == n.ID ||
+		models.Between(ln.predecessor.ID, n.ID, ln.ID) {
+		// yep, closer, change it
 		ln.predecessor = n
 		glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
 		return nil
 	}
+	return errors.New("not updating as new isn't between")
+}
 
-	if pID < lnID {
-		// easy, no wrapping
-		if pID < nID && nID < lnID {
-			// yep, closer, change it
-			ln.predecessor = n
-			glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
-			return nil
+// clearPredecessor - forget our predecessor if it is still node, a new one
+// will be found the next time a node notifies us
+func (ln *LocalNode) clearPredecessor(node models.Node) {
+	ln.predecessorMutex.Lock()
+	defer ln.predecessorMutex.Unlock()
+	if ln.predecessor.Addr != "" && ln.predecessor.CompareID(node.ID) == 0 {
+		glog.Infof("predecessor id=%s failed, clearing it",
+			hex.EncodeToString(node.ID[:]))
+		ln.predecessor = models.Node{}
+	}
+}
+
+// evict - remove a failed node from our successor list and finger table,
+// if it was our successor the next node in the list takes its place
+func (ln *LocalNode) evict(node models.Node) error {
+	if err := ln.removeSuccessor(node); err != nil {
+		return errors.Wrap(err, "failed to remove successor: ")
+	}
+	evicted := ln.fingerTable.Evict(node)
+	glog.Infof("evicted id=%s from %d fingers",
+		hex.EncodeToString(node.ID[:]), evicted)
+	return nil
+}
+
+// Leave - gracefully leave the ring.  All the keys we hold are handed to our
+// successor, and our predecessor and successor are told to point at each
+// other.  Leaving gives up once ctx is done.
+func (ln *LocalNode) Leave(ctx context.Context) error {
+	successor, err := ln.GetSuccessor()
+	if err != nil {
+		return errors.Wrap(err, "failed to get successor: ")
+	}
+	if ln.CompareID(successor.ID) == 0 {
+		// we are the only node, nobody to hand off to
+		glog.Info("leaving ring as the only node")
+		return nil
+	}
+	predecessor, _ := ln.GetPredecessor()
+
+	// hand off all of our data to our successor, the data path is shared by
+	// all of the server's virtual nodes, so only keys within our range are
+	// handed off when we know where our range starts
+	keys, err := file.List(ln.dataPath)
+	if err != nil {
+		return errors.Wrap(err, "failed to list keys: ")
+	}
+	if predecessor.Addr != "" {
+		owned := [][20]byte{}
+		for _, key := range keys {
+			if models.BetweenRightIncl(predecessor.ID, key, ln.ID) {
+				owned = append(owned, key)
+			}
 		}
-		return errors.New("not updating as new isn't between")
-	} else {
-		// not easy, wrapping around the horn
-		if nID < lnID || pID < nID {
-			// yep, closer, change it
-			ln.predecessor = n
-			glog.Infof("predescessor set to: %s\n", ln.predecessor.ToString())
-			return nil
+		keys = owned
+	}
+	glog.Infof("handing %d keys off to successor id=%s",
+		len(keys), hex.EncodeToString(successor.ID[:]))
+
+	successorRN, err := NewRemoteNode(successor)
+	if err != nil {
+		return errors.Wrap(err, "error creating new remote node for successor: ")
+	}
+	for _, key := range keys {
+		// a key we can not hand off would be lost, so we stay in the ring
+		blob, err := file.OpenBlob(ln.dataPath, key)
+		if err != nil {
+			return errors.Wrap(err, "error reading key "+hex.EncodeToString(key[:])+": ")
+		}
+		err = successorRN.StoreReplica(ctx, key, blob, ln.caller)
+		blob.Close()
+		if err != nil {
+			return errors.Wrap(err, "error handing key to successor: ")
 		}
-		return errors.New("not updating as new isn't between")
 	}
+
+	// splice ourselves out of the ring, our successor's new predecessor is
+	// our predecessor
+	err = successorRN.Leave(ctx, protocol.PredecessorLeaveMethod,
+		ln.ToNode(), predecessor, ln.caller)
+	if err != nil {
+		glog.Infof("error telling successor we are leaving: %v\n", err)
+	}
+
+	// and our predecessor's new successor is our successor
+	if predecessor.Addr != "" && ln.CompareID(predecessor.ID) != 0 {
+		predecessorRN, err := NewRemoteNode(predecessor)
+		if err != nil {
+			return errors.Wrap(err, "error creating new remote node for predecessor: ")
+		}
+		err = predecessorRN.Leave(ctx, protocol.SuccessorLeaveMethod,
+			ln.ToNode(), successor, ln.caller)
+		if err != nil {
+			glog.Infof("error telling predecessor we are leaving: %v\n", err)
+		}
+	}
+	glog.Info("left the ring")
+	return nil
+}
+
+// successorLeft - our successor left the ring, replacement is its successor
+func (ln *LocalNode) successorLeft(leaving, replacement models.Node) error {
+	successor, err := ln.GetSuccessor()
+	if err != nil {
+		return errors.Wrap(err, "failed to get successor: ")
+	}
+	if successor.CompareID(leaving.ID) != 0 {
+		return errors.New("leaving node is not our successor")
+	}
+	glog.Infof("successor id=%s left, new successor is id=%s",
+		hex.EncodeToString(leaving.ID[:]), hex.EncodeToString(replacement.ID[:]))
+
+	if err := ln.removeSuccessor(leaving); err != nil {
+		return errors.Wrap(err, "failed to remove successor: ")
+	}
+	return ln.SetSuccessor(replacement)
+}
+
+// predecessorLeft - our predecessor left the ring, replacement is its
+// predecessor
+func (ln *LocalNode) predecessorLeft(leaving, replacement models.Node) error {
+	ln.predecessorMutex.Lock()
+	defer ln.predecessorMutex.Unlock()
+
+	if ln.predecessor.CompareID(leaving.ID) != 0 {
+		return errors.New("leaving node is not our predecessor")
+	}
+	glog.Infof("predecessor id=%s left, new predecessor is id=%s",
+		hex.EncodeToString(leaving.ID[:]), hex.EncodeToString(replacement.ID[:]))
+
+	if ln.CompareID(replacement.ID) == 0 {
+		// the leaving node was our only neighbor
+		replacement = models.Node{}
+	}
+	ln.predecessor = replacement
 	return nil
 }
@@ -0,0 +1,115 @@
+package chord
+
+import (
+	"context"
+	"crypto/rsa"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Caller - who requests to remote nodes are made as, a node or a user, ID
+// being the one bound to Key, and the network they are sent over
+type Caller struct {
+	Type    protocol.CallerType
+	ID      models.Identifier
+	Key     *rsa.PrivateKey
+	Network protocol.Network
+}
+
+// NodeCaller - the caller a node holding key on network makes its requests
+// as
+func NodeCaller(network protocol.Network, key *rsa.PrivateKey) (Caller, error) {
+	id, err := crypto.KeyID(key.Public().(*rsa.PublicKey))
+	if err != nil {
+		return Caller{}, errors.Wrap(err, "failed to derive caller id: ")
+	}
+	return Caller{
+		Type:    protocol.NodeType,
+		ID:      models.Identifier(id),
+		Key:     key,
+		Network: network,
+	}, nil
+}
+
+// Hop - a single node asked during an iterative lookup, Err is set when the
+// node could not be reached and the lookup had to route around it
+type Hop struct {
+	Node    models.Node
+	Latency time.Duration
+	Err     error
+}
+
+// LookupResult - the outcome of an iterative lookup, the successor of ID and
+// the path the lookup took to find it
+type LookupResult struct {
+	ID        models.Identifier
+	Successor models.Node
+	Path      []Hop
+	Hops      int
+}
+
+// Lookup - find the successor of id iteratively, starting at start.  Rather
+// than each node forwarding the lookup to the next, every hop is asked for
+// its closest preceding node by the caller, so the caller sees the whole path
+// the lookup takes.  When a hop fails the previous hop is asked again, with
+// the failed hop excluded, to route around it.  The lookup gives up once ctx
+// is done.
+func Lookup(ctx context.Context, start models.Node, id models.Identifier, caller Caller) (LookupResult, error) {
+	var (
+		result = LookupResult{ID: id}
+		failed = map[models.Identifier]bool{}
+		// the hops taken so far, so we can back up when a hop fails
+		trail = []models.Node{start}
+	)
+
+	for len(result.Path) < MaxLookupHops {
+		if len(trail) == 0 {
+			return result, errors.New("lookup failed, every hop was unreachable")
+		}
+		if err := ctx.Err(); err != nil {
+			return result, errors.Wrap(err, "lookup gave up: ")
+		}
+		current := trail[len(trail)-1]
+
+		var (
+			resp    models.ClosestPrecedingResponse
+			started = time.Now()
+		)
+		rn, err := NewRemoteNode(current)
+		if err == nil {
+			excluded := make([]models.Identifier, 0, len(failed))
+			for failedID := range failed {
+				excluded = append(excluded, failedID)
+			}
+			resp, err = rn.ClosestPrecedingNode(ctx, id, excluded, caller)
+		}
+		result.Path = append(result.Path, Hop{
+			Node:    current,
+			Latency: time.Since(started),
+			Err:     err,
+		})
+		result.Hops = len(result.Path)
+
+		if err != nil {
+			glog.Infof("lookup hop %s failed: %v\n", current.ToString(), err)
+			failed[current.ID] = true
+			trail = trail[:len(trail)-1]
+			continue
+		}
+
+		// the id falls between the hop and its successor, or the hop knows
+		// of nobody closer, either way its successor is the answer
+		if models.BetweenRightIncl(current.ID, id, resp.Successor.ID) ||
+			resp.Closest.CompareID(current.ID) == 0 {
+			result.Successor = resp.Successor
+			return result, nil
+		}
+		trail = append(trail, resp.Closest)
+	}
+	return result, errors.New("lookup exceeded the maximum number of hops")
+}
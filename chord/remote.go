@@ -2,11 +2,12 @@ package chord
 
 import (
 	"bytes"
+	"context"
 	"crypto/rsa"
-	"crypto/sha1"
 	"encoding/gob"
+	"io"
 
-	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
 	"github.com/pkg/errors"
@@ -23,48 +24,80 @@ type RemoteNode struct {
 
 // NewRemoteNode - create a new remote node, which implements ChordNode, wherein
 // we are able to perform queries on this node
-func NewRemoteNode(addr string, key *rsa.PublicKey) (*RemoteNode, error) {
+func NewRemoteNode(node models.Node) (*RemoteNode, error) {
+	if err := verifyNode(node); err != nil {
+		return nil, err
+	}
 	return &RemoteNode{
-		&models.Node{
-			Addr:      addr,
-			PublicKey: key,
-			ID: models.Identifier(
-				sha1.Sum([]byte(addr)),
-			),
-		},
+		&node,
 		nil,
 	}, nil
 }
 
-// GetPredecessor - Get the predecessor of a remote node
-func (rn *RemoteNode) GetPredecessor(key *rsa.PrivateKey) (models.Node, error) {
-	// if connection is nil, create a new connection to the remote node
-
-	if rn.PublicKey == nil {
-		glog.Infof("HERE THE RN HAS NO PUBLIC KEY")
+// verifyNode - make sure a node handed to us by a remote has an ID bound to
+// its public key, otherwise it could claim any position on the ring
+func verifyNode(node models.Node) error {
+	if node.VNode >= models.MaxVirtualNodes {
+		return errors.New("invalid node " + node.Addr + ": too many virtual nodes")
 	}
+	if err := crypto.VerifyVirtualKeyID(node.ID, node.PublicKey, node.VNode); err != nil {
+		return errors.Wrap(err, "invalid node "+node.Addr+": ")
+	}
+	return nil
+}
 
+// closeTransport - close the transport to the remote node, so the next call
+// on this remote node will set up a fresh transport, which reuses a pooled
+// connection where it can
+func (rn *RemoteNode) closeTransport() {
+	rn.transport.Close()
+	rn.transport = nil
+}
+
+// roundTrip - send request to the remote node as caller, giving up once ctx
+// is done
+func (rn *RemoteNode) roundTrip(ctx context.Context, caller Caller, request *protocol.Request) (protocol.Response, error) {
+	return rn.send(ctx, caller, request, (*protocol.Transport).RoundTripContext)
+}
+
+// roundTripStream - send request like roundTrip, leaving a streamed response
+// to be read from its body, the response has to be closed
+func (rn *RemoteNode) roundTripStream(ctx context.Context, caller Caller, request *protocol.Request) (protocol.Response, error) {
+	return rn.send(ctx, caller, request, (*protocol.Transport).RoundTripStreamContext)
+}
+
+// send - send request to the remote node as caller with roundTrip
+func (rn *RemoteNode) send(ctx context.Context, caller Caller, request *protocol.Request, roundTrip func(*protocol.Transport, context.Context, *protocol.Request) (protocol.Response, error)) (protocol.Response, error) {
+	// if connection is nil, create a new connection to the remote node
 	if rn.transport == nil {
 		var err error
-		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
+		if rn.transport, err = protocol.NewTransportContext(ctx, caller.Network, "tcp", rn.Addr, caller.Type, caller.ID, rn.PublicKey, caller.Key); err != nil {
 			// we had an error setting up our connection
-			return models.Node{}, errors.Wrap(err, "failed creating transport: ")
+			return protocol.Response{}, errors.Wrap(err, "failed creating transport: ")
 		}
 	}
+	request.Header.From = caller.ID
+	request.Header.To = rn.ID
+	request.Header.Type = caller.Type
+	request.Header.PubKey = caller.Key.Public().(*rsa.PublicKey)
+
 	// send request to the remote
-	resp, err := rn.transport.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			From:     rn.ID,
-			FromAddr: rn.Addr,
-			Type:     protocol.NodeType,
-			PubKey:   rn.PublicKey,
-		},
+	resp, err := roundTrip(rn.transport, ctx, request)
+	rn.closeTransport()
+
+	if err != nil {
+		return protocol.Response{}, errors.Wrap(err, "failed round trip: ")
+	}
+	return resp, nil
+}
+
+// GetPredecessor - Get the predecessor of a remote node
+func (rn *RemoteNode) GetPredecessor(ctx context.Context, caller Caller) (models.Node, error) {
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
 		Method: protocol.GetPredecessorMethod,
 	})
-	rn.transport.Close()
-
 	if err != nil {
-		return models.Node{}, errors.Wrap(err, "failed round trip: ")
+		return models.Node{}, err
 	}
 
 	// decode the response body into a node object
@@ -74,24 +107,71 @@ func (rn *RemoteNode) GetPredecessor(key *rsa.PrivateKey) (models.Node, error) {
 	)
 	dec := gob.NewDecoder(buf)
 	if err := dec.Decode(&node); err != nil {
-		errors.Wrap(err, "failure decoding successor response from body")
+		return models.Node{}, errors.Wrap(err, "failure decoding predecessor response from body")
 	}
 
+	if node.Addr != "" {
+		if err := verifyNode(node); err != nil {
+			return models.Node{}, err
+		}
+	}
 	return node, nil
 
 }
 
-// Successor - Call successor on
-func (rn *RemoteNode) Successor(id models.Identifier, key *rsa.PrivateKey) (models.Node, error) {
-	// if connection is nil, create a new connection to the remote node
-	if rn.transport == nil {
-		var err error
-		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
-			// we had an error setting up our connection
-			return models.Node{}, errors.Wrap(err, "failed creating transport: ")
+// GetSuccessorList - Get the successor list of a remote node
+func (rn *RemoteNode) GetSuccessorList(ctx context.Context, caller Caller) ([]models.Node, error) {
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Method: protocol.GetSuccessorListMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the response body into a list of nodes
+	var successors = []models.Node{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	if err := dec.Decode(&successors); err != nil {
+		return nil, errors.Wrap(err, "failure decoding successor list response from body")
+	}
+	for _, node := range successors {
+		if err := verifyNode(node); err != nil {
+			return nil, err
 		}
 	}
 
+	return successors, nil
+}
+
+// GetFingerTable - Get the finger table of a remote node
+func (rn *RemoteNode) GetFingerTable(ctx context.Context, caller Caller) ([]models.Finger, error) {
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Method: protocol.GetFingerTableMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// decode the response body into a list of fingers
+	var fingers = []models.Finger{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	if err := dec.Decode(&fingers); err != nil {
+		return nil, errors.Wrap(err, "failure decoding finger table response from body")
+	}
+	for _, finger := range fingers {
+		if finger.Successor.Addr == "" {
+			continue
+		}
+		if err := verifyNode(finger.Successor); err != nil {
+			return nil, err
+		}
+	}
+
+	return fingers, nil
+}
+
+// Successor - Call successor on
+func (rn *RemoteNode) Successor(ctx context.Context, id models.Identifier, caller Caller) (models.Node, error) {
 	var reqBuffer = new(bytes.Buffer)
 
 	enc := gob.NewEncoder(reqBuffer)
@@ -99,24 +179,12 @@ func (rn *RemoteNode) Successor(id models.Identifier, key *rsa.PrivateKey) (mode
 		return models.Node{}, errors.Wrap(err, "failed to encode request: ")
 	}
 
-	glog.Infof("rn.PublicKey is %v", rn.PublicKey)
-	// send request to the remote
-	resp, err := rn.transport.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			From:     rn.ID,
-			FromAddr: rn.Addr,
-			Type:     protocol.NodeType,
-			PubKey:   rn.PublicKey,
-		},
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
 		Method: protocol.GetSuccessorMethod,
 		Data:   reqBuffer.Bytes(),
 	})
-	rn.transport.Close()
-
-	glog.Info("DO I GET HERE??????????????????????")
-
 	if err != nil {
-		return models.Node{}, errors.Wrap(err, "failed round trip: ")
+		return models.Node{}, err
 	}
 
 	// decode the response body into a node object
@@ -126,24 +194,17 @@ func (rn *RemoteNode) Successor(id models.Identifier, key *rsa.PrivateKey) (mode
 	)
 	dec := gob.NewDecoder(buf)
 	if err := dec.Decode(&node); err != nil {
-		errors.Wrap(err, "failure decoding successor response from body")
+		return models.Node{}, errors.Wrap(err, "failure decoding successor response from body")
 	}
 
+	if err := verifyNode(node); err != nil {
+		return models.Node{}, err
+	}
 	return node, nil
 }
 
 // SetPredecessor - set the predecessor on a remote node to node
-func (rn *RemoteNode) SetPredecessor(node models.Node, key *rsa.PrivateKey) error {
-	// if connection is nil, create a new connection to the remote node
-	if rn.transport == nil {
-		glog.Infof("setting up transport for set pred call: %v", node)
-		var err error
-		if rn.transport, err = protocol.NewTransport("tcp", rn.Addr, protocol.NodeType, rn.ID, rn.PublicKey, key); err != nil {
-			// we had an error setting up our connection
-			return errors.Wrap(err, "failed creating transport: ")
-		}
-	}
-
+func (rn *RemoteNode) SetPredecessor(ctx context.Context, node models.Node, caller Caller) error {
 	var reqBuffer = new(bytes.Buffer)
 
 	enc := gob.NewEncoder(reqBuffer)
@@ -151,23 +212,146 @@ func (rn *RemoteNode) SetPredecessor(node models.Node, key *rsa.PrivateKey) erro
 		return errors.Wrap(err, "failed to encode request: ")
 	}
 
-	// send request to the remote
-	_, err := rn.transport.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			From:     rn.ID,
-			FromAddr: rn.Addr,
-			Type:     protocol.NodeType,
-			PubKey:   rn.PublicKey,
-		},
+	_, err := rn.roundTrip(ctx, caller, &protocol.Request{
 		Method: protocol.SetPredecessorMethod,
 		Data:   reqBuffer.Bytes(),
 	})
+	return err
+}
 
-	rn.transport.Close()
+// ListKeys - list the keys the remote node holds within (low, high]
+func (rn *RemoteNode) ListKeys(ctx context.Context, low, high models.Identifier, caller Caller) ([]models.Identifier, error) {
+	var reqBuffer = new(bytes.Buffer)
 
+	enc := gob.NewEncoder(reqBuffer)
+	if err := enc.Encode(models.KeyRangeRequest{Low: low, High: high}); err != nil {
+		return nil, errors.Wrap(err, "failed to encode request: ")
+	}
+
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Method: protocol.ListKeysMethod,
+		Data:   reqBuffer.Bytes(),
+	})
 	if err != nil {
-		return errors.Wrap(err, "failed round trip: ")
+		return nil, err
 	}
 
-	return nil
+	// decode the response body into a list of keys
+	var keys = []models.Identifier{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	if err := dec.Decode(&keys); err != nil {
+		return nil, errors.Wrap(err, "failure decoding list keys response from body")
+	}
+
+	return keys, nil
+}
+
+// TransferKey - pull the raw blob stored under id, owner/secret header
+// included, from the remote node.  The blob is streamed as it is read, the
+// caller has to close it.
+func (rn *RemoteNode) TransferKey(ctx context.Context, id models.Identifier, caller Caller) (io.ReadCloser, error) {
+	resp, err := rn.roundTripStream(ctx, caller, &protocol.Request{
+		Header: protocol.Header{Key: id},
+		Method: protocol.TransferKeyMethod,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return responseBody{Reader: resp.Body(), resp: resp}, nil
+}
+
+// responseBody - the body of a streamed response, closing it closes the
+// response
+type responseBody struct {
+	io.Reader
+	resp protocol.Response
+}
+
+// Close - close the response the body is read from
+func (rb responseBody) Close() error {
+	return rb.resp.Close()
+}
+
+// StoreReplica - push the raw blob stored under id, owner/secret header
+// included, to the remote node, streaming it as it is read
+func (rn *RemoteNode) StoreReplica(ctx context.Context, id models.Identifier, blob io.Reader, caller Caller) error {
+	request := &protocol.Request{
+		Header: protocol.Header{Key: id},
+		Method: protocol.StoreReplicaMethod,
+	}
+	request.SetBody(blob)
+	_, err := rn.roundTrip(ctx, caller, request)
+	return err
+}
+
+// DeleteReplica - remove the raw blob stored under id from the remote node
+func (rn *RemoteNode) DeleteReplica(ctx context.Context, id models.Identifier, caller Caller) error {
+	_, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Header: protocol.Header{Key: id},
+		Method: protocol.DeleteReplicaMethod,
+	})
+	return err
+}
+
+// Leave - tell the remote node that leaving is leaving the ring, and that
+// replacement takes its place.  method is either SuccessorLeaveMethod or
+// PredecessorLeaveMethod, depending on which neighbor the remote node is.
+func (rn *RemoteNode) Leave(ctx context.Context, method protocol.RequestMethod, leaving, replacement models.Node, caller Caller) error {
+	var reqBuffer = new(bytes.Buffer)
+
+	enc := gob.NewEncoder(reqBuffer)
+	if err := enc.Encode(models.LeaveRequest{
+		Leaving: leaving, Replacement: replacement,
+	}); err != nil {
+		return errors.Wrap(err, "failed to encode request: ")
+	}
+
+	_, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Method: method,
+		Data:   reqBuffer.Bytes(),
+	})
+	return err
+}
+
+// Ping - check the remote node is alive, giving up once ctx is done
+func (rn *RemoteNode) Ping(ctx context.Context, caller Caller) error {
+	_, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Method: protocol.PingMethod,
+	})
+	return err
+}
+
+// ClosestPrecedingNode - ask the remote node for its successor and the
+// closest node it knows of preceding id, skipping the failed nodes.  This is
+// a single hop of an iterative lookup, made as caller.
+func (rn *RemoteNode) ClosestPrecedingNode(ctx context.Context, id models.Identifier, failed []models.Identifier, caller Caller) (models.ClosestPrecedingResponse, error) {
+	var reqBuffer = new(bytes.Buffer)
+	if err := gob.NewEncoder(reqBuffer).Encode(models.ClosestPrecedingRequest{
+		ID:     id,
+		Failed: failed,
+	}); err != nil {
+		return models.ClosestPrecedingResponse{}, errors.Wrap(err, "failed to encode request: ")
+	}
+
+	resp, err := rn.roundTrip(ctx, caller, &protocol.Request{
+		Header: protocol.Header{Key: id},
+		Method: protocol.ClosestPrecedingNodeMethod,
+		Data:   reqBuffer.Bytes(),
+	})
+	if err != nil {
+		return models.ClosestPrecedingResponse{}, err
+	}
+
+	var out = models.ClosestPrecedingResponse{}
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&out); err != nil {
+		return models.ClosestPrecedingResponse{}, errors.Wrap(err, "failure decoding closest preceding response from body")
+	}
+	if err := verifyNode(out.Successor); err != nil {
+		return models.ClosestPrecedingResponse{}, err
+	}
+	if err := verifyNode(out.Closest); err != nil {
+		return models.ClosestPrecedingResponse{}, err
+	}
+	return out, nil
 }
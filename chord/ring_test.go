@@ -0,0 +1,632 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/file"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+var (
+	// testKeys - keys are slow to generate, so they are shared by all tests
+	testKeys   []*rsa.PrivateKey
+	testKeysMu sync.Mutex
+)
+
+func testKey(t *testing.T, i int) *rsa.PrivateKey {
+	testKeysMu.Lock()
+	defer testKeysMu.Unlock()
+	for len(testKeys) <= i {
+		key, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatalf("failed to generate key: %v", err)
+		}
+		testKeys = append(testKeys, key)
+	}
+	return testKeys[i]
+}
+
+// testRing - a number of servers running chord hosts on a memory network
+type testRing struct {
+	t       *testing.T
+	network *protocol.MemoryNetwork
+	hosts   []*Host
+	paths   []string
+	crashed map[int]bool
+	joined  int
+	quits   []chan bool
+	dones   []chan bool
+}
+
+func newTestRing(t *testing.T, size int, vnodes uint) *testRing {
+	r := &testRing{
+		t:       t,
+		network: protocol.NewMemoryNetwork(),
+		crashed: make(map[int]bool),
+	}
+	t.Cleanup(r.stop)
+
+	for i := 0; i < size; i++ {
+		r.hosts = append(r.hosts, nil)
+		r.paths = append(r.paths, t.TempDir())
+		// every host but the first trusts it as its seed, like a server
+		// given it on the command line
+		var seeds []models.Node
+		if i > 0 {
+			seeds = append(seeds, r.hosts[0].Nodes()[0].ToNode())
+		}
+		r.start(i, testAddr(i), vnodes, seeds)
+	}
+	// hosts join one at a time, with the ring settling in between, as the
+	// successor found on joining is only as good as the ring at that time.
+	// A refused notify on joining is fixed up by stabilizing, so it is only
+	// logged.
+	for i, h := range r.hosts {
+		peer := models.Node{}
+		if i > 0 {
+			peer = r.hosts[0].Nodes()[0].ToNode()
+		}
+		if err := h.Join(peer); err != nil {
+			t.Logf("host %d joined with: %v", i, err)
+		}
+		r.joined++
+		r.stabilize(5 * len(r.live()))
+	}
+	return r
+}
+
+func testAddr(i int) string {
+	return fmt.Sprintf("node-%d", i)
+}
+
+// start - start the i'th server listening on addr, trusting seeds, it keeps
+// its key and data path when it is restarted
+func (r *testRing) start(i int, addr string, vnodes uint, seeds []models.Node) *protocol.Server {
+	s, err := protocol.NewServer(r.network,
+		testKey(r.t, i), seeds, addr, r.paths[i], 16, 8)
+	if err != nil {
+		r.t.Fatalf("failed to create server: %v", err)
+	}
+	h, err := NewHost(s, addr, vnodes, 3, 3)
+	if err != nil {
+		r.t.Fatalf("failed to create host: %v", err)
+	}
+
+	s.Handle(protocol.GetSuccessorMethod, h.Dispatch((*LocalNode).SuccessorHandler))
+	s.Handle(protocol.SetPredecessorMethod, h.Dispatch((*LocalNode).SetPredecessorHandler), s.RequireNodeOrAdmin)
+	s.Handle(protocol.GetPredecessorMethod, h.Dispatch((*LocalNode).GetPredecessorHandler))
+	s.Handle(protocol.GetFingerTableMethod, h.Dispatch((*LocalNode).FingerTableHandler))
+	s.Handle(protocol.GetSuccessorListMethod, h.Dispatch((*LocalNode).SuccessorListHandler))
+	s.Handle(protocol.SuccessorLeaveMethod, h.Dispatch((*LocalNode).SuccessorLeaveHandler), s.RequireNode)
+	s.Handle(protocol.PredecessorLeaveMethod, h.Dispatch((*LocalNode).PredecessorLeaveHandler), s.RequireNode)
+	s.Handle(protocol.ClosestPrecedingNodeMethod, h.Dispatch((*LocalNode).ClosestPrecedingNodeHandler))
+	s.Handle(protocol.ListKeysMethod, file.ListKeysHandler, s.RequireNode)
+	s.Handle(protocol.TransferKeyMethod, file.TransferKeyHandler, s.RequireNode)
+	s.Handle(protocol.StoreReplicaMethod, file.StoreReplicaHandler, s.RequireNode)
+	s.Handle(protocol.DeleteReplicaMethod, file.DeleteReplicaHandler, s.RequireNode)
+	s.Handle(protocol.MerkleTreeMethod, file.MerkleTreeHandler, s.RequireNode)
+	s.Handle(protocol.PingMethod, s.PingHandler)
+	s.Handle(protocol.UserRegistrationMethod, s.UserRegistrationHandler)
+	s.Handle(protocol.PostPublicKeyMethod, file.PostPublicKeyHandler)
+	s.Handle(protocol.GetPublicKeyMethod, file.GetPublicKeyHandler)
+	s.Handle(protocol.NodeRegistrationMethod, s.NodeRegistrationHandler)
+	s.Handle(protocol.NodeTrustMethod, s.NodeTrustHandler)
+
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	// registering gets the host trusted by the seed, and the hosts which
+	// registered before it
+	if len(seeds) > 0 {
+		if err := s.Register(seeds, time.Second); err != nil {
+			r.t.Fatalf("failed to register: %v", err)
+		}
+	}
+	r.hosts[i] = h
+	r.quits = append(r.quits, quit)
+	r.dones = append(r.dones, done)
+	return s
+}
+
+// registerUser - register a new user with the first host, for requests
+// to be made as
+func (r *testRing) registerUser() Caller {
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	id, err := crypto.KeyID(&key.PublicKey)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	seed := r.hosts[0].Nodes()[0]
+	tr, err := protocol.NewTransportWithTimeout(
+		r.network, "tcp", seed.Addr, protocol.UserType, id, seed.server.PrivateKey.Public().(*rsa.PublicKey), key, time.Second)
+	if err != nil {
+		r.t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+	if _, err := tr.RoundTrip(&protocol.Request{
+		Header: protocol.Header{
+			From:   id,
+			Type:   protocol.UserType,
+			PubKey: &key.PublicKey,
+		},
+		Method: protocol.UserRegistrationMethod,
+	}); err != nil {
+		r.t.Fatalf("failed to register user: %v", err)
+	}
+	return Caller{Type: protocol.UserType, ID: id, Key: key, Network: r.network}
+}
+
+func (r *testRing) stop() {
+	var wg sync.WaitGroup
+	for i := range r.quits {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r.quits[i] <- true
+			<-r.dones[i]
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (r *testRing) crash(i int) {
+	r.crashed[i] = true
+	r.network.Crash(testAddr(i))
+}
+
+// live - all virtual nodes of hosts which have joined and not crashed
+func (r *testRing) live() []*LocalNode {
+	nodes := []*LocalNode{}
+	for i, h := range r.hosts[:r.joined] {
+		if !r.crashed[i] {
+			nodes = append(nodes, h.Nodes()...)
+		}
+	}
+	return nodes
+}
+
+// sorted - the live nodes in ring order
+func (r *testRing) sorted() []*LocalNode {
+	nodes := r.live()
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Compare(*nodes[j].Node) < 0
+	})
+	return nodes
+}
+
+// owner - the live node that should be responsible for id
+func (r *testRing) owner(id models.Identifier) *LocalNode {
+	nodes := r.sorted()
+	for i, ln := range nodes {
+		predecessor := nodes[(i+len(nodes)-1)%len(nodes)]
+		if models.BetweenRightIncl(predecessor.ID, id, ln.ID) {
+			return ln
+		}
+	}
+	return nodes[0]
+}
+
+// settled - does every live node have the right successor and predecessor,
+// a node alone in a ring is its own successor and has no predecessor
+func (r *testRing) settled() bool {
+	nodes := r.sorted()
+	if len(nodes) == 1 {
+		successor, _ := nodes[0].GetSuccessor()
+		return successor.CompareID(nodes[0].ID) == 0
+	}
+	for i, ln := range nodes {
+		successor, _ := ln.GetSuccessor()
+		predecessor, _ := ln.GetPredecessor()
+		if successor.CompareID(nodes[(i+1)%len(nodes)].ID) != 0 ||
+			predecessor.CompareID(nodes[(i+len(nodes)-1)%len(nodes)].ID) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// stabilize - run stabilization rounds on all live nodes until the ring has
+// settled, failing the test if it does not within rounds
+func (r *testRing) stabilize(rounds int) {
+	for round := 0; round < rounds; round++ {
+		for _, ln := range r.live() {
+			ln.Stabilize()
+			ln.FixFingers()
+		}
+		if r.settled() {
+			return
+		}
+	}
+	r.t.Fatalf("ring did not settle within %d rounds", rounds)
+}
+
+func testKeyID(i int) models.Identifier {
+	return models.Identifier(sha1.Sum([]byte(fmt.Sprintf("key-%d", i))))
+}
+
+// checkLookups - every live node finds the right owner for a set of keys,
+// both recursively and iteratively
+func (r *testRing) checkLookups() {
+	nodes := r.live()
+	for i := 0; i < 20; i++ {
+		id := testKeyID(i)
+		expected := r.owner(id)
+		ln := nodes[i%len(nodes)]
+
+		node, err := ln.Successor(context.Background(), id)
+		if err != nil {
+			r.t.Errorf("key %d: successor failed: %v", i, err)
+		} else if node.CompareID(expected.ID) != 0 {
+			r.t.Errorf("key %d: successor from %s is %s, expected %s", i,
+				ln.ToString(), node.ToString(), expected.ToString())
+		}
+
+		result, err := Lookup(context.Background(), ln.ToNode(), id, ln.caller)
+		if err != nil {
+			r.t.Errorf("key %d: lookup failed: %v", i, err)
+		} else if result.Successor.CompareID(expected.ID) != 0 {
+			r.t.Errorf("key %d: lookup from %s found %s, expected %s", i,
+				ln.ToString(), result.Successor.ToString(), expected.ToString())
+		}
+	}
+}
+
+func TestRingJoinAndLookup(t *testing.T) {
+	r := newTestRing(t, 5, 1)
+	r.stabilize(10)
+	r.checkLookups()
+}
+
+func TestRingVirtualNodes(t *testing.T) {
+	r := newTestRing(t, 3, 3)
+	r.stabilize(15)
+	if n := len(r.live()); n != 9 {
+		t.Fatalf("expected 9 virtual nodes, found %d", n)
+	}
+	r.checkLookups()
+}
+
+func TestRingNodeCrash(t *testing.T) {
+	r := newTestRing(t, 5, 1)
+	r.stabilize(10)
+
+	nodes := r.sorted()
+	crashed, predecessor, successor := nodes[2], nodes[1], nodes[3]
+	for i, h := range r.hosts {
+		if h.Nodes()[0] == crashed {
+			r.crash(i)
+		}
+	}
+
+	// a lookup passing through the crashed node routes around it
+	result, err := Lookup(context.Background(), predecessor.ToNode(), models.FingerStart(crashed.ID, 1), predecessor.caller)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if result.Successor.CompareID(successor.ID) != 0 {
+		t.Errorf("lookup found %s, expected %s",
+			result.Successor.ToString(), successor.ToString())
+	}
+	routedAround := false
+	for _, hop := range result.Path {
+		if hop.Node.CompareID(crashed.ID) == 0 && hop.Err != nil {
+			routedAround = true
+		}
+	}
+	if !routedAround {
+		t.Error("expected the lookup path to include the failed hop")
+	}
+
+	// the failure detectors evict the crashed node, and the ring heals.  The
+	// crashed node refuses connections right away, so the pings wait on live
+	// nodes however long they take, and no live node is ever evicted for
+	// being slow on a busy machine.
+	for _, ln := range r.live() {
+		fd := NewFailureDetector(ln, 0, 1)
+		fd.CheckPredecessor()
+		fd.CheckFingers()
+	}
+	r.stabilize(10)
+	r.checkLookups()
+}
+
+func TestRingExpiredLookup(t *testing.T) {
+	r := newTestRing(t, 5, 1)
+	r.stabilize(10)
+
+	// a lookup which runs out of time fails, without evicting the live
+	// nodes it did not get to ask
+	ln := r.live()[0]
+	successors := ln.GetSuccessorList()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, other := range r.live() {
+		if _, err := ln.Successor(ctx, other.ID); err != nil &&
+			errors.Cause(err) != context.Canceled {
+			t.Errorf("expected the lookup to fail with the context, got %v", err)
+		}
+	}
+	after := ln.GetSuccessorList()
+	if len(after) != len(successors) {
+		t.Fatalf("expected %d successors, found %d", len(successors), len(after))
+	}
+	for i := range after {
+		if after[i].CompareID(successors[i].ID) != 0 {
+			t.Errorf("successor %d changed from %s to %s", i,
+				successors[i].ToString(), after[i].ToString())
+		}
+	}
+}
+
+func TestRingLeave(t *testing.T) {
+	r := newTestRing(t, 4, 1)
+	r.stabilize(10)
+
+	nodes := r.sorted()
+	leaving, predecessor, successor := nodes[2], nodes[1], nodes[3]
+
+	// another node can not take the leaving node out of the ring
+	rn, err := NewRemoteNode(successor.ToNode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rn.Leave(context.Background(), protocol.PredecessorLeaveMethod,
+		leaving.ToNode(), predecessor.ToNode(), nodes[0].caller)
+	if protocol.ErrorCodeOf(err) != protocol.Forbidden {
+		t.Errorf("expected a leave for another node to be forbidden, got %v", err)
+	}
+	if p, _ := successor.GetPredecessor(); p.CompareID(leaving.ID) != 0 {
+		t.Fatalf("expected the predecessor to be untouched, is %s", p.ToString())
+	}
+
+	// the node itself can, handing a key bigger than a single frame of a
+	// stream off to its successor
+	var key models.Identifier
+	for i := 0; ; i++ {
+		if key = testKeyID(i); r.owner(key) == leaving {
+			break
+		}
+	}
+	blob := bytes.Repeat([]byte("peerstore"), 1<<17)
+	if err := file.PutBlob(leaving.dataPath, key, blob); err != nil {
+		t.Fatal(err)
+	}
+	if err := leaving.Leave(context.Background()); err != nil {
+		t.Fatalf("failed to leave: %v", err)
+	}
+	if got, err := file.GetBlob(successor.dataPath, key); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("expected the key to be handed off to the successor: %v", err)
+	}
+	if p, _ := successor.GetPredecessor(); p.CompareID(predecessor.ID) != 0 {
+		t.Errorf("expected the predecessor of the successor to be %s, is %s",
+			predecessor.ToString(), p.ToString())
+	}
+	if s, _ := predecessor.GetSuccessor(); s.CompareID(successor.ID) != 0 {
+		t.Errorf("expected the successor of the predecessor to be %s, is %s",
+			successor.ToString(), s.ToString())
+	}
+}
+
+func TestRingLatencyAndPartition(t *testing.T) {
+	r := newTestRing(t, 3, 1)
+	r.stabilize(10)
+
+	from := r.hosts[0].Nodes()[0]
+	to := r.hosts[1].Nodes()[0]
+	caller := from.caller
+
+	// every write to and from node 1 is delayed, so a hop takes at least a
+	// round trip of it
+	r.network.SetLatency(testAddr(1), 20*time.Millisecond)
+	result, err := Lookup(context.Background(), to.ToNode(), to.ID, caller)
+	if err != nil {
+		t.Fatalf("lookup failed: %v", err)
+	}
+	if result.Path[0].Latency < 40*time.Millisecond {
+		t.Errorf("hop latency %v, expected at least 40ms", result.Path[0].Latency)
+	}
+	r.network.SetLatency(testAddr(1), 0)
+
+	// partitioned nodes can not reach each other
+	r.network.Partition([]string{testAddr(0)}, []string{testAddr(1)})
+	result, err = Lookup(context.Background(), to.ToNode(), to.ID, caller)
+	if err == nil {
+		t.Fatal("expected the lookup across a partition to fail")
+	}
+	if len(result.Path) != 1 || result.Path[0].Err == nil {
+		t.Errorf("expected a single failed hop, path was %+v", result.Path)
+	}
+
+	r.network.Heal()
+	if _, err := Lookup(context.Background(), to.ToNode(), to.ID, caller); err != nil {
+		t.Errorf("lookup failed after healing the partition: %v", err)
+	}
+}
+
+func problems(report RingReport) string {
+	out := []string{}
+	for _, p := range report.Problems {
+		out = append(out, p.ToString())
+	}
+	return fmt.Sprintf("%v", out)
+}
+
+func TestRingCheckAndRepair(t *testing.T) {
+	r := newTestRing(t, 4, 1)
+	r.stabilize(10)
+	// fill in every finger, so none are stale
+	for i := 0; i < 3; i++ {
+		for _, ln := range r.live() {
+			ln.FixFingers()
+		}
+	}
+
+	// the ring is checked by a user, like the client does
+	seed := r.hosts[0].Nodes()[0]
+	user := r.registerUser()
+	report, err := CheckRing(seed.ToNode(), user, time.Second)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	if !report.Consistent() || len(report.Nodes) != 4 {
+		t.Fatalf("expected a consistent ring of 4, walked %d with %s",
+			len(report.Nodes), problems(report))
+	}
+
+	// break a link and a finger
+	nodes := r.sorted()
+	nodes[2].predecessor = models.Node{}
+	wrong := nodes[0]
+	if r.owner(models.FingerStart(nodes[1].ID, models.M)) == wrong {
+		wrong = nodes[3]
+	}
+	nodes[1].fingerTable.SetIth(models.M, models.Interval{}, wrong.ToNode(), nodes[1].ToNode())
+
+	report, err = CheckRing(seed.ToNode(), user, time.Second)
+	if err != nil {
+		t.Fatalf("check failed: %v", err)
+	}
+	found := map[RingProblemType]bool{}
+	for _, p := range report.Problems {
+		found[p.Type] = true
+	}
+	if !found[BrokenLink] || !found[StaleFinger] || len(report.Problems) != 2 {
+		t.Fatalf("expected a broken link and a stale finger, found %s",
+			problems(report))
+	}
+
+	// only a user the nodes were told is an admin may repair it
+	if n, err := RepairRing(context.Background(), report, user); protocol.ErrorCodeOf(err) != protocol.Forbidden || n != 0 {
+		t.Fatalf("expected the repair to be forbidden, repaired %d: %v", n, err)
+	}
+	for _, h := range r.hosts {
+		if err := h.nodes[0].server.AddAdmin(user.Key.Public().(*rsa.PublicKey)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, err := RepairRing(context.Background(), report, user); err != nil || n != 1 {
+		t.Fatalf("expected 1 repair, repaired %d: %v", n, err)
+	}
+	if predecessor, _ := nodes[2].GetPredecessor(); predecessor.CompareID(nodes[1].ID) != 0 {
+		t.Errorf("predecessor was not repaired, is %s", predecessor.ToString())
+	}
+}
+
+func TestRingAntiEntropy(t *testing.T) {
+	r := newTestRing(t, 3, 1)
+	r.stabilize(10)
+
+	// the primary holds two keys its replicas never got, and a replica holds
+	// a key the primary lost
+	primary := r.hosts[0]
+	var pushed, pulled []models.Identifier
+	for i := 0; len(pushed) < 2 || len(pulled) < 1; i++ {
+		id := testKeyID(i)
+		if r.owner(id) != primary.Nodes()[0] {
+			continue
+		}
+		if len(pushed) < 2 {
+			pushed = append(pushed, id)
+			file.PutBlob(r.paths[0], id, []byte(fmt.Sprintf("blob-%d", i)))
+		} else {
+			pulled = append(pulled, id)
+			file.PutBlob(r.paths[1], id, []byte(fmt.Sprintf("blob-%d", i)))
+		}
+	}
+
+	replicator := file.NewReplicator(r.network,
+		3, primary.SuccessorList, testAddr(0), testKey(t, 0))
+	ae := file.NewAntiEntropy(replicator, r.paths[0], primary.Ranges)
+	if err := ae.Sync(); err != nil {
+		t.Fatalf("anti entropy failed: %v", err)
+	}
+
+	for _, id := range pushed {
+		for i := 1; i < 3; i++ {
+			if _, err := file.GetBlob(r.paths[i], id); err != nil {
+				t.Errorf("key %x was not pushed to host %d", id, i)
+			}
+		}
+	}
+	for _, id := range pulled {
+		if _, err := file.GetBlob(r.paths[0], id); err != nil {
+			t.Errorf("key %x was not pulled to the primary", id)
+		}
+	}
+
+	// a key deleted on the primary, which the replicas missed the delete
+	// of, is deleted from them rather than brought back
+	deleted := pushed[0]
+	if err := file.Delete(r.paths[0], deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := ae.Sync(); err != nil {
+		t.Fatalf("anti entropy failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := file.GetBlob(r.paths[i], deleted); err == nil {
+			t.Errorf("deleted key %x was brought back on host %d", deleted, i)
+		}
+	}
+}
+
+func TestRingRestart(t *testing.T) {
+	r := newTestRing(t, 3, 1)
+	r.stabilize(10)
+	if err := r.hosts[2].SaveState(r.paths[2]); err != nil {
+		t.Fatalf("failed to save ring state: %v", err)
+	}
+	seed := r.hosts[0].Nodes()[0].ToNode()
+
+	// the seed goes down, and host 2 is restarted somewhere else, so it has
+	// to rejoin through what it remembers
+	r.crash(0)
+	r.crash(2)
+	s := r.start(2, "node-2-restarted", 1, nil)
+	r.crashed[2] = false
+
+	state, err := LoadRingState(r.paths[2])
+	if err != nil {
+		t.Fatalf("failed to load ring state: %v", err)
+	}
+	if len(state.Peers()) == 0 {
+		t.Fatal("expected the saved ring state to have peers")
+	}
+	trustsSeed := false
+	for _, node := range s.TrustedNodes() {
+		if node.ID == seed.ID {
+			trustsSeed = true
+		}
+	}
+	if !trustsSeed {
+		t.Error("expected the seed to still be trusted after the restart")
+	}
+
+	// the node left running notices the others are gone before host 2 is
+	// back up
+	survivor := r.hosts[1].Nodes()[0]
+	fd := NewFailureDetector(survivor, time.Second, 1)
+	fd.CheckPredecessor()
+	fd.CheckFingers()
+	survivor.Stabilize()
+
+	peers := append([]models.Node{seed}, state.Peers()...)
+	if err := r.hosts[2].Rejoin(peers, time.Second); err != nil {
+		t.Fatalf("failed to rejoin: %v", err)
+	}
+	r.stabilize(10)
+	r.checkLookups()
+}
@@ -0,0 +1,133 @@
+package chord
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// RingStateFile - the file under the data path the ring state is kept in
+const RingStateFile = "ringstate"
+
+// ErrNoPeers - none of the peers given to Rejoin answered
+var ErrNoPeers = errors.New("none of the known peers answered")
+
+// VirtualNodeState - the neighbours a virtual node last knew of
+type VirtualNodeState struct {
+	VNode       uint
+	Predecessor models.Node
+	Successors  []models.Node
+}
+
+// RingState - the neighbours every virtual node of a host last knew of,
+// saved so a restarted server can find its way back into the ring without
+// depending on a single seed
+type RingState struct {
+	Nodes []VirtualNodeState
+}
+
+// State - the current neighbours of every virtual node
+func (h *Host) State() RingState {
+	state := RingState{}
+	for _, ln := range h.nodes {
+		predecessor, _ := ln.GetPredecessor()
+		state.Nodes = append(state.Nodes, VirtualNodeState{
+			VNode:       ln.VNode,
+			Predecessor: predecessor,
+			Successors:  ln.GetSuccessorList(),
+		})
+	}
+	return state
+}
+
+// SaveState - write the current neighbours of every virtual node to the
+// data path
+func (h *Host) SaveState(dataPath string) error {
+	path := fmt.Sprintf("%s/%s", dataPath, RingStateFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create ring state file: ")
+	}
+	if err := gob.NewEncoder(f).Encode(h.State()); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to encode ring state: ")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close ring state file: ")
+	}
+	// rename so a crash part way through never leaves a broken file behind
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "failed to replace ring state file: ")
+	}
+	return nil
+}
+
+// LoadRingState - read the ring state saved in the data path, which is
+// empty if the server has never run there before
+func LoadRingState(dataPath string) (RingState, error) {
+	f, err := os.Open(fmt.Sprintf("%s/%s", dataPath, RingStateFile))
+	if os.IsNotExist(err) {
+		return RingState{}, nil
+	}
+	if err != nil {
+		return RingState{}, errors.Wrap(err, "failed to open ring state file: ")
+	}
+	defer f.Close()
+
+	state := RingState{}
+	if err := gob.NewDecoder(f).Decode(&state); err != nil {
+		return RingState{}, errors.Wrap(err, "failed to decode ring state: ")
+	}
+	return state, nil
+}
+
+// Peers - the nodes worth trying to rejoin the ring through, closest first.
+// Every virtual node's successors come before any predecessor, as they are
+// the nodes that were still alive most recently when the list was refreshed.
+func (rs RingState) Peers() []models.Node {
+	peers := []models.Node{}
+	for _, vn := range rs.Nodes {
+		peers = append(peers, vn.Successors...)
+	}
+	for _, vn := range rs.Nodes {
+		peers = append(peers, vn.Predecessor)
+	}
+	return peers
+}
+
+// Rejoin - join the ring through the first of peers which answers a ping
+// within timeout.  Our own virtual nodes, empty and repeated peers, and
+// peers whose ID does not match their key are skipped.  ErrNoPeers is
+// returned if none of them answer, it is up to the caller whether to start a
+// new ring.  Any other error comes from joining through the peer which
+// answered, and is left for stabilization to fix.
+func (h *Host) Rejoin(peers []models.Node, timeout time.Duration) error {
+	tried := map[models.Identifier]bool{}
+	for _, peer := range peers {
+		if peer.Addr == "" || tried[peer.ID] || h.local(peer.ID) != nil {
+			continue
+		}
+		tried[peer.ID] = true
+
+		rn, err := NewRemoteNode(peer)
+		if err != nil {
+			glog.Infof("skipping peer %s: %v", peer.ToString(), err)
+			continue
+		}
+		ctx, cancel := timeoutContext(timeout)
+		err = rn.Ping(ctx, h.nodes[0].caller)
+		cancel()
+		if err != nil {
+			glog.Infof("peer %s did not answer: %v", peer.ToString(), err)
+			continue
+		}
+		glog.Infof("rejoining the ring through %s", peer.ToString())
+		return h.Join(peer)
+	}
+	return errors.Wrapf(ErrNoPeers, "tried %d peers: ", len(tried))
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -9,7 +10,7 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
 	"os/signal"
@@ -19,6 +20,7 @@ import (
 
 	"github.com/dietsche/rfsnotify"
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/chord"
 	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
@@ -27,9 +29,13 @@ import (
 )
 
 var (
+	// peerAddr - the comma separated addresses of known peers on the network
 	peerAddr string
-	// peerKeyFile - the key file location for a known peer on the network
-	peerKeyFile      string
+	// peerKeyFile - the comma separated key file locations of known peers on
+	// the network, in the same order as peerAddr
+	peerKeyFile string
+	// seedsFile - a file listing known peers on the network
+	seedsFile        string
 	selfKeyFile      string
 	shareWithKeyFile string
 	localPath        string
@@ -37,15 +43,23 @@ var (
 	filename         string
 	filedest         string
 	pollInterval     time.Duration
+	pingTimeout      time.Duration
+	timeout          time.Duration
+	repair           bool
+	// protocolVersion - the version of the wire protocol to send requests in
+	protocolVersion uint
+	// minProtocolVersion - the oldest version of the wire protocol we fall
+	// back to, or accept
+	minProtocolVersion uint
 )
 
 func init() {
 	flag.StringVar(
 		&peerAddr, "peerAddr", "",
-		"the address of a peer")
+		"the address of a peer, or a comma separated list of them")
 	flag.StringVar(
 		&operation, "operation", "",
-		"choice of operation, backup or getfile.  backup will put localPath in peerstore, getfile will download the file and put it in filedest. specify the file to download by name with -filename flag")
+		"choice of operation, backup or getfile.  backup will put localPath in peerstore, getfile will download the file and put it in filedest. specify the file to download by name with -filename flag.  lookup will trace the path taken to find the node storing -filename.  checkring will walk the ring from the peer and report any problems with it, repairing broken links with -repair")
 	flag.StringVar(
 		&localPath, "localPath", "",
 		"the location of the dir you wish to sync")
@@ -57,7 +71,10 @@ func init() {
 		"destination of the file with doing getfile operation")
 	flag.StringVar(
 		&peerKeyFile, "peerKeyFile", "",
-		"the key file location of a known peer on the network")
+		"the key file location of a known peer on the network, or a comma separated list of them in the same order as peerAddr")
+	flag.StringVar(
+		&seedsFile, "seedsFile", "",
+		"a file listing known peers on the network, one \"addr keyfile\" per line, tried after the ones given by peerAddr")
 	flag.StringVar(
 		&selfKeyFile, "selfKeyFile", "",
 		"the key file location of your private/public key pem file")
@@ -65,12 +82,33 @@ func init() {
 		&shareWithKeyFile, "shareWithKeyFile", "",
 		"the key file location of the public key of the user you wish to share with as a pem file")
 	flag.DurationVar(&pollInterval, "poll", time.Second, "the polling interval for sync")
+	flag.DurationVar(&pingTimeout, "pingTimeout", 2*time.Second,
+		"how long to wait on a peer to answer before trying the next one, and on a node checkring was not able to walk to before considering it dead")
+	flag.DurationVar(&timeout, "timeout", time.Minute,
+		"how long to wait on the ring for each file, its transfer included, and for lookup and the repairs of checkring")
+	flag.BoolVar(&repair, "repair", false,
+		"with checkring, set the predecessors needed to fix broken links and gaps, the nodes have to list our key with -adminKeyFile")
+	flag.UintVar(&protocolVersion, "protocolVersion", uint(protocol.LatestVersion),
+		"the version of the wire protocol to first send requests in, servers which do not accept it are fallen back to older versions down to minProtocolVersion")
+	flag.UintVar(&minProtocolVersion, "minProtocolVersion", uint(protocol.GCMVersion),
+		"the oldest version of the wire protocol to fall back to, 0 to talk to servers which only speak the legacy protocol")
 	flag.Parse()
 }
 
 func validateParams() error {
-	if peerAddr == "" {
-		return errors.New("peerAddr must be set")
+	if timeout <= 0 {
+		return errors.New("timeout must be positive")
+	}
+	if peerAddr == "" && seedsFile == "" {
+		return errors.New("peerAddr or seedsFile must be set")
+	}
+	if protocolVersion > uint(protocol.LatestVersion) ||
+		minProtocolVersion > uint(protocol.LatestVersion) {
+		return errors.Errorf("protocol versions can be at most %d",
+			protocol.LatestVersion)
+	}
+	if protocolVersion < minProtocolVersion {
+		return errors.New("protocolVersion can not be below minProtocolVersion")
 	}
 	if operation == "backup" {
 		if localPath == "" {
@@ -106,6 +144,14 @@ func validateParams() error {
 			return errors.New("filename must be set")
 		}
 
+	} else if operation == "lookup" {
+		if filename == "" {
+			return errors.New("filename must be set")
+		}
+	} else if operation == "checkring" {
+		if pingTimeout <= 0 {
+			return errors.New("pingTimeout must be positive")
+		}
 	} else {
 		return errors.New("must specify operation flag, either backup or getfile")
 	}
@@ -119,6 +165,8 @@ func main() {
 	if err := validateParams(); err != nil {
 		log.Fatalf("could not validate params: %v\n", err)
 	}
+	protocol.SendVersion = uint8(protocolVersion)
+	protocol.MinVersion = uint8(minProtocolVersion)
 
 	var (
 		privateKey *rsa.PrivateKey
@@ -153,49 +201,47 @@ func main() {
 	kb, _ := crypto.GobEncodePublicKey(privateKey.Public().(*rsa.PublicKey))
 	id := models.Identifier(sha1.Sum(kb))
 
-	// read in our peer's public key
-	keyFile, err := os.Open(peerKeyFile) // For read access.
+	// read in our peers and their public keys
+	seeds, err := protocol.ParseSeeds(peerAddr, peerKeyFile)
 	if err != nil {
-		glog.Infof("failed to read initial peer key file: %s", err)
+		log.Printf("failed to read peers: %s", err)
 		return
 	}
-
-	peerKey, err := crypto.ReadPublicKeyAsPem(keyFile)
-	if err != nil {
-		glog.Infof("failed to read keypair file: %s", err)
-		return
+	if seedsFile != "" {
+		fileSeeds, err := protocol.ReadSeedsFile(seedsFile)
+		if err != nil {
+			log.Printf("failed to read seeds file: %s", err)
+			return
+		}
+		seeds = append(seeds, fileSeeds...)
 	}
 
-	// register the user with the network
+	// register the user with the network, through the first peer which
+	// answers, which is the peer we use from here on
 	log.Printf("usertype should be : %d", protocol.UserType)
-	rt, err := protocol.NewTransport("tcp", peerAddr, protocol.UserType, id, &peerKey, privateKey)
+	peer, resp, err := protocol.FirstSeed(
+		protocol.TCPNetwork{}, seeds, protocol.UserType, id, privateKey, pingTimeout,
+		&protocol.Request{
+			Header: protocol.Header{
+				From:   id,
+				Type:   protocol.UserType,
+				PubKey: privateKey.Public().(*rsa.PublicKey),
+			},
+			Method: protocol.UserRegistrationMethod,
+		})
 	if err != nil {
-		log.Printf("ERR: %v", err)
+		log.Printf("Failed to register with a peer: %v", err)
 		return
 	}
-	log.Println("transport established")
-
-	resp, err := rt.RoundTrip(&protocol.Request{
-		Header: protocol.Header{
-			From:   id,
-			Type:   protocol.UserType,
-			PubKey: privateKey.Public().(*rsa.PublicKey),
-		},
-		Method: protocol.UserRegistrationMethod,
-	})
-	log.Println("registered user")
-	if err != nil {
-		log.Printf("Failed to round trip the successor request: %v", err)
-		return
+	if err := resp.Err(); err != nil {
+		// we may well have registered before, in which case the rest
+		// still works
+		log.Printf("Failed to register with %s: %v", peer.Addr, err)
+	} else {
+		log.Printf("registered user with %s", peer.Addr)
 	}
-	rt.Close()
 	log.Printf("response: %+v", resp)
 
-	var peer = models.Node{
-		Addr:      peerAddr,
-		PublicKey: &peerKey,
-	}
-
 	switch operation {
 	case "share":
 		log.Println("starting share!")
@@ -223,6 +269,8 @@ func main() {
 		// we have our shareWithKey, which we will use to encrypt
 		// the session key
 
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
 		// create a transport to our peer
 		t, err := createTransport(id, peer, privateKey)
 		if !handleError(err) {
@@ -230,7 +278,7 @@ func main() {
 		}
 		defer t.Close()
 		// get the node that has the file
-		node, err := getNode(fileToKeyIdentifier(filename), id, t)
+		node, err := getNode(ctx, fileToKeyIdentifier(filename), id, t)
 		// connect to node housing the data
 		st, err := createTransport(id, node, privateKey)
 		if !handleError(err) {
@@ -238,10 +286,11 @@ func main() {
 		}
 		defer st.Close()
 		// get the file
-		resp, err := getKey(fileToKeyIdentifier(filename), id, st)
+		resp, err := getKey(ctx, fileToKeyIdentifier(filename), id, st)
 		if !handleError(err) {
 			return
 		}
+		defer resp.Close()
 		// encrypt session key with public key of shared user
 		sKey, err := crypto.DecryptRSA(privateKey, resp.Header.Secret)
 		if !handleError(err) {
@@ -265,12 +314,13 @@ func main() {
 
 		// post file
 		log.Println("starting request: ", protocol.PostFileMethod)
-		_, err = st.RoundTrip(&protocol.Request{
+		// the file is streamed back as it is read, over a connection
+		// of its own
+		req := &protocol.Request{
 			Header: protocol.Header{
 				Key:          fileToKeyIdentifier(filename),
 				Type:         protocol.UserType,
 				From:         id,
-				DataLength:   uint64(len(resp.Data)),
 				PubKey:       privateKey.Public().(*rsa.PublicKey),
 				ResourceName: filename,
 				Log:          true,
@@ -278,8 +328,9 @@ func main() {
 				Secret:       resp.Header.Secret,
 			},
 			Method: protocol.PostFileMethod,
-			Data:   resp.Data,
-		})
+		}
+		req.SetBody(resp.Body())
+		_, err = st.RoundTripContext(ctx, req)
 		if !handleError(err) {
 			return
 		}
@@ -326,7 +377,7 @@ func main() {
 		// that resource.  If timestamp is less than current clock, then post
 		var transactionLog = models.TransactionLog{}
 		transactionLog, _ = Synchronize(
-			id, localPath, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+			id, localPath, peer,
 			privateKey, transactionLog)
 
 		AddWatchers(watcher, localPath)
@@ -341,7 +392,7 @@ func main() {
 				// if differences, get the resources that are different
 				RemoveWatchers(watcher, localPath)
 				transactionLog, _ = Synchronize(
-					id, localPath, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+					id, localPath, peer,
 					privateKey, transactionLog)
 				AddWatchers(watcher, localPath)
 			case event := <-watcher.Events:
@@ -350,13 +401,13 @@ func main() {
 				if event.Op == fsnotify.Write {
 					log.Println("file written: ", event.Name)
 					path := strings.TrimPrefix(event.Name, localPath)
-					PostFile(id, path, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+					PostFile(id, path, peer,
 						privateKey)
 				}
 				if event.Op == fsnotify.Remove {
 					log.Println("file removed: ", event.Name)
 					path := strings.TrimPrefix(event.Name, localPath)
-					DeleteFile(id, path, models.Node{Addr: peerAddr, PublicKey: &peerKey},
+					DeleteFile(id, path, peer,
 						privateKey)
 				}
 			case err := <-watcher.Errors:
@@ -371,6 +422,9 @@ func main() {
 			if !fi.IsDir() {
 				log.Printf("file is: %s\n", path)
 
+				ctx, cancel := context.WithTimeout(context.Background(), timeout)
+				defer cancel()
+
 				// figure out where to connect to
 				t, err := createTransport(id, peer, privateKey)
 				if !handleError(err) {
@@ -378,7 +432,7 @@ func main() {
 				}
 				defer t.Close()
 
-				node, err := getNode(fileToKeyIdentifier(path), id, t)
+				node, err := getNode(ctx, fileToKeyIdentifier(path), id, t)
 				if !handleError(err) {
 					return errors.Wrap(err, "failed to get node")
 				}
@@ -394,15 +448,18 @@ func main() {
 					sessionKey []byte
 					secret     []byte
 					iv         []byte
-					ciphertext []byte
 				)
 
-				// read the file
-				plaintext, err := ioutil.ReadFile(path)
-
-				resp, err := getKey(fileToKeyIdentifier(path), id, t)
+				resp, err := getKey(ctx, fileToKeyIdentifier(path), id, t)
 				fmt.Println("UHHHH! ", err, resp.Status)
-				if err != nil || resp.Status == protocol.Error {
+				if err != nil && protocol.ErrorCodeOf(err) != protocol.NotFound {
+					// the file may well be there, we are just not able
+					// to get it, so we can not post over it, skip it
+					log.Printf("ERR: failed to check for file %s, skipping it: %v",
+						path, err)
+					return nil
+				}
+				if err != nil {
 					// doesnt exist, create new key
 					log.Println("IN HER$E!!!")
 					sessionKey, secret, err = crypto.GenerateSessionKey(
@@ -413,9 +470,9 @@ func main() {
 					if !handleError(err) {
 						return errors.Wrap(err, "failed to generate session key")
 					}
-					ciphertext, iv, err = crypto.Encrypt(sessionKey, plaintext)
+					iv, err = crypto.GenerateIV()
 					if !handleError(err) {
-						return errors.Wrap(err, "failed to encrypt payload")
+						return errors.Wrap(err, "failed to generate iv")
 					}
 				} else {
 					// user session key from remote
@@ -425,39 +482,50 @@ func main() {
 					log.Printf("crypted session key: %s", hex.EncodeToString(secret))
 					log.Printf("len of session key crypted: %d", len(secret))
 					if !handleError(err) {
+						resp.Close()
 						return errors.Wrap(err, "failed to decrypt session Key")
 					}
-					iv = resp.Data[:aes.BlockSize]
-					ciphertext, iv, err = crypto.EncryptWithIV(sessionKey, plaintext, iv)
+					// the stored file starts with the iv, which we keep
+					iv = make([]byte, aes.BlockSize)
+					_, err = io.ReadFull(resp.Body(), iv)
+					resp.Close()
 					if !handleError(err) {
-						return errors.Wrap(err, "failed to encrypt payload")
+						return errors.Wrap(err, "failed to read iv")
 					}
 				}
 
-				log.Printf("plaintext is: %s", string(plaintext))
-
-				log.Printf("len of ciphertext: %d", len(ciphertext))
-				log.Printf("ciphertext: %s", hex.EncodeToString(ciphertext))
 				log.Printf("len of iv: %d", len(iv))
 				log.Printf("iv: %s", hex.EncodeToString(iv))
-				ciphertext = append(iv, ciphertext...)
+
+				// read the file, encrypting it as it is sent
+				f, err := os.Open(path)
+				if !handleError(err) {
+					return errors.Wrap(err, "failed to open file")
+				}
+				defer f.Close()
+				pr, pw := io.Pipe()
+				defer pr.Close()
+				go func() {
+					pw.CloseWithError(encryptFile(pw, f, sessionKey, iv))
+				}()
 
 				// send the file over
 				log.Println("starting request: ", protocol.PostFileMethod)
-				_, err = st.RoundTrip(&protocol.Request{
+				req := &protocol.Request{
 					Header: protocol.Header{
 						Key:          fileToKeyIdentifier(path),
 						Type:         protocol.UserType,
 						From:         id,
-						DataLength:   uint64(len(ciphertext)),
+						DataLength:   uint64(aes.BlockSize + (fi.Size()/aes.BlockSize+1)*aes.BlockSize),
 						PubKey:       privateKey.Public().(*rsa.PublicKey),
 						ResourceName: path,
 						Log:          true,
 						Secret:       secret,
 					},
 					Method: protocol.PostFileMethod,
-					Data:   ciphertext,
-				})
+				}
+				req.SetBody(pr)
+				_, err = st.RoundTripContext(ctx, req)
 				if !handleError(err) {
 					return errors.Wrap(err, "failed to post file")
 				}
@@ -466,11 +534,81 @@ func main() {
 		}
 
 		// Open up directory
-		// read each file, and send to peerAddr
+		// read each file, and send to our peer
 		filepath.Walk(localPath, walkFn)
 
+	case "lookup":
+		log.Printf("looking up file: %s", filename)
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		result, err := chord.Lookup(ctx, peer, fileToKeyIdentifier(filename), chord.Caller{
+			Type:    protocol.UserType,
+			ID:      id,
+			Key:     privateKey,
+			Network: protocol.TCPNetwork{},
+		})
+		for i, hop := range result.Path {
+			if hop.Err != nil {
+				log.Printf("hop %d: %s, vnode=%d, id=%s, %v, failed: %v", i+1,
+					hop.Node.Addr, hop.Node.VNode,
+					hex.EncodeToString(hop.Node.ID[:]), hop.Latency, hop.Err)
+				continue
+			}
+			log.Printf("hop %d: %s, vnode=%d, id=%s, %v", i+1,
+				hop.Node.Addr, hop.Node.VNode,
+				hex.EncodeToString(hop.Node.ID[:]), hop.Latency)
+		}
+		if !handleError(err) {
+			return
+		}
+		log.Printf("key=%s is stored on %s, vnode=%d, id=%s after %d hops",
+			hex.EncodeToString(result.ID[:]), result.Successor.Addr,
+			result.Successor.VNode, hex.EncodeToString(result.Successor.ID[:]),
+			result.Hops)
+
+	case "checkring":
+		log.Printf("checking ring from: %s", peer.Addr)
+
+		// the walk only reads the state of the nodes, so it is made as
+		// the user
+		caller := chord.Caller{
+			Type:    protocol.UserType,
+			ID:      id,
+			Key:     privateKey,
+			Network: protocol.TCPNetwork{},
+		}
+		report, err := chord.CheckRing(peer, caller, pingTimeout)
+		for i, node := range report.Nodes {
+			log.Printf("node %d: %s, vnode=%d, id=%s", i+1,
+				node.Addr, node.VNode, hex.EncodeToString(node.ID[:]))
+		}
+		for _, p := range report.Problems {
+			log.Printf("problem: %s", p.ToString())
+		}
+		if !handleError(err) {
+			return
+		}
+		if report.Consistent() {
+			log.Printf("ring of %d nodes is consistent", len(report.Nodes))
+			return
+		}
+		log.Printf("ring of %d nodes has %d problems",
+			len(report.Nodes), len(report.Problems))
+		if repair {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			repaired, err := chord.RepairRing(ctx, report, caller)
+			log.Printf("repaired %d links", repaired)
+			if !handleError(err) {
+				return
+			}
+		}
+
 	case "getfile":
 		log.Printf("getting file: %s, putting %s", filename, filedest)
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
 		t, err := createTransport(id, peer, privateKey)
 		if !handleError(err) {
 			return
@@ -478,7 +616,10 @@ func main() {
 		defer t.Close()
 
 		// get the node that houses the file we need
-		node, err := getNode(fileToKeyIdentifier(filename), id, t)
+		node, err := getNode(ctx, fileToKeyIdentifier(filename), id, t)
+		if !handleError(err) {
+			return
+		}
 
 		st, err := createTransport(id, node, privateKey)
 		if !handleError(err) {
@@ -487,10 +628,11 @@ func main() {
 		defer st.Close()
 
 		// get the key
-		resp, err := getKey(fileToKeyIdentifier(filename), id, t)
+		resp, err := getKey(ctx, fileToKeyIdentifier(filename), id, t)
 		if !handleError(err) {
 			return
 		}
+		defer resp.Close()
 
 		log.Printf("response from getKey: %+v", resp)
 		log.Printf("secret from getKey: %+v", hex.EncodeToString(resp.Header.Secret))
@@ -503,29 +645,35 @@ func main() {
 
 		log.Printf("plaintext session key is: %s", hex.EncodeToString(sessionKey))
 
-		// pull iv out of data
-		log.Printf("length of data: %d", len(resp.Data))
-		iv := resp.Data[:aes.BlockSize]
-		ciphertext := resp.Data[aes.BlockSize:]
+		// pull iv out of data, the ciphertext follows it
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(resp.Body(), iv); !handleError(err) {
+			return
+		}
 
 		log.Printf("iv from data: %s", hex.EncodeToString(iv))
-		log.Printf("ciphertext from data: %s", hex.EncodeToString(ciphertext))
 
-		// decrypt data
-		plaintext, err := crypto.Decrypt(sessionKey, ciphertext, iv)
+		// decrypt data as it arrives
+		plaintext, err := crypto.NewDecryptReader(resp.Body(), sessionKey, iv)
 		if !handleError(err) {
-			log.Printf("err: %s", err.Error())
 			return
 		}
 		// store data
-
-		log.Printf("plaintext is: %s", plaintext)
-
-		err = ioutil.WriteFile(filedest, plaintext, 0644)
+		f, err := os.OpenFile(filedest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		if err != nil {
 			log.Println(err)
 			return
 		}
+		if _, err := io.Copy(f, plaintext); err != nil {
+			log.Printf("err: %s", err.Error())
+			f.Close()
+			os.Remove(filedest)
+			return
+		}
+		if err := f.Close(); err != nil {
+			log.Println(err)
+			return
+		}
 	}
 }
 
@@ -533,7 +681,9 @@ func fileToKeyIdentifier(filename string) models.Identifier {
 	return models.Identifier(sha1.Sum([]byte(filename)))
 }
 
-func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, error) {
+// getNode - ask the node t talks to for the successor of key, giving up
+// once ctx is done
+func getNode(ctx context.Context, key, id models.Identifier, t *protocol.Transport) (models.Node, error) {
 	// serialize our get successor request
 	var (
 		idBuf = new(bytes.Buffer)
@@ -543,7 +693,7 @@ func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, err
 	// encode successor request
 	enc.Encode(models.SuccessorRequest{key})
 	// perform round trip on transport
-	resp, err := t.RoundTrip(&protocol.Request{
+	resp, err := t.RoundTripContext(ctx, &protocol.Request{
 		Header: protocol.Header{
 			Type: protocol.UserType,
 			From: id,
@@ -569,7 +719,7 @@ func getNode(key, id models.Identifier, t *protocol.Transport) (models.Node, err
 }
 
 func createTransport(id models.Identifier, node models.Node, key *rsa.PrivateKey) (*protocol.Transport, error) {
-	return protocol.NewTransport(
+	return protocol.NewTransport(protocol.TCPNetwork{},
 		"tcp", node.Addr, protocol.UserType, id, node.PublicKey, key)
 }
 
@@ -581,9 +731,12 @@ func handleError(err error) bool {
 	return true
 }
 
-func getKey(key, id models.Identifier, t *protocol.Transport) (protocol.Response, error) {
+// getKey - get the file stored under key, the file is streamed in the body
+// of the response, which has to be closed.  Reading the file gives up once
+// ctx is done.
+func getKey(ctx context.Context, key, id models.Identifier, t *protocol.Transport) (protocol.Response, error) {
 	// perform round trip
-	resp, err := t.RoundTrip(&protocol.Request{
+	resp, err := t.RoundTripStreamContext(ctx, &protocol.Request{
 		Header: protocol.Header{
 			Type: protocol.UserType,
 			From: id,
@@ -592,16 +745,28 @@ func getKey(key, id models.Identifier, t *protocol.Transport) (protocol.Response
 		Method: protocol.GetFileMethod,
 	})
 	if err != nil {
-		log.Printf("Failed to round trip the successor request: %v", err)
-		return protocol.Response{}, errors.Wrap(err, "failed round trip")
-	}
-	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return resp, errors.New("protocol failure")
+		log.Printf("failed to get resource requested: %v", err)
+		return resp, errors.Wrap(err, "failed round trip")
 	}
 	return resp, nil
 }
 
+// encryptFile - write the iv followed by the contents of f encrypted with
+// key, a block at a time
+func encryptFile(w io.Writer, f io.Reader, key, iv []byte) error {
+	if _, err := w.Write(iv); err != nil {
+		return errors.Wrap(err, "failed to write iv: ")
+	}
+	ew, err := crypto.NewEncryptWriter(w, key, iv)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(ew, f); err != nil {
+		return errors.Wrap(err, "failed to encrypt file: ")
+	}
+	return ew.Close()
+}
+
 var tl = models.TransactionLog{}
 
 func Synchronize(clientID models.Identifier, localPath string, peer models.Node, privateKey *rsa.PrivateKey, oldTransactionLog models.TransactionLog) (models.TransactionLog, error) {
@@ -694,7 +859,7 @@ func GetFile(clientID models.Identifier, path string, peer models.Node, privateK
 	key := sha1.Sum([]byte(path))
 
 	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
@@ -734,12 +899,13 @@ func GetFile(clientID models.Identifier, path string, peer models.Node, privateK
 	}
 
 	// figure out where to connect to
-	t, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
 
-	resp, err = t.RoundTrip(&protocol.Request{
+	defer t.Close()
+	resp, err = t.RoundTripStream(&protocol.Request{
 		Header: protocol.Header{
 			Type: protocol.UserType,
 			From: clientID,
@@ -747,39 +913,50 @@ func GetFile(clientID models.Identifier, path string, peer models.Node, privateK
 		},
 		Method: protocol.GetFileMethod,
 	})
-	t.Close()
 	if err != nil {
 		log.Printf("Failed to round trip the successor request: %v", err)
 		return
 	}
-	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return
-	}
-
+	defer resp.Close()
 	models.IncrementClock(resp.Header.Clock)
 
 	// make the directory structure needed:
 	dir, _ := filepath.Split(filepath.Join(localPath, path))
 	os.MkdirAll(dir, 0700)
 
-	log.Printf("The file contents are: %s", string(resp.Data))
-
-	err = ioutil.WriteFile(filepath.Join(localPath, path), resp.Data, 0644)
+	f, err := os.OpenFile(
+		filepath.Join(localPath, path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		log.Println(err)
 		return
 	}
+	if _, err := io.Copy(f, resp.Body()); err != nil {
+		log.Println(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Println(err)
+		return
+	}
 }
 
 func PostFile(clientID models.Identifier, path string, peer models.Node, privateKey *rsa.PrivateKey) {
 	// post the specified resource in the DHT
 	// the key for the distributed lookup
 	key := sha1.Sum([]byte(path))
-	data, err := ioutil.ReadFile(filepath.Join(localPath, path)) // path is the path to the file.
+	data, err := os.Open(filepath.Join(localPath, path)) // path is the path to the file.
+	if err != nil {
+		log.Printf("ERR: %v", err)
+		return
+	}
+	defer data.Close()
+	info, err := data.Stat()
+	if err != nil {
+		log.Printf("ERR: %v", err)
+		return
+	}
 
 	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.UserType, clientID, peer.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
@@ -814,27 +991,28 @@ func PostFile(clientID models.Identifier, path string, peer models.Node, private
 	}
 
 	// figure out where to connect to
-	t, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", node.Addr, protocol.UserType, clientID, node.PublicKey, privateKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
 
 	// send the file over
 	log.Println("starting request: ", protocol.PostFileMethod)
-	response, err := t.RoundTrip(&protocol.Request{
+	req := &protocol.Request{
 		Header: protocol.Header{
 			Key:          key,
 			Type:         protocol.UserType,
 			From:         clientID,
-			DataLength:   uint64(len(data)),
+			DataLength:   uint64(info.Size()),
 			PubKey:       privateKey.Public().(*rsa.PublicKey),
 			ResourceName: path,
 			Log:          true,
 			Clock:        models.GetClock(),
 		},
 		Method: protocol.PostFileMethod,
-		Data:   data,
-	})
+	}
+	req.SetBody(data)
+	response, err := t.RoundTrip(req)
 	t.Close()
 	if err != nil {
 		log.Printf("ERR: %v\n", err)
@@ -936,7 +1114,7 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	log.Printf("Trying to GET Transaction LOG, ID: %x", id)
 
 	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 	}
@@ -974,7 +1152,7 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	glog.Info("Peer holding TransactionLog: %s", node.ToString())
 
 	// now connect to the node holding the transaction log
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, thisID, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.UserType, thisID, node.PublicKey, selfKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
@@ -993,11 +1171,6 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 		return models.TransactionLog{}, errors.Wrap(err, "failed to get file")
 	}
 
-	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file, protocol error")
-	}
-
 	var transactionLog = models.TransactionLog{}
 	dec = gob.NewDecoder(bytes.NewBuffer(resp.Data))
 	err = dec.Decode(&transactionLog)
@@ -1018,7 +1191,7 @@ func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	glog.Infof("Trying to PUT Transaction LOG, ID: %x", id)
 
 	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.UserType, id, peer.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 	}
@@ -1064,7 +1237,7 @@ func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	}
 
 	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", node.Addr, protocol.UserType, id, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", node.Addr, protocol.UserType, id, node.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 		return errors.Wrap(err, "failed serialize transaction log: ")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rsa"
 	"crypto/sha1"
 	"encoding/hex"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/golang/glog"
@@ -25,16 +27,42 @@ var (
 
 	// addr - the address for the server to listen on
 	addr string
-	// initialPeerAddr - the address for a known peer on the network
+	// initialPeerAddr - the comma separated addresses of known peers on the
+	// network
 	initialPeerAddr string
-	// initialPeerKeyFile - the key file location for a known peer on the network
+	// initialPeerKeyFile - the comma separated key file locations of known
+	// peers on the network, in the same order as initialPeerAddr
 	initialPeerKeyFile string
+	// seedsFile - a file listing known peers on the network
+	seedsFile string
 	// dataPath - the path where the data should be stored
 	dataPath string
 	// requestQueueBuffer - the number of requests to buffer in the server
 	requestQueueBuffer uint
 	// requestNumWorkers - the number of request processing workers
 	requestNumWorkers uint
+	// successorListSize - the number of successors each node keeps track of
+	successorListSize uint
+	// replicationFactor - the number of nodes holding a copy of every file
+	replicationFactor uint
+	// pingInterval - how often to check that known nodes are alive
+	pingInterval time.Duration
+	// pingTimeout - how long to wait for a node to answer a ping
+	pingTimeout time.Duration
+	// maxPingFailures - the number of failed pings in a row before a node
+	// is considered dead
+	maxPingFailures uint
+	// virtualNodes - the number of positions on the ring this server takes
+	virtualNodes uint
+	// antiEntropyInterval - how often to compare our keys with our replicas
+	antiEntropyInterval time.Duration
+	// protocolVersion - the version of the wire protocol we send requests in
+	protocolVersion uint
+	// minProtocolVersion - the oldest version of the wire protocol we accept
+	minProtocolVersion uint
+	// adminKeyFile - the comma separated public key file locations of the
+	// users allowed to repair the ring
+	adminKeyFile string
 )
 
 func init() {
@@ -44,10 +72,13 @@ func init() {
 		"the address for the server to listen")
 	flag.StringVar(
 		&initialPeerAddr, "initialPeerAddr", "",
-		"the address of a known peer on the network")
+		"the address of a known peer on the network, or a comma separated list of them")
 	flag.StringVar(
 		&initialPeerKeyFile, "initialPeerKeyFile", "",
-		"the key file location of a known peer on the network")
+		"the key file location of a known peer on the network, or a comma separated list of them in the same order as initialPeerAddr")
+	flag.StringVar(
+		&seedsFile, "seedsFile", "",
+		"a file listing known peers on the network, one \"addr keyfile\" per line, tried after the ones given by initialPeerAddr")
 	flag.StringVar(
 		&dataPath, "dataPath", "./.peerstore",
 		"the data location for the server to store files")
@@ -57,6 +88,36 @@ func init() {
 	flag.UintVar(
 		&requestNumWorkers, "requestNumWorkers", uint(runtime.NumCPU()*2),
 		"the number of server threads for connection processing")
+	flag.UintVar(
+		&successorListSize, "successorListSize", 4,
+		"the number of successors to keep track of in case of node failures")
+	flag.UintVar(
+		&replicationFactor, "replicationFactor", 3,
+		"the number of nodes, primary included, which store a copy of every file")
+	flag.DurationVar(
+		&pingInterval, "pingInterval", 5*time.Second,
+		"how often to check the predecessor, fingers and successors are alive")
+	flag.DurationVar(
+		&pingTimeout, "pingTimeout", 2*time.Second,
+		"how long to wait for a node to answer a ping")
+	flag.UintVar(
+		&maxPingFailures, "maxPingFailures", 2,
+		"the number of failed pings in a row before a node is considered dead")
+	flag.UintVar(
+		&virtualNodes, "virtualNodes", 4,
+		"the number of virtual nodes, bigger machines can take a larger share of keys")
+	flag.DurationVar(
+		&antiEntropyInterval, "antiEntropyInterval", time.Minute,
+		"how often to compare the keys we are in charge of with our replicas, and fix any that differ")
+	flag.UintVar(
+		&protocolVersion, "protocolVersion", uint(protocol.LatestVersion),
+		"the version of the wire protocol to first send requests in, peers which do not accept it are fallen back to older versions down to minProtocolVersion")
+	flag.UintVar(
+		&minProtocolVersion, "minProtocolVersion", uint(protocol.GCMVersion),
+		"the oldest version of the wire protocol to accept and fall back to, 0 while some peers or clients still only speak the legacy protocol")
+	flag.StringVar(
+		&adminKeyFile, "adminKeyFile", "",
+		"the public key file location of a user allowed to repair the ring with checkring -repair, or a comma separated list of them")
 	flag.Parse()
 }
 
@@ -64,12 +125,42 @@ func validateParams() error {
 	if addr == "" {
 		return errors.New("addr must be set")
 	}
-	if initialPeerAddr == "" {
-		return errors.New("intialPeerAddr must be set")
+	if initialPeerAddr == "" && seedsFile == "" {
+		return errors.New("intialPeerAddr or seedsFile must be set")
 	}
 	if dataPath == "" {
 		return errors.New("dataPath must be set")
 	}
+	if successorListSize < 1 {
+		return errors.New("successorListSize must be at least 1")
+	}
+	if replicationFactor < 1 {
+		return errors.New("replicationFactor must be at least 1")
+	}
+	if replicationFactor-1 > successorListSize {
+		return errors.New("replicationFactor can not exceed successorListSize + 1")
+	}
+	if pingInterval <= 0 || pingTimeout <= 0 {
+		return errors.New("pingInterval and pingTimeout must be positive")
+	}
+	if antiEntropyInterval <= 0 {
+		return errors.New("antiEntropyInterval must be positive")
+	}
+	if maxPingFailures < 1 {
+		return errors.New("maxPingFailures must be at least 1")
+	}
+	if virtualNodes < 1 || virtualNodes > models.MaxVirtualNodes {
+		return errors.Errorf("virtualNodes must be between 1 and %d",
+			models.MaxVirtualNodes)
+	}
+	if protocolVersion > uint(protocol.LatestVersion) ||
+		minProtocolVersion > uint(protocol.LatestVersion) {
+		return errors.Errorf("protocol versions can be at most %d",
+			protocol.LatestVersion)
+	}
+	if protocolVersion < minProtocolVersion {
+		return errors.New("protocolVersion can not be below minProtocolVersion")
+	}
 	info, err := os.Stat(dataPath)
 	if err != nil {
 		return errors.Wrap(err, "error attempting to validate dataPath: ")
@@ -87,35 +178,24 @@ func main() {
 	if err := validateParams(); err != nil {
 		glog.Fatalf("failed to validate command line params: %v\n", err)
 	}
+	protocol.SendVersion = uint8(protocolVersion)
+	protocol.MinVersion = uint8(minProtocolVersion)
 
 	var (
-		// quit - channel to inform the server to stop listening
-		// signal chord to "leave" the network
+		// quit - channel to inform the server to stop listening,
+		// which signals chord to "leave" the network
 		quit = make(chan bool)
 		// done - channel to inform main the server is shutdown
 		// and the chord node has left the network
 		done = make(chan bool)
+		// stopStabilize - channel to stop the stabilization loop
+		stopStabilize = make(chan bool)
 	)
 
-	// handle interupts gracefully
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, os.Interrupt)
-	go func() {
-		for _ = range signalChan {
-			glog.Info("Interrupt, Killing workers")
-			// signal server to quit processing requests
-			quit <- true
-			// wait for server to be finished
-			<-done
-			glog.Info("Done.")
-			os.Exit(0)
-		}
-	}()
-
 	var (
-		peerNode models.Node
-		key      *rsa.PrivateKey
-		err      error
+		seeds []models.Node
+		key   *rsa.PrivateKey
+		err   error
 	)
 
 	privateKeyFile, err := os.Open(
@@ -154,77 +234,110 @@ func main() {
 		}
 	}
 
-	// if no peer is specified, we are the only one, so dont read a peer
-	if initialPeerKeyFile != "" {
-		// read in our peer's public key
-		keyFile, err := os.Open(initialPeerKeyFile) // For read access.
-		if err != nil {
-			glog.Infof("failed to read initial peer key file: %s", err)
-			return
-		}
-
-		peerKey, err := crypto.ReadPublicKeyAsPem(keyFile)
+	// if no peer is specified, we are the only one, so there are no seeds
+	seeds, err = protocol.ParseSeeds(initialPeerAddr, initialPeerKeyFile)
+	if err != nil {
+		glog.Fatalf("failed to read initial peers: %v", err)
+	}
+	if seedsFile != "" {
+		fileSeeds, err := protocol.ReadSeedsFile(seedsFile)
 		if err != nil {
-
-		}
-
-		peerNode = models.Node{
-			Addr:      initialPeerAddr,
-			PublicKey: &peerKey,
-			ID:        sha1.Sum([]byte(addr)),
+			glog.Fatalf("failed to read seeds file: %v", err)
 		}
+		seeds = append(seeds, fileSeeds...)
 	}
 
 	// create a server to listen on
-	server, err := protocol.NewServer(
-		key, peerNode, addr, dataPath, requestQueueBuffer, requestNumWorkers)
+	server, err := protocol.NewServer(protocol.TCPNetwork{},
+		key, seeds, addr, dataPath, requestQueueBuffer, requestNumWorkers)
 	if err != nil {
 		glog.Fatalf("Failed to create new server: %v", err)
 	}
+	if err := addAdmins(server, adminKeyFile); err != nil {
+		glog.Fatalf("failed to read admin keys: %v", err)
+	}
 
-	if initialPeerKeyFile != "" {
-		// need to register with our peer first thing
-		t, err := protocol.NewTransport("tcp", peerNode.Addr, protocol.NodeType, models.Identifier(sha1.Sum([]byte(addr))), peerNode.PublicKey, key)
-		resp, err := t.RoundTrip(&protocol.Request{
-			Header: protocol.Header{
-				From:     models.Identifier(sha1.Sum([]byte(addr))),
-				FromAddr: addr,
-				Type:     protocol.NodeType,
-				PubKey:   key.Public().(*rsa.PublicKey),
-			},
-			Method: protocol.NodeRegistrationMethod,
-		})
-		if err != nil {
-			// failed to register with peer node
-			glog.Infof("failed to register trust with peer node")
-			return
-		}
-		glog.Infof("Response from registration: %+v", resp)
-		// TODO: iterate through all nodes in response, and contact all of
-		// them to "NodeTrustMethod" them
+	// create our virtual chord nodes.
+	host, err := chord.NewHost(server, addr, virtualNodes, successorListSize, replicationFactor)
+	if err != nil {
+		glog.Fatalf("failed to create chord virtual nodes: %v\n", err)
 	}
 
-	// create our local chord node.
-	localNode, err := chord.NewLocalNode(server, addr, peerNode)
+	for _, localNode := range host.Nodes() {
+		glog.Infof("!!! local node: addr=%s, vnode=%d, id=%s\n",
+			localNode.Addr, localNode.VNode,
+			hex.EncodeToString(localNode.ID[:]))
+	}
 
-	glog.Infof("!!! local node: addr=%s, id=%s\n",
-		localNode.Addr,
-		hex.EncodeToString(localNode.ID[:]))
+	// leave the ring as the server shuts down, while it can still answer
+	// the nodes we hand off to
+	server.OnShutdown(func(ctx context.Context) {
+		glog.Info("leaving the ring")
+		// stop stabilizing, we are on our way out
+		close(stopStabilize)
+		// hand off our keys and splice ourselves out of the ring
+		if err := host.Leave(ctx); err != nil {
+			glog.Infof("failed to leave the ring: %v\n", err)
+		}
+	})
 
-	if err != nil {
-		// error condition happens when node is unable to connect to
-		// the peer specified, we shall log the error, and use an uninitialized
-		// peer for now
-		glog.Infof("failed to create chord local node: %v\n", err)
-	}
+	// handle interupts gracefully
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, os.Interrupt)
+	go func() {
+		for _ = range signalChan {
+			glog.Info("Interrupt, shutting down")
+			// signal server to leave the ring, and finish the requests
+			// it is answering
+			quit <- true
+			// wait for server to be finished
+			<-done
+			glog.Info("Done.")
+			os.Exit(0)
+		}
+	}()
 
 	// Start stabilizing!
 	go func() {
 		for {
 			select {
 			case <-time.After(10 * time.Second):
-				localNode.Stabilize()
-				// TODO: use quit chan to stop stabilization
+				for _, localNode := range host.Nodes() {
+					localNode.Stabilize()
+					localNode.FixFingers()
+				}
+				// remember our neighbours, to rejoin through if restarted
+				if err := host.SaveState(dataPath); err != nil {
+					glog.Infof("failed to save ring state: %v\n", err)
+				}
+			case <-stopStabilize:
+				glog.Info("stopping stabilization")
+				return
+			}
+		}
+	}()
+
+	// Start checking our neighbors are alive
+	detectors := []*chord.FailureDetector{}
+	for _, localNode := range host.Nodes() {
+		detectors = append(detectors,
+			chord.NewFailureDetector(localNode, pingTimeout, maxPingFailures))
+	}
+	go func() {
+		for {
+			select {
+			case <-time.After(pingInterval):
+				for _, detector := range detectors {
+					if err := detector.CheckPredecessor(); err != nil {
+						glog.Infof("failed to check predecessor: %v\n", err)
+					}
+					if err := detector.CheckFingers(); err != nil {
+						glog.Infof("failed to check fingers: %v\n", err)
+					}
+				}
+			case <-stopStabilize:
+				glog.Info("stopping failure detection")
+				return
 			}
 		}
 	}()
@@ -232,22 +345,68 @@ func main() {
 	glog.Infof("Starting server - %s, %s, %d, %d",
 		addr, dataPath, requestQueueBuffer, requestNumWorkers)
 
+	// push every post and delete to our successors
+	replicator := file.NewReplicator(server.Network(),
+		replicationFactor, host.SuccessorList, addr, key)
+	server.SetContextValue(models.ReplicatorContextKey, replicator)
+
+	// periodically fix any replicas which have fallen out of step
+	antiEntropy := file.NewAntiEntropy(replicator, dataPath, host.Ranges)
+	go func() {
+		for {
+			select {
+			case <-time.After(antiEntropyInterval):
+				if err := antiEntropy.Sync(); err != nil {
+					glog.Infof("failed anti entropy: %v\n", err)
+				}
+			case <-stopStabilize:
+				glog.Info("stopping anti entropy")
+				return
+			}
+		}
+	}()
+
 	// file handler routes
 	server.Handle(protocol.GetFileMethod, file.GetFileHandler)
 	server.Handle(protocol.PostFileMethod, file.PostFileHandler)
 	server.Handle(protocol.GetPublicKeyMethod, file.GetPublicKeyHandler)
 	server.Handle(protocol.PostPublicKeyMethod, file.PostPublicKeyHandler)
 	server.Handle(protocol.DeleteFileMethod, file.DeleteFileHandler)
-	// chord handler routes
-	server.Handle(protocol.GetSuccessorMethod, localNode.SuccessorHandler)
-	server.Handle(protocol.SetPredecessorMethod, localNode.SetPredecessorHandler)
-	server.Handle(protocol.GetPredecessorMethod, localNode.GetPredecessorHandler)
-	server.Handle(protocol.GetFingerTableMethod, localNode.FingerTableHandler)
+	// key transfer routes, which only other nodes may use
+	server.Handle(protocol.ListKeysMethod, file.ListKeysHandler, server.RequireNode)
+	server.Handle(protocol.TransferKeyMethod, file.TransferKeyHandler, server.RequireNode)
+	// replication routes, also only for nodes
+	server.Handle(protocol.StoreReplicaMethod, file.StoreReplicaHandler, server.RequireNode)
+	server.Handle(protocol.DeleteReplicaMethod, file.DeleteReplicaHandler, server.RequireNode)
+	server.Handle(protocol.MerkleTreeMethod, file.MerkleTreeHandler, server.RequireNode)
+	// chord handler routes, dispatched to the right virtual node, the
+	// ones which change the ring only for nodes, and admins repairing it
+	server.Handle(protocol.GetSuccessorMethod,
+		host.Dispatch((*chord.LocalNode).SuccessorHandler))
+	server.Handle(protocol.SetPredecessorMethod,
+		host.Dispatch((*chord.LocalNode).SetPredecessorHandler),
+		server.RequireNodeOrAdmin)
+	server.Handle(protocol.GetPredecessorMethod,
+		host.Dispatch((*chord.LocalNode).GetPredecessorHandler))
+	server.Handle(protocol.GetFingerTableMethod,
+		host.Dispatch((*chord.LocalNode).FingerTableHandler))
+	server.Handle(protocol.GetSuccessorListMethod,
+		host.Dispatch((*chord.LocalNode).SuccessorListHandler))
+	server.Handle(protocol.SuccessorLeaveMethod,
+		host.Dispatch((*chord.LocalNode).SuccessorLeaveHandler),
+		server.RequireNode)
+	server.Handle(protocol.PredecessorLeaveMethod,
+		host.Dispatch((*chord.LocalNode).PredecessorLeaveHandler),
+		server.RequireNode)
+	server.Handle(protocol.ClosestPrecedingNodeMethod,
+		host.Dispatch((*chord.LocalNode).ClosestPrecedingNodeHandler))
 	// registration route
 	server.Handle(protocol.UserRegistrationMethod, server.UserRegistrationHandler)
 	// node registration route
 	server.Handle(protocol.NodeRegistrationMethod, server.NodeRegistrationHandler)
 	server.Handle(protocol.NodeTrustMethod, server.NodeTrustHandler)
+	// health check route
+	server.Handle(protocol.PingMethod, server.PingHandler)
 
 	go func() {
 		for {
@@ -255,7 +414,9 @@ func main() {
 			case <-time.After(30 * time.Second):
 				hash := sha1.Sum([]byte("hello"))
 
-				node, err := localNode.Successor(models.Identifier(hash))
+				ctx, cancel := context.WithTimeout(context.Background(), chord.RequestTimeout)
+				node, err := host.Nodes()[0].Successor(ctx, models.Identifier(hash))
+				cancel()
 				if err != nil {
 					glog.Infof("!!!!!!!!!!!!!!!!! error finding node : %s", err)
 					continue
@@ -265,6 +426,68 @@ func main() {
 		}
 	}()
 
+	// the nodes we can rejoin the ring through, our last known neighbours
+	// and trusted nodes from before we were restarted come before the
+	// seeds, so we do not depend on them being up
+	state, err := chord.LoadRingState(dataPath)
+	if err != nil {
+		glog.Infof("failed to load ring state: %v\n", err)
+	}
+	peers := append(state.Peers(), server.TrustedNodes()...)
+	peers = append(peers, seeds...)
+
+	// register and join the ring once we are serving, our virtual nodes
+	// reach the peer and each other over the network
+	go func() {
+		if len(seeds) > 0 {
+			// need to register with a seed first thing, the first one to
+			// answer will do, and be trusted by the nodes it trusts
+			if err := server.Register(seeds, pingTimeout); err != nil {
+				// failed to register with any seed, we may still know of
+				// peers from before we were restarted, so carry on and
+				// try those
+				glog.Infof("failed to register trust with a seed: %v", err)
+			}
+		}
+		err := host.Rejoin(peers, pingTimeout)
+		if errors.Cause(err) == chord.ErrNoPeers {
+			// none of the peers we know of answer, we shall log the
+			// error, and start a ring of our own which the others can
+			// rejoin through us
+			glog.Infof("failed to join the ring: %v\n", err)
+			if err := host.Join(models.Node{}); err != nil {
+				glog.Infof("failed to start a new ring: %v\n", err)
+			}
+		} else if err != nil {
+			// we reached the ring, but a successor refused us, which
+			// stabilizing fixes up
+			glog.Infof("joined the ring with: %v\n", err)
+		}
+	}()
+
 	// serve requests
 	server.Serve(quit, done)
 }
+
+// addAdmins - let the users with the keys in the comma separated keyFiles
+// repair the ring
+func addAdmins(server *protocol.Server, keyFiles string) error {
+	if keyFiles == "" {
+		return nil
+	}
+	for _, keyFile := range strings.Split(keyFiles, ",") {
+		f, err := os.Open(strings.TrimSpace(keyFile))
+		if err != nil {
+			return errors.Wrap(err, "failed to open admin key file: ")
+		}
+		key, err := crypto.ReadPublicKeyAsPem(f)
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to read admin key: ")
+		}
+		if err := server.AddAdmin(&key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
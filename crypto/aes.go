@@ -4,6 +4,7 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/subtle"
 	"io"
 
 	"github.com/pkg/errors"
@@ -18,23 +19,26 @@ func padPKCS7(in []byte) []byte {
 	return in
 }
 
-// unpadPKCS7 - unpad in using PKCS7 algorithm and return results
+// unpadPKCS7 - unpad in using PKCS7 algorithm and return results, nil is
+// returned if the padding is invalid.  The whole of the last block is
+// checked whatever the padding turns out to be, so how long the check takes
+// does not tell anyone where the padding went wrong.
 func unpadPKCS7(in []byte) []byte {
-	if len(in) == 0 {
+	if len(in) < aes.BlockSize || len(in)%aes.BlockSize != 0 {
 		return nil
 	}
 
 	padding := in[len(in)-1]
-	if int(padding) > len(in) || padding > aes.BlockSize {
-		return nil
-	} else if padding == 0 {
-		return nil
+	good := subtle.ConstantTimeLessOrEq(1, int(padding)) &
+		subtle.ConstantTimeLessOrEq(int(padding), aes.BlockSize)
+	for i := 1; i <= aes.BlockSize; i++ {
+		// bytes within the padding have to equal it
+		inPadding := subtle.ConstantTimeLessOrEq(i, int(padding))
+		matches := subtle.ConstantTimeByteEq(in[len(in)-i], padding)
+		good &= subtle.ConstantTimeSelect(inPadding, matches, 1)
 	}
-
-	for i := len(in) - 1; i > len(in)-int(padding)-1; i-- {
-		if in[i] != padding {
-			return nil
-		}
+	if good != 1 {
+		return nil
 	}
 	return in[:len(in)-int(padding)]
 }
@@ -106,9 +110,63 @@ func Decrypt(key, ciphertext, iv []byte) ([]byte, error) {
 		return nil, errors.New("ciphertext is not a multiple of block size")
 	}
 
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("iv is not the size of a block")
+	}
+
 	mode := cipher.NewCBCDecrypter(block, iv)
 	// CryptBlocks can work in-place if the two arguments are the same.
 	mode.CryptBlocks(ciphertext, ciphertext)
 
-	return unpadPKCS7(ciphertext), nil
+	plaintext := unpadPKCS7(ciphertext)
+	if plaintext == nil {
+		return nil, errors.New("ciphertext has invalid padding")
+	}
+	return plaintext, nil
+}
+
+// EncryptGCM - encrypt plaintext with aes256 in gcm mode, authenticating
+// additionalData along with it, returns ciphertext, nonce and error
+func EncryptGCM(key, plaintext, additionalData []byte) ([]byte, []byte, error) {
+	aead, err := NewGCM(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, errors.Wrap(err, "failed to generate nonce: ")
+	}
+	return aead.Seal(nil, nonce, plaintext, additionalData), nonce, nil
+}
+
+// DecryptGCM - decrypt ciphertext with aes256 in gcm mode, failing if it or
+// additionalData is not what was encrypted, returns plaintext and error
+func DecryptGCM(key, ciphertext, nonce, additionalData []byte) ([]byte, error) {
+	aead, err := NewGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != aead.NonceSize() {
+		return nil, errors.New("nonce is the wrong size")
+	}
+
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate ciphertext: ")
+	}
+	return plaintext, nil
+}
+
+// NewGCM - aes256 in gcm mode with key
+func NewGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create gcm: ")
+	}
+	return aead, nil
 }
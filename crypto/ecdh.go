@@ -0,0 +1,44 @@
+package crypto
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"github.com/pkg/errors"
+)
+
+// GenerateEphemeralKey - generate an x25519 key pair, to be used for a
+// single key exchange and thrown away afterwards
+func GenerateEphemeralKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate ephemeral key: ")
+	}
+	return key, nil
+}
+
+// SharedSecret - the secret shared between key and the holder of the
+// private half of peerKey, an x25519 public key
+func SharedSecret(key *ecdh.PrivateKey, peerKey []byte) ([]byte, error) {
+	pub, err := ecdh.X25519().NewPublicKey(peerKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid ephemeral key: ")
+	}
+	secret, err := key.ECDH(pub)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed key exchange: ")
+	}
+	return secret, nil
+}
+
+// HKDF - derive length bytes of key from secret, with hkdf over sha256.
+// Different info gives unrelated keys from the same secret.
+func HKDF(secret, salt []byte, info string, length int) ([]byte, error) {
+	key, err := hkdf.Key(sha256.New, secret, salt, info, length)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive key: ")
+	}
+	return key, nil
+}
@@ -0,0 +1,9 @@
+//go:build !go1.24
+// +build !go1.24
+
+package crypto
+
+// peerstore needs go 1.24 or newer, HKDF is derived with crypto/hkdf from the
+// standard library, which older releases do not have.  This fails the build
+// with a name saying so, instead of leaving only a missing package to go on.
+var _ = peerstoreRequiresGo1_24
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha1"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/gob"
 	"encoding/pem"
 	"io"
@@ -55,6 +57,64 @@ func WritePublicKeyAsPem(w io.Writer, key *rsa.PublicKey) error {
 	return nil
 }
 
+// WriteKeypairAsPem - write both the private and public key of the keypair
+// in PEM formatting, which is how keypairs are stored to disk.
+func WriteKeypairAsPem(w io.Writer, key *rsa.PrivateKey) error {
+	if err := WritePrivateKeyAsPem(w, key); err != nil {
+		return err
+	}
+	return WritePublicKeyAsPem(w, key.Public().(*rsa.PublicKey))
+}
+
+// KeyID - the identifier bound to a public key, which is the sha1 sum of the
+// gob encoded key.  Both users and nodes are identified this way.
+func KeyID(pub *rsa.PublicKey) ([20]byte, error) {
+	if pub == nil {
+		return [20]byte{}, errors.New("no public key to derive id from")
+	}
+	b, err := GobEncodePublicKey(pub)
+	if err != nil {
+		return [20]byte{}, errors.Wrap(err, "failed to derive id: ")
+	}
+	return sha1.Sum(b), nil
+}
+
+// VerifyKeyID - verify that id is the identifier bound to the public key
+func VerifyKeyID(id [20]byte, pub *rsa.PublicKey) error {
+	return VerifyVirtualKeyID(id, pub, 0)
+}
+
+// VirtualKeyID - the identifier bound to the index'th virtual node of a
+// public key.  The 0th virtual node has the same identifier as the key.
+func VirtualKeyID(pub *rsa.PublicKey, index uint) ([20]byte, error) {
+	if index == 0 {
+		return KeyID(pub)
+	}
+	if pub == nil {
+		return [20]byte{}, errors.New("no public key to derive id from")
+	}
+	b, err := GobEncodePublicKey(pub)
+	if err != nil {
+		return [20]byte{}, errors.Wrap(err, "failed to derive id: ")
+	}
+	suffix := make([]byte, 8)
+	binary.BigEndian.PutUint64(suffix, uint64(index))
+	return sha1.Sum(append(b, suffix...)), nil
+}
+
+// VerifyVirtualKeyID - verify that id is the identifier bound to the index'th
+// virtual node of the public key
+func VerifyVirtualKeyID(id [20]byte, pub *rsa.PublicKey, index uint) error {
+	expected, err := VirtualKeyID(pub, index)
+	if err != nil {
+		return err
+	}
+	if expected != id {
+		return errors.New("id does not match public key")
+	}
+	return nil
+}
+
 // GobEncodePublicKey - encode the public key to gob formatting.
 func GobEncodePublicKey(pub *rsa.PublicKey) ([]byte, error) {
 	var buf = bytes.NewBuffer([]byte{})
@@ -32,3 +32,38 @@ func TestReadAndWriteKeypairAsPem(t *testing.T) {
 		t.Error("original key doesnt match new key")
 	}
 }
+
+func TestKeyID(t *testing.T) {
+	k, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := KeyID(&k.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyKeyID(id, &k.PublicKey); err != nil {
+		t.Errorf("id should match its own key: %v", err)
+	}
+	if err := VerifyKeyID(id, &other.PublicKey); err == nil {
+		t.Error("id should not match another key")
+	}
+
+	vid, err := VirtualKeyID(&k.PublicKey, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vid == id {
+		t.Error("virtual node id should differ from the key id")
+	}
+	if err := VerifyVirtualKeyID(vid, &k.PublicKey, 1); err != nil {
+		t.Errorf("virtual id should match its own key and index: %v", err)
+	}
+	if err := VerifyVirtualKeyID(vid, &k.PublicKey, 2); err == nil {
+		t.Error("virtual id should not match another index")
+	}
+}
@@ -0,0 +1,153 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+// streamChunkSize - how much ciphertext a decrypting reader reads at a time
+const streamChunkSize = 32 * 1024
+
+// GenerateIV - generate a random iv for aes256 in cbc mode
+func GenerateIV() ([]byte, error) {
+	var iv = make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return nil, errors.Wrap(err, "failed to generate iv: ")
+	}
+	return iv, nil
+}
+
+// encryptWriter - encrypts what is written to it with aes256 in cbc mode
+type encryptWriter struct {
+	w    io.Writer
+	mode cipher.BlockMode
+	buf  []byte
+}
+
+// NewEncryptWriter - encrypt everything written to the returned writer with
+// aes256 in cbc mode, writing the ciphertext to w, which ends up the same as
+// EncryptWithIV would give.  Close writes the last, padded, block, it does
+// not close w.
+func NewEncryptWriter(w io.Writer, key, iv []byte) (io.WriteCloser, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("iv is not the size of a block")
+	}
+	return &encryptWriter{
+		w:    w,
+		mode: cipher.NewCBCEncrypter(block, iv),
+	}, nil
+}
+
+// Write - encrypt and write out all the whole blocks we have, keeping the
+// rest for the next write
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	ew.buf = append(ew.buf, p...)
+	n := len(ew.buf) - len(ew.buf)%aes.BlockSize
+	if n == 0 {
+		return len(p), nil
+	}
+	ew.mode.CryptBlocks(ew.buf[:n], ew.buf[:n])
+	if _, err := ew.w.Write(ew.buf[:n]); err != nil {
+		return 0, errors.Wrap(err, "failed to write ciphertext: ")
+	}
+	ew.buf = append(ew.buf[:0], ew.buf[n:]...)
+	return len(p), nil
+}
+
+// Close - pad, encrypt and write out the last block
+func (ew *encryptWriter) Close() error {
+	padded := padPKCS7(ew.buf)
+	ew.mode.CryptBlocks(padded, padded)
+	ew.buf = nil
+	if _, err := ew.w.Write(padded); err != nil {
+		return errors.Wrap(err, "failed to write ciphertext: ")
+	}
+	return nil
+}
+
+// decryptReader - decrypts what is read from it with aes256 in cbc mode
+type decryptReader struct {
+	r       io.Reader
+	mode    cipher.BlockMode
+	chunk   []byte
+	pending []byte
+	out     []byte
+	err     error
+}
+
+// NewDecryptReader - decrypt the ciphertext read from r with aes256 in cbc
+// mode, as Decrypt would, but a chunk at a time
+func NewDecryptReader(r io.Reader, key, iv []byte) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create new cipher: ")
+	}
+	if len(iv) != aes.BlockSize {
+		return nil, errors.New("iv is not the size of a block")
+	}
+	return &decryptReader{
+		r:     r,
+		mode:  cipher.NewCBCDecrypter(block, iv),
+		chunk: make([]byte, streamChunkSize),
+	}, nil
+}
+
+// Read - read the plaintext
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.out) == 0 {
+		if dr.err != nil {
+			return 0, dr.err
+		}
+		dr.fill()
+	}
+	n := copy(p, dr.out)
+	dr.out = dr.out[n:]
+	return n, nil
+}
+
+// fill - read more ciphertext, and decrypt what we can of it.  The last
+// block is held back until the end of the ciphertext, as it is the one
+// which is padded.
+func (dr *decryptReader) fill() {
+	n, err := dr.r.Read(dr.chunk)
+	dr.pending = append(dr.pending, dr.chunk[:n]...)
+	if err == io.EOF {
+		dr.err = io.EOF
+		if len(dr.pending) < aes.BlockSize {
+			dr.err = errors.New("ciphertext is too short")
+			return
+		}
+		if len(dr.pending)%aes.BlockSize != 0 {
+			dr.err = errors.New("ciphertext is not a multiple of block size")
+			return
+		}
+		dr.mode.CryptBlocks(dr.pending, dr.pending)
+		dr.out = unpadPKCS7(dr.pending)
+		dr.pending = nil
+		if dr.out == nil {
+			dr.err = errors.New("ciphertext has invalid padding")
+		}
+		return
+	}
+	if err != nil {
+		dr.err = errors.Wrap(err, "failed to read ciphertext: ")
+		return
+	}
+
+	usable := len(dr.pending) - aes.BlockSize
+	usable -= usable % aes.BlockSize
+	if usable <= 0 {
+		return
+	}
+	dr.out = make([]byte, usable)
+	dr.mode.CryptBlocks(dr.out, dr.pending[:usable])
+	dr.pending = append(dr.pending[:0], dr.pending[usable:]...)
+}
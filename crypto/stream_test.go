@@ -0,0 +1,59 @@
+package crypto
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEncryptWriterDecryptReader(t *testing.T) {
+	key := make([]byte, 32)
+	for _, size := range []int{0, 15, 16, 17, 100000} {
+		plaintext := bytes.Repeat([]byte{'x'}, size)
+		iv, err := GenerateIV()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// what we stream has to be what Encrypt would give, so files
+		// stored either way can be read back either way
+		buf := &bytes.Buffer{}
+		w, err := NewEncryptWriter(buf, key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rest := plaintext; len(rest) > 0; {
+			n := 7
+			if n > len(rest) {
+				n = len(rest)
+			}
+			w.Write(rest[:n])
+			rest = rest[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		expected, _, _ := EncryptWithIV(key, append([]byte{}, plaintext...), iv)
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("size %d: streamed ciphertext differs from EncryptWithIV", size)
+		}
+
+		r, err := NewDecryptReader(bytes.NewReader(expected), key, iv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decrypted, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("size %d: failed to decrypt: %v", size, err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("size %d: decrypted plaintext differs", size)
+		}
+	}
+
+	iv, _ := GenerateIV()
+	r, _ := NewDecryptReader(bytes.NewReader(make([]byte, 20)), key, iv)
+	if _, err := ioutil.ReadAll(r); err == nil {
+		t.Error("expected an error for a partial block")
+	}
+}
@@ -0,0 +1,263 @@
+package file
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// AntiEntropy - periodically compares the keys this server is in charge of
+// with the copies on its replicas, and fixes any divergence.  Replication
+// pushes every post and delete as it happens, but a replica that was down,
+// or a push that failed, leaves the replicas out of step until this catches
+// it.  Merkle trees are compared rather than key lists, so only the blobs
+// that differ are sent.
+type AntiEntropy struct {
+	replicator *Replicator
+	dataPath   string
+	ranges     func() []models.KeyRangeRequest
+	// owned - the ranges we were in charge of as of the last sync, nil
+	// before the first
+	owned []models.KeyRangeRequest
+	// sync - the number of the sync under way, which replicas build their
+	// tree once for
+	sync uint64
+}
+
+// NewAntiEntropy - create a new anti entropy process, ranges is used to find
+// the ranges of the ring this server is in charge of
+func NewAntiEntropy(replicator *Replicator, dataPath string, ranges func() []models.KeyRangeRequest) *AntiEntropy {
+	return &AntiEntropy{
+		replicator: replicator,
+		dataPath:   dataPath,
+		ranges:     ranges,
+		// a restarted server does not pick up the numbering where it left
+		// off, so it starts somewhere else
+		sync: uint64(time.Now().UnixNano()),
+	}
+}
+
+// Sync - compare every range we are in charge of with each of its replicas.
+// Blobs a replica is missing, or holds a different version of, are pushed to
+// it, our copy wins as we are the primary for the range.  Blobs only the
+// replica holds are pulled when they fall in a range we just took over, as
+// they are keys we never got.  Where we were already in charge, they are
+// keys we deleted and the replica missed the delete, so they are deleted
+// from it rather than brought back.  On the first sync we can not tell, and
+// pull, as losing a key is worse than bringing a deleted one back.  Every
+// replica is tried, the first error is returned.
+func (ae *AntiEntropy) Sync() error {
+	var (
+		syncErr error
+		owned   = []models.KeyRangeRequest{}
+	)
+	ae.sync++
+	for _, rng := range ae.ranges() {
+		tree, err := BuildMerkleTree(ae.dataPath, rng)
+		if err != nil {
+			return errors.Wrap(err, "failed to build merkle tree: ")
+		}
+		synced := true
+		for _, node := range ae.replicator.replicas(rng.High) {
+			if err := ae.syncReplica(node, tree); err != nil {
+				glog.Infof("failed anti entropy with %s: %v", node.ToString(), err)
+				synced = false
+				if syncErr == nil {
+					syncErr = errors.Wrap(err, "failed anti entropy: ")
+				}
+			}
+		}
+		// a range only counts as ours once every replica has had the
+		// chance to hand us the keys we never got
+		if synced || ae.ownedBefore(rng) {
+			owned = append(owned, rng)
+		}
+	}
+	ae.owned = owned
+	return syncErr
+}
+
+// syncReplica - bring node in line with our tree
+func (ae *AntiEntropy) syncReplica(node models.Node, tree *MerkleTree) error {
+	differ, missing, err := diffMerkleTrees(tree, &remoteMerkleTree{
+		replicator: ae.replicator,
+		node:       node,
+		rng:        tree.Range,
+		sync:       ae.sync,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to compare merkle trees: ")
+	}
+
+	// pushes and deletes go behind the posts and deletes already queued
+	// for the replica, so they can not undo a newer one
+	for _, key := range differ {
+		if err := ae.replicator.sendInOrder(
+			node, protocol.StoreReplicaMethod, key, ae.dataPath); err != nil {
+			return errors.Wrap(err, "failed to push blob: ")
+		}
+		glog.Infof("anti entropy pushed key=%s to %s",
+			hex.EncodeToString(key[:]), node.Addr)
+	}
+
+	for _, key := range missing {
+		if ae.ownedKeyBefore(key) {
+			if _, err := os.Stat(fmt.Sprintf(
+				"%s/%s", ae.dataPath, hex.EncodeToString(key[:]))); err == nil {
+				// posted since we built the tree
+				continue
+			}
+			if err := ae.replicator.sendInOrder(
+				node, protocol.DeleteReplicaMethod, key, ""); err != nil {
+				return errors.Wrap(err, "failed to delete replica: ")
+			}
+			glog.Infof("anti entropy deleted key=%s from %s",
+				hex.EncodeToString(key[:]), node.Addr)
+			continue
+		}
+		resp, err := ae.replicator.requestStream(node, protocol.TransferKeyMethod, key)
+		if protocol.ErrorCodeOf(err) == protocol.NotFound {
+			// deleted on the replica since it built its tree
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to pull blob: ")
+		}
+		// the blob is streamed straight to storage, which only replaces
+		// the key once all of it has arrived
+		err = Post(ae.dataPath, key, resp.Body())
+		resp.Close()
+		if err != nil {
+			return errors.Wrap(err, "failed to store pulled blob: ")
+		}
+		glog.Infof("anti entropy pulled key=%s from %s",
+			hex.EncodeToString(key[:]), node.Addr)
+	}
+	return nil
+}
+
+// ownedKeyBefore - whether key fell in a range we were in charge of as of
+// the last sync
+func (ae *AntiEntropy) ownedKeyBefore(key models.Identifier) bool {
+	for _, rng := range ae.owned {
+		if rng.Contains(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// ownedBefore - whether we were in charge of the whole of rng as of the last
+// sync
+func (ae *AntiEntropy) ownedBefore(rng models.KeyRangeRequest) bool {
+	for _, owned := range ae.owned {
+		if owned == rng {
+			return true
+		}
+	}
+	return false
+}
+
+// merkleSource - somewhere the nodes of a merkle tree can be read from,
+// either a tree of our own or one on a replica
+type merkleSource interface {
+	Node(level, index uint) (models.MerkleResponse, error)
+}
+
+// remoteMerkleTree - the merkle tree a replica holds over a range
+type remoteMerkleTree struct {
+	replicator *Replicator
+	node       models.Node
+	rng        models.KeyRangeRequest
+	sync       uint64
+}
+
+// Node - ask the replica for a node of its tree
+func (rt *remoteMerkleTree) Node(level, index uint) (models.MerkleResponse, error) {
+	var reqBuffer = new(bytes.Buffer)
+	if err := gob.NewEncoder(reqBuffer).Encode(models.MerkleRequest{
+		Range: rt.rng,
+		Level: level,
+		Index: index,
+		Sync:  rt.sync,
+	}); err != nil {
+		return models.MerkleResponse{}, errors.Wrap(err, "failed to encode request: ")
+	}
+
+	resp, err := rt.replicator.request(
+		rt.node, protocol.MerkleTreeMethod, rt.rng.High, reqBuffer.Bytes(), nil)
+	if err != nil {
+		return models.MerkleResponse{}, err
+	}
+
+	var out = models.MerkleResponse{}
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&out); err != nil {
+		return models.MerkleResponse{}, errors.Wrap(err, "failure decoding merkle tree response from body")
+	}
+	return out, nil
+}
+
+// diffMerkleTrees - compare local with remote from the root down, following
+// only the branches whose hashes differ.  differ are the keys remote is
+// missing or holds a different blob for, missing are the keys only remote
+// holds.
+func diffMerkleTrees(local *MerkleTree, remote merkleSource) (differ, missing []models.Identifier, err error) {
+	type position struct {
+		level, index uint
+	}
+	queue := []position{{0, 0}}
+
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+
+		theirs, err := remote.Node(p.level, p.index)
+		if err != nil {
+			return nil, nil, err
+		}
+		ours, err := local.Node(p.level, p.index)
+		if err != nil {
+			return nil, nil, err
+		}
+		if theirs.Hash == ours.Hash {
+			continue
+		}
+
+		if p.level == MerkleDepth {
+			theirLeaves := map[models.Identifier][20]byte{}
+			for _, leaf := range theirs.Leaves {
+				theirLeaves[leaf.Key] = leaf.Hash
+			}
+			for _, leaf := range ours.Leaves {
+				if hash, ok := theirLeaves[leaf.Key]; !ok || hash != leaf.Hash {
+					differ = append(differ, leaf.Key)
+				}
+				delete(theirLeaves, leaf.Key)
+			}
+			for _, leaf := range theirs.Leaves {
+				if _, ok := theirLeaves[leaf.Key]; ok {
+					missing = append(missing, leaf.Key)
+				}
+			}
+			continue
+		}
+
+		if len(theirs.Children) != MerkleFanout {
+			return nil, nil, errors.New("merkle tree node has the wrong number of children")
+		}
+		for i, child := range ours.Children {
+			if theirs.Children[i] != child {
+				queue = append(queue, position{p.level + 1, p.index*MerkleFanout + uint(i)})
+			}
+		}
+	}
+	return differ, missing, nil
+}
@@ -3,13 +3,18 @@ package file
 import (
 	"bytes"
 	"context"
+	"encoding/gob"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
+	"os"
 	"sync"
+	"syscall"
 
 	"github.com/golang/glog"
 	"github.com/husobee/peerstore/models"
 	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
 )
 
 var fileMu = &sync.Mutex{}
@@ -42,9 +47,7 @@ func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Resp
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return storageErrorResponse(err)
 	}
 	defer buf.Close()
 	for n := 1; n > 0; {
@@ -58,9 +61,7 @@ func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Resp
 				continue
 			}
 			glog.Infof("ERR: %v\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "failed to read public key")
 		}
 	}
 
@@ -71,24 +72,31 @@ func GetPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Resp
 // GetFileHandler - This is the server handler which manages Get File Requests
 func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	caller := protocol.CallerFromContext(ctx)
+	if !caller.Verified {
+		return protocol.NewErrorResponse(protocol.Unauthenticated, "caller is not verified")
+	}
 
 	glog.Infof("GetFileHandler Request: %v, %x", r.Header.ResourceName, r.Header.Key)
 
 	var response = protocol.Response{
 		Status: protocol.Success,
 	}
-	fileMu.Lock()
-	defer fileMu.Unlock()
-	// perform file get based on key
-	buf, err := Get(dataPath, r.Header.Key)
+	// perform file get based on key, posts replace the file rather than
+	// writing to it, so what we opened stays as it is while we stream it
+	buf, err := OpenBlob(dataPath, r.Header.Key)
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return storageErrorResponse(err)
 	}
-	defer buf.Close()
+	// the file is closed once the response has streamed it
+	streaming := false
+	defer func() {
+		if !streaming {
+			buf.Close()
+		}
+	}()
 
 	// We need to read the first byte of the file to know
 	// how many id/secret pairs are in the file
@@ -96,15 +104,11 @@ func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 	n, err := buf.Read(ownerCount)
 	if n != 1 {
 		glog.Infof("ERR: could not read header from file\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 	}
 	if err != nil {
 		glog.Infof("ERR: %s\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 	}
 
 	idSecrets := []idSecret{}
@@ -116,15 +120,11 @@ func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 		glog.Infof("header is: %x", idSlice)
 		if n != 20 {
 			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 
 		secretSlice := make([]byte, sessionKeyLen)
@@ -132,15 +132,11 @@ func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 		glog.Infof("secret is: %x", secretSlice)
 		if n != sessionKeyLen {
 			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 
 		id := models.Identifier{}
@@ -153,42 +149,26 @@ func GetFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 	// check each id in the list
 	found := false
 	for _, pair := range idSecrets {
-		// all we need to do here is compare the from in the request
-		// header to what the file "header" has, as we have already
-		// authenticated the request against that from id
-		if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
+		// all we need to do here is compare the caller to what the
+		// file "header" has, as the server has already authenticated
+		// the caller
+		if pair.ID == caller.ID {
 			found = true
 			response.Header.Secret = pair.Secret
 		}
 	}
 
-	// all we need to do here is compare the from in the request
-	// header to what the file "header" has, as we have already
-	// authenticated the request against that from id
+	// all we need to do here is compare the caller to what the file
+	// "header" has, as the server has already authenticated the caller
 	if !found {
 		glog.Infof("invalid ownership of this resource requested\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Forbidden, "not an owner of this resource")
 	}
 
-	for n := 1; n > 0; {
-		var err error
-		tmp := make([]byte, 256)
-		n, err = buf.Read(tmp)
-		response.Data = append(response.Data, tmp[:n]...)
-		if err != nil {
-			if err == io.EOF {
-				// file is fully read, continue
-				continue
-			}
-			glog.Infof("ERR: %v\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-	}
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! GET FILE response: !!!!!!!!!!! %s", hex.EncodeToString(response.Data))
+	// the rest of the file is the data, stream it rather than reading it
+	// all into memory
+	response.SetBody(buf)
+	streaming = true
 	return response
 }
 
@@ -208,14 +188,15 @@ func PostPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Res
 	}
 
 	if err := Post(
-		dataPath, r.Header.Key, bytes.NewBuffer(r.Data),
+		dataPath, r.Header.Key, r.Body(),
 	); err != nil {
 		glog.Infof("ERR: %s", err.Error())
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return storageErrorResponse(err)
 	}
 	glog.Infof("!!!!!!!!!!!!!!!!!!!!! POST Public Key request: !!!!!!!!!!! %s", string(r.Data))
+	if replicator := replicatorFromContext(ctx); replicator != nil {
+		replicator.Replicate(dataPath, r.Header.Key)
+	}
 
 	response.Status = protocol.Success
 	return response
@@ -224,24 +205,79 @@ func PostPublicKeyHandler(ctx context.Context, r *protocol.Request) protocol.Res
 // PostFileHandler - This is the server handler which manages Post File Requests
 func PostFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
-	// add the request owner id to the file "header"
+	caller := protocol.CallerFromContext(ctx)
+	if !caller.Verified {
+		return protocol.NewErrorResponse(protocol.Unauthenticated, "caller is not verified")
+	}
+
+	var timestamp = models.IncrementClock(r.Header.Clock)
+	response := protocol.Response{
+		Header: protocol.Header{
+			Clock: timestamp,
+		},
+	}
+
+	// turn away callers who may not post before reading the data
+	fileMu.Lock()
+	_, _, failure := postFileHeader(dataPath, caller, r)
+	fileMu.Unlock()
+	if failure != nil {
+		return protocol.NewErrorResponse(failure.Code, failure.Message)
+	}
+
+	// the data is streamed in without the lock, then the request owner id
+	// is added to the file "header", worked out again under the lock, and
+	// the file replaced before anyone else can change who owns it
+	body, err := spool(dataPath, r.Body())
+	if err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storageErrorResponse(err)
+	}
+	defer func() {
+		body.Close()
+		os.Remove(body.Name())
+	}()
 
 	fileMu.Lock()
 	defer fileMu.Unlock()
+	header, secret, failure := postFileHeader(dataPath, caller, r)
+	if failure != nil {
+		return protocol.NewErrorResponse(failure.Code, failure.Message)
+	}
+	response.Header.Secret = secret
 
+	if err := Post(
+		dataPath, r.Header.Key, io.MultiReader(bytes.NewReader(header), body),
+	); err != nil {
+		glog.Infof("ERR: %s", err.Error())
+		return storageErrorResponse(err)
+	}
+	if replicator := replicatorFromContext(ctx); replicator != nil {
+		replicator.Replicate(dataPath, r.Header.Key)
+	}
+
+	glog.Infof("!!!!!!!!!!!!!!!!!!!!! POST FILE request: !!!!!!!!!!! %x", r.Header.Key)
+
+	response.Status = protocol.Success
+	return response
+}
+
+// corruptHeader - the failure of a request for a file whose owner/secret
+// header can not be read
+var corruptHeader = &protocol.ResponseError{
+	Code:    protocol.Internal,
+	Message: "file header is corrupt",
+}
+
+// postFileHeader - the owner/secret header a post should store the file
+// with, along with the secret of the poster if the file already exists.
+// The caller of postFileHeader must hold fileMu.
+func postFileHeader(dataPath string, caller protocol.Caller, r *protocol.Request) ([]byte, []byte, *protocol.ResponseError) {
 	// TODO: we need to check if this is an existing file or not, if existing,
 	// we need to pull the original ownership, validate user has permissions
 	// then update the data, then also include the new "shareWith" header values
 	// perform file get based on key
 	buf, err := Get(dataPath, r.Header.Key)
-
-	var timestamp = models.IncrementClock(r.Header.Clock)
-	response := protocol.Response{
-		Header: protocol.Header{
-			Clock: timestamp,
-		},
-	}
-
 	if err != nil {
 		glog.Infof("Error from GET in the POST call: %v", err)
 		// this can mean it doesn't exist, so we should make it
@@ -249,7 +285,7 @@ func PostFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 		header := []byte{}
 		header = append(header, byte(1+len(r.Header.SharedWith)))
 		// user's id and secret
-		header = append(header, r.Header.From[:]...)
+		header = append(header, caller.ID[:]...)
 		header = append(header, r.Header.Secret...)
 
 		glog.Infof("length of header: %d", len(header))
@@ -262,137 +298,106 @@ func PostFileHandler(ctx context.Context, r *protocol.Request) protocol.Response
 		}
 
 		glog.Infof("new file header: %s", hex.EncodeToString(header))
-		glog.Infof("new file data: %s", hex.EncodeToString(r.Data))
-
-		if err := Post(
-			dataPath, r.Header.Key, bytes.NewBuffer(append(header, r.Data...)),
-		); err != nil {
-			glog.Infof("ERR: %s", err.Error())
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
+		return header, nil, nil
+	}
+	defer buf.Close()
+	// We need to read the first byte of the file to know
+	// how many id/secret pairs are in the file
+	ownerCount := make([]byte, 1)
+	n, err := buf.Read(ownerCount)
+	if n != 1 {
+		glog.Infof("ERR: could not read header from file\n")
+		return nil, nil, corruptHeader
+	}
+	glog.Infof("number of shared owners: %d", ownerCount)
+	if err != nil {
+		glog.Infof("ERR: %s\n", err)
+		return nil, nil, corruptHeader
+	}
+
+	idSecrets := []idSecret{}
 
-	} else {
-		defer buf.Close()
-		// We need to read the first byte of the file to know
-		// how many id/secret pairs are in the file
-		ownerCount := make([]byte, 1)
-		n, err := buf.Read(ownerCount)
-		if n != 1 {
+	for i := byte(0); i < ownerCount[0]; i++ {
+		glog.Infof("reading the owner list from header i=%d", i)
+		// read the owner id out of the "header" of the file
+		idSlice := make([]byte, 20)
+		n, err := buf.Read(idSlice)
+		glog.Infof("header is: %x", idSlice)
+		if n != 20 {
 			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return nil, nil, corruptHeader
 		}
-		glog.Infof("number of shared owners: %d", ownerCount)
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return nil, nil, corruptHeader
 		}
+		glog.Infof("id is: %v", idSlice)
 
-		idSecrets := []idSecret{}
-
-		for i := byte(0); i < ownerCount[0]; i++ {
-			glog.Infof("reading the owner list from header i=%d", i)
-			// read the owner id out of the "header" of the file
-			idSlice := make([]byte, 20)
-			n, err := buf.Read(idSlice)
-			glog.Infof("header is: %x", idSlice)
-			if n != 20 {
-				glog.Infof("ERR: could not read header from file\n")
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			if err != nil {
-				glog.Infof("ERR: %s\n", err)
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			glog.Infof("id is: %v", idSlice)
-
-			secretSlice := make([]byte, sessionKeyLen)
-			n, err = buf.Read(secretSlice)
-			glog.Infof("secret is: %x", secretSlice)
-			if n != sessionKeyLen {
-				glog.Infof("ERR: could not read header from file\n")
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			if err != nil {
-				glog.Infof("ERR: %s\n", err)
-				return protocol.Response{
-					Status: protocol.Error,
-				}
-			}
-			glog.Infof("secret is: %v", secretSlice)
-
-			id := models.Identifier{}
-			copy(id[:], idSlice)
-
-			idSecrets = append(idSecrets, idSecret{
-				ID: id, Secret: secretSlice})
+		secretSlice := make([]byte, sessionKeyLen)
+		n, err = buf.Read(secretSlice)
+		glog.Infof("secret is: %x", secretSlice)
+		if n != sessionKeyLen {
+			glog.Infof("ERR: could not read header from file\n")
+			return nil, nil, corruptHeader
 		}
-
-		// check each id in the list
-		found := false
-		for _, pair := range idSecrets {
-			// all we need to do here is compare the from in the request
-			// header to what the file "header" has, as we have already
-			// authenticated the request against that from id
-			if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
-				found = true
-				response.Header.Secret = pair.Secret
-			}
+		if err != nil {
+			glog.Infof("ERR: %s\n", err)
+			return nil, nil, corruptHeader
 		}
+		glog.Infof("secret is: %v", secretSlice)
 
-		if !found {
-			glog.Infof("Unauthorized Post Request: %v", r)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
-		}
-		// package up the number of shared owners, and keys
+		id := models.Identifier{}
+		copy(id[:], idSlice)
 
-		header := []byte{}
+		idSecrets = append(idSecrets, idSecret{
+			ID: id, Secret: secretSlice})
+	}
 
-		header = append(header, byte(len(idSecrets)+len(r.Header.SharedWith)))
-		for _, pair := range idSecrets {
-			header = append(header, pair.ID[:]...)
-			header = append(header, pair.Secret...)
+	// check each id in the list
+	found := false
+	var secret []byte
+	for _, pair := range idSecrets {
+		// all we need to do here is compare the caller to what the
+		// file "header" has, as the server has already authenticated
+		// the caller
+		if pair.ID == caller.ID {
+			found = true
+			secret = pair.Secret
 		}
+	}
 
-		for _, shareWith := range r.Header.SharedWith {
-			header = append(header, shareWith.ID[:]...)
-			header = append(header, shareWith.Secret...)
-		}
-		// now we have all our old state, lets post the data changes
-		glog.Infof("header: %s", hex.EncodeToString(header))
-		glog.Infof("data: %s", hex.EncodeToString(r.Data))
-		if err := Post(
-			dataPath, r.Header.Key, bytes.NewBuffer(append(header, r.Data...)),
-		); err != nil {
-			glog.Infof("ERR: %s", err.Error())
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+	if !found {
+		glog.Infof("Unauthorized Post Request: %v", r)
+		return nil, nil, &protocol.ResponseError{
+			Code:    protocol.Forbidden,
+			Message: "not an owner of this resource",
 		}
 	}
+	// package up the number of shared owners, and keys
 
-	glog.Infof("!!!!!!!!!!!!!!!!!!!!! POST FILE request: !!!!!!!!!!! %s", hex.EncodeToString(r.Data))
+	header := []byte{}
 
-	response.Status = protocol.Success
-	return response
+	header = append(header, byte(len(idSecrets)+len(r.Header.SharedWith)))
+	for _, pair := range idSecrets {
+		header = append(header, pair.ID[:]...)
+		header = append(header, pair.Secret...)
+	}
+
+	for _, shareWith := range r.Header.SharedWith {
+		header = append(header, shareWith.ID[:]...)
+		header = append(header, shareWith.Secret...)
+	}
+	glog.Infof("header: %s", hex.EncodeToString(header))
+	return header, secret, nil
 }
 
 // DeleteFileHandler - This is the server handler which manages Delete File Requests
 func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Response {
 	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+	caller := protocol.CallerFromContext(ctx)
+	if !caller.Verified {
+		return protocol.NewErrorResponse(protocol.Unauthenticated, "caller is not verified")
+	}
 	fileMu.Lock()
 	defer fileMu.Unlock()
 
@@ -401,25 +406,19 @@ func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Respon
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
 		// write the get file error out.
-		buf.Close()
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return storageErrorResponse(err)
 	}
+	defer buf.Close()
 
 	ownerCount := make([]byte, 1)
 	n, err := buf.Read(ownerCount)
 	if n != 1 {
 		glog.Infof("ERR: could not read header from file\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 	}
 	if err != nil {
 		glog.Infof("ERR: %s\n", err)
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 	}
 
 	idSecrets := []idSecret{}
@@ -431,15 +430,11 @@ func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Respon
 		glog.Infof("header is: %x", idSlice)
 		if n != 20 {
 			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 
 		secretSlice := make([]byte, sessionKeyLen)
@@ -447,15 +442,11 @@ func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Respon
 		glog.Infof("secret is: %x", secretSlice)
 		if n != sessionKeyLen {
 			glog.Infof("ERR: could not read header from file\n")
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 		if err != nil {
 			glog.Infof("ERR: %s\n", err)
-			return protocol.Response{
-				Status: protocol.Error,
-			}
+			return protocol.NewErrorResponse(protocol.Internal, "file header is corrupt")
 		}
 
 		id := models.Identifier{}
@@ -476,31 +467,213 @@ func DeleteFileHandler(ctx context.Context, r *protocol.Request) protocol.Respon
 	// check each id in the list
 	found := false
 	for _, pair := range idSecrets {
-		// all we need to do here is compare the from in the request
-		// header to what the file "header" has, as we have already
-		// authenticated the request against that from id
-		if bytes.Compare(pair.ID[:], r.Header.From[:]) == 0 {
+		// all we need to do here is compare the caller to what the
+		// file "header" has, as the server has already authenticated
+		// the caller
+		if pair.ID == caller.ID {
 			found = true
 			response.Header.Secret = pair.Secret
 		}
 	}
 
-	// all we need to do here is compare the from in the request
-	// header to what the file "header" has, as we have already
-	// authenticated the request against that from id
+	// all we need to do here is compare the caller to what the file
+	// "header" has, as the server has already authenticated the caller
 	if !found {
 		glog.Infof("invalid ownership of this resource requested\n")
-		return protocol.Response{
-			Status: protocol.Error,
-		}
+		return protocol.NewErrorResponse(protocol.Forbidden, "not an owner of this resource")
 	}
 
 	if err := Delete(dataPath, r.Header.Key); err != nil {
 		glog.Infof("failed to delete")
-		return protocol.Response{
-			Status: protocol.Error,
+		return storageErrorResponse(err)
+	}
+	if replicator := replicatorFromContext(ctx); replicator != nil {
+		replicator.Delete(r.Header.Key)
+	}
+
+	return response
+}
+
+// StoreReplicaHandler - This is the server handler which stores a replica
+// pushed to us by the primary node for the key
+func StoreReplicaHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	if err := Post(dataPath, r.Header.Key, r.Body()); err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return storageErrorResponse(err)
+	}
+	glog.Infof("stored replica of key: %x", r.Header.Key)
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
+
+// DeleteReplicaHandler - This is the server handler which removes a replica
+// when the primary node for the key deleted it
+func DeleteReplicaHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	fileMu.Lock()
+	defer fileMu.Unlock()
+	if err := Delete(dataPath, r.Header.Key); err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return storageErrorResponse(err)
+	}
+	glog.Infof("deleted replica of key: %x", r.Header.Key)
+
+	return protocol.Response{
+		Status: protocol.Success,
+	}
+}
+
+// storageErrorResponse - the response for a request which failed on err
+// from storage
+func storageErrorResponse(err error) protocol.Response {
+	cause := errors.Cause(err)
+	if pathErr, ok := cause.(*os.PathError); ok {
+		cause = pathErr.Err
+	}
+	switch {
+	case os.IsNotExist(cause):
+		return protocol.NewErrorResponse(protocol.NotFound, "resource does not exist")
+	case cause == syscall.ENOSPC || cause == syscall.EFBIG:
+		return protocol.NewErrorResponse(protocol.TooLarge, "not enough space to store the resource")
+	}
+	return protocol.NewErrorResponse(protocol.Internal, "failed to access storage")
+}
+
+// replicatorFromContext - the replicator for this node, nil when the
+// server is not replicating
+func replicatorFromContext(ctx context.Context) *Replicator {
+	replicator, _ := ctx.Value(models.ReplicatorContextKey).(*Replicator)
+	return replicator
+}
+
+// ListKeysHandler - This is the server handler which lists the keys this
+// node holds within the requested range of the ring
+func ListKeysHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	var in = models.KeyRangeRequest{}
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&in); err != nil {
+		glog.Infof("decode key range request error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid key range request")
+	}
+
+	fileMu.Lock()
+	keys, err := List(dataPath)
+	fileMu.Unlock()
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to list keys")
+	}
+
+	out := []models.Identifier{}
+	for _, key := range keys {
+		if in.Contains(key) {
+			out = append(out, models.Identifier(key))
 		}
 	}
 
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(out); err != nil {
+		glog.Infof("encode list keys response error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode keys")
+	}
+	glog.Infof("listing %d keys in range low=%x, high=%x", len(out), in.Low, in.High)
+
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   buf.Bytes(),
+	}
+}
+
+// TransferKeyHandler - This is the server handler which hands a stored blob,
+// owner/secret header included, to the node that is taking over the key
+func TransferKeyHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	blob, err := OpenBlob(dataPath, r.Header.Key)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return storageErrorResponse(err)
+	}
+	glog.Infof("transferring key: %x", r.Header.Key)
+
+	response := protocol.Response{
+		Status: protocol.Success,
+	}
+	response.SetBody(blob)
 	return response
 }
+
+// MerkleTreeHandler - This is the server handler which hands out a node of
+// the merkle tree over the keys this node holds in a range of the ring, so
+// the primary for the range can compare it with its own
+func MerkleTreeHandler(ctx context.Context, r *protocol.Request) protocol.Response {
+	var dataPath = ctx.Value(models.DataPathContextKey).(string)
+
+	var in = models.MerkleRequest{}
+	if err := gob.NewDecoder(bytes.NewBuffer(r.Data)).Decode(&in); err != nil {
+		glog.Infof("decode merkle request error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "invalid merkle request")
+	}
+
+	// the tree is built on the first request of the sync, and used for the
+	// rest of them
+	tree, err := MerkleTreeForSync(dataPath, protocol.CallerFromContext(ctx).ID, in)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to build merkle tree")
+	}
+	node, err := tree.Node(in.Level, in.Index)
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return protocol.NewErrorResponse(protocol.BadRequest, "no such merkle tree node")
+	}
+
+	var buf = new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(node); err != nil {
+		glog.Infof("encode merkle tree response error: %v\n", err)
+		return protocol.NewErrorResponse(protocol.Internal, "failed to encode merkle tree node")
+	}
+
+	return protocol.Response{
+		Status: protocol.Success,
+		Data:   buf.Bytes(),
+	}
+}
+
+// GetBlob - read a raw blob, owner/secret header included, from storage
+func GetBlob(dataPath string, key [20]byte) ([]byte, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	buf, err := Get(dataPath, key)
+	if err != nil {
+		return nil, err
+	}
+	defer buf.Close()
+	return ioutil.ReadAll(buf)
+}
+
+// OpenBlob - open a raw blob, owner/secret header included, to be read from
+// storage, the caller has to close it
+func OpenBlob(dataPath string, key [20]byte) (io.ReadCloser, error) {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	return Get(dataPath, key)
+}
+
+// PutBlob - store a raw blob, owner/secret header included, as is.  This is
+// used when moving keys between nodes, where ownership was already checked
+// by the node the blob came from.
+func PutBlob(dataPath string, key [20]byte, blob []byte) error {
+	fileMu.Lock()
+	defer fileMu.Unlock()
+
+	return Post(dataPath, key, bytes.NewBuffer(blob))
+}
@@ -0,0 +1,281 @@
+package file
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+const (
+	// MerkleFanout - the number of children of each node of a merkle tree,
+	// one for each hex digit of a key
+	MerkleFanout = 16
+	// MerkleDepth - the number of levels below the root of a merkle tree,
+	// keys are bucketed at the bottom by their first MerkleDepth hex digits
+	MerkleDepth = 2
+)
+
+// MerkleTree - a hash tree over the keys held within a range of the ring.
+// Every level splits the keys by one more hex digit, so two nodes holding
+// the same range can find which keys differ by comparing hashes from the
+// root down, only following the branches where the hashes differ.
+type MerkleTree struct {
+	Range models.KeyRangeRequest
+	// levels - the hashes of each level, from the root down to the buckets
+	levels [][][20]byte
+	// buckets - the leaves under each node of the bottom level, by key
+	buckets [][]models.MerkleLeaf
+}
+
+// NewMerkleTree - build a merkle tree over the given leaves
+func NewMerkleTree(rng models.KeyRangeRequest, leaves []models.MerkleLeaf) *MerkleTree {
+	t := &MerkleTree{
+		Range:   rng,
+		levels:  make([][][20]byte, MerkleDepth+1),
+		buckets: make([][]models.MerkleLeaf, merkleWidth(MerkleDepth)),
+	}
+
+	sorted := make([]models.MerkleLeaf, len(leaves))
+	copy(sorted, leaves)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i].Key[:], sorted[j].Key[:]) < 0
+	})
+	for _, leaf := range sorted {
+		i := merkleBucket(leaf.Key)
+		t.buckets[i] = append(t.buckets[i], leaf)
+	}
+
+	t.levels[MerkleDepth] = make([][20]byte, len(t.buckets))
+	for i, bucket := range t.buckets {
+		t.levels[MerkleDepth][i] = hashLeaves(bucket)
+	}
+	for level := MerkleDepth - 1; level >= 0; level-- {
+		t.levels[level] = make([][20]byte, merkleWidth(level))
+		for i := range t.levels[level] {
+			t.levels[level][i] = hashChildren(
+				t.levels[level+1][i*MerkleFanout : (i+1)*MerkleFanout])
+		}
+	}
+	return t
+}
+
+// BuildMerkleTree - build a merkle tree over the keys stored in dataPath
+// which fall within rng
+func BuildMerkleTree(dataPath string, rng models.KeyRangeRequest) (*MerkleTree, error) {
+	fileMu.Lock()
+	keys, err := List(dataPath)
+	fileMu.Unlock()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list keys: ")
+	}
+
+	leaves := []models.MerkleLeaf{}
+	for _, key := range keys {
+		if !rng.Contains(key) {
+			continue
+		}
+		hash, err := hashBlob(dataPath, key)
+		if os.IsNotExist(errors.Cause(err)) {
+			// deleted since we listed the keys
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to hash blob: ")
+		}
+		leaves = append(leaves, models.MerkleLeaf{Key: key, Hash: hash})
+	}
+	return NewMerkleTree(rng, leaves), nil
+}
+
+// syncTreeKey - who a tree was built for, over which range of which data
+// path
+type syncTreeKey struct {
+	from     models.Identifier
+	dataPath string
+	rng      models.KeyRangeRequest
+}
+
+// syncTree - a tree built for a sync of another node
+type syncTree struct {
+	sync uint64
+	tree *MerkleTree
+}
+
+var (
+	// syncTrees - the tree last built for each node comparing trees with
+	// us, so it is built once for all of the requests of a sync, rather
+	// than on every one of them
+	syncTrees   = map[syncTreeKey]syncTree{}
+	syncTreesMu = &sync.Mutex{}
+)
+
+// MerkleTreeForSync - the tree over the keys stored in dataPath within the
+// range of in, built once for the requests of the sync of in from the node
+// with the given id.  A request without a sync always has the tree built.
+func MerkleTreeForSync(dataPath string, from models.Identifier, in models.MerkleRequest) (*MerkleTree, error) {
+	if in.Sync == 0 {
+		return BuildMerkleTree(dataPath, in.Range)
+	}
+	key := syncTreeKey{from: from, dataPath: dataPath, rng: in.Range}
+	syncTreesMu.Lock()
+	cached, ok := syncTrees[key]
+	syncTreesMu.Unlock()
+	if ok && cached.sync == in.Sync {
+		return cached.tree, nil
+	}
+
+	tree, err := BuildMerkleTree(dataPath, in.Range)
+	if err != nil {
+		return nil, err
+	}
+	syncTreesMu.Lock()
+	defer syncTreesMu.Unlock()
+	// the trees of the node's earlier syncs will not be asked for again
+	for k, cached := range syncTrees {
+		if k.from == from && k.dataPath == dataPath && cached.sync != in.Sync {
+			delete(syncTrees, k)
+		}
+	}
+	syncTrees[key] = syncTree{sync: in.Sync, tree: tree}
+	return tree, nil
+}
+
+// Root - the hash of the root of the tree, which covers every key in it
+func (t *MerkleTree) Root() [20]byte {
+	return t.levels[0][0]
+}
+
+// Node - the node of the tree at index within level, with the hashes of its
+// children, or its leaves if it is at the bottom of the tree
+func (t *MerkleTree) Node(level, index uint) (models.MerkleResponse, error) {
+	if level > MerkleDepth || index >= merkleWidth(int(level)) {
+		return models.MerkleResponse{}, errors.New("no such merkle tree node")
+	}
+	resp := models.MerkleResponse{
+		Hash: t.levels[level][index],
+	}
+	if level == MerkleDepth {
+		resp.Leaves = t.buckets[index]
+		return resp, nil
+	}
+	resp.Children = t.levels[level+1][index*MerkleFanout : (index+1)*MerkleFanout]
+	return resp, nil
+}
+
+// merkleWidth - the number of nodes in a level of the tree
+func merkleWidth(level int) uint {
+	width := uint(1)
+	for i := 0; i < level; i++ {
+		width *= MerkleFanout
+	}
+	return width
+}
+
+// merkleBucket - the bucket at the bottom of the tree a key falls in, the
+// first MerkleDepth hex digits of the key
+func merkleBucket(key models.Identifier) uint {
+	bucket := uint(0)
+	for i := 0; i < MerkleDepth; i++ {
+		digit := key[i/2] >> 4
+		if i%2 == 1 {
+			digit = key[i/2] & 0x0f
+		}
+		bucket = bucket*MerkleFanout + uint(digit)
+	}
+	return bucket
+}
+
+// hashLeaves - the hash of a bucket of leaves, an empty bucket is all zeros
+func hashLeaves(leaves []models.MerkleLeaf) [20]byte {
+	if len(leaves) == 0 {
+		return [20]byte{}
+	}
+	h := sha1.New()
+	for _, leaf := range leaves {
+		h.Write(leaf.Key[:])
+		h.Write(leaf.Hash[:])
+	}
+	var out [20]byte
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
+// hashChildren - the hash of a node from its children, a node with nothing
+// under it is all zeros, so empty trees are equal
+func hashChildren(children [][20]byte) [20]byte {
+	h := sha1.New()
+	empty := true
+	for _, child := range children {
+		if child != [20]byte{} {
+			empty = false
+		}
+		h.Write(child[:])
+	}
+	var out [20]byte
+	if !empty {
+		copy(out[:], h.Sum(nil))
+	}
+	return out
+}
+
+// cachedHash - the hash of a blob, along with what the blob's file looked
+// like when it was hashed
+type cachedHash struct {
+	modTime time.Time
+	size    int64
+	hash    [20]byte
+}
+
+var (
+	// blobHashes - the hashes of the blobs we have read, so a blob is only
+	// read again when its file changes, not every time a tree is built
+	blobHashes   = map[string]cachedHash{}
+	blobHashesMu = &sync.Mutex{}
+)
+
+// hashBlob - the hash of the blob stored under key, owner/secret header
+// included, as that is what gets copied between replicas
+func hashBlob(dataPath string, key [20]byte) ([20]byte, error) {
+	path := fmt.Sprintf("%s/%s", dataPath, hex.EncodeToString(key[:]))
+	info, err := os.Stat(path)
+	if err != nil {
+		return [20]byte{}, errors.Wrap(err, "failed to stat blob: ")
+	}
+
+	blobHashesMu.Lock()
+	cached, ok := blobHashes[path]
+	blobHashesMu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hash, nil
+	}
+
+	blob, err := OpenBlob(dataPath, key)
+	if err != nil {
+		return [20]byte{}, errors.Wrap(err, "failed to open blob: ")
+	}
+	defer blob.Close()
+	h := sha1.New()
+	if _, err := io.Copy(h, blob); err != nil {
+		return [20]byte{}, errors.Wrap(err, "failed to read blob: ")
+	}
+	var hash [20]byte
+	copy(hash[:], h.Sum(nil))
+
+	blobHashesMu.Lock()
+	blobHashes[path] = cachedHash{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		hash:    hash,
+	}
+	blobHashesMu.Unlock()
+	return hash, nil
+}
@@ -0,0 +1,113 @@
+package file
+
+import (
+	"crypto/sha1"
+	"sort"
+	"testing"
+
+	"github.com/husobee/peerstore/models"
+)
+
+func leaf(name, content string) models.MerkleLeaf {
+	return models.MerkleLeaf{
+		Key:  models.Identifier(sha1.Sum([]byte(name))),
+		Hash: sha1.Sum([]byte(content)),
+	}
+}
+
+func keys(leaves ...models.MerkleLeaf) []models.Identifier {
+	out := []models.Identifier{}
+	for _, l := range leaves {
+		out = append(out, l.Key)
+	}
+	sortKeys(out)
+	return out
+}
+
+func sortKeys(ids []models.Identifier) {
+	sort.Slice(ids, func(i, j int) bool {
+		return models.KeyToID(ids[i]).Cmp(models.KeyToID(ids[j])) < 0
+	})
+}
+
+func equalKeys(a, b []models.Identifier) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMerkleTreeDiff(t *testing.T) {
+	var (
+		everything = models.KeyRangeRequest{}
+		a          = leaf("a", "a")
+		b1         = leaf("b", "b1")
+		b2         = leaf("b", "b2")
+		c          = leaf("c", "c")
+		d          = leaf("d", "d")
+	)
+
+	empty := NewMerkleTree(everything, nil)
+	if empty.Root() != [20]byte{} {
+		t.Errorf("empty tree root is %x, expected zeros", empty.Root())
+	}
+
+	local := NewMerkleTree(everything, []models.MerkleLeaf{a, b1, c})
+	same := NewMerkleTree(everything, []models.MerkleLeaf{c, b1, a})
+	if local.Root() != same.Root() {
+		t.Error("trees over the same leaves have different roots")
+	}
+	differ, missing, err := diffMerkleTrees(local, same)
+	if err != nil || len(differ) != 0 || len(missing) != 0 {
+		t.Errorf("expected no difference, differ=%d missing=%d err=%v",
+			len(differ), len(missing), err)
+	}
+
+	remote := NewMerkleTree(everything, []models.MerkleLeaf{b2, c, d})
+	differ, missing, err = diffMerkleTrees(local, remote)
+	if err != nil {
+		t.Fatalf("failed to diff: %v", err)
+	}
+	sortKeys(differ)
+	sortKeys(missing)
+	if !equalKeys(differ, keys(a, b1)) {
+		t.Errorf("differ is %x, expected a and b", differ)
+	}
+	if !equalKeys(missing, keys(d)) {
+		t.Errorf("missing is %x, expected d", missing)
+	}
+}
+
+func TestMerkleTreeForSync(t *testing.T) {
+	dataPath := t.TempDir()
+	if err := PutBlob(dataPath, [20]byte{1}, []byte("one")); err != nil {
+		t.Fatal(err)
+	}
+	from := models.Identifier{9}
+	in := models.MerkleRequest{Sync: 1}
+	first, err := MerkleTreeForSync(dataPath, from, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rest of the sync is answered from the same tree
+	if err := PutBlob(dataPath, [20]byte{2}, []byte("two")); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := MerkleTreeForSync(dataPath, from, in); again != first {
+		t.Error("expected the tree to be built once for the sync")
+	}
+	in.Sync = 2
+	next, err := MerkleTreeForSync(dataPath, from, in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next == first || next.Root() == first.Root() {
+		t.Error("expected the tree to be built again for the next sync")
+	}
+}
@@ -0,0 +1,290 @@
+package file
+
+import (
+	"crypto/rsa"
+	"encoding/hex"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+	"github.com/pkg/errors"
+)
+
+// Replicator - pushes every post and delete a node performs to the next
+// factor-1 nodes on the ring.  Replicas are stored exactly as they are on
+// the primary, owner/secret header included, so when the primary goes down
+// and a replica takes over its range, GetFileHandler on the replica serves
+// the file as is.
+//
+// Every server holding replicas has a queue of its own, which the requests
+// to it are sent from one at a time, in the order they were made.  A delete
+// can not overtake the post of the same key, which would leave the replica
+// holding a file the primary no longer has.
+type Replicator struct {
+	network    protocol.Network
+	factor     uint
+	successors func(key [20]byte) []models.Node
+	addr       string
+	key        *rsa.PrivateKey
+	// queues - the queue of requests to each replica server, by server id
+	queues   map[[20]byte]*replicaQueue
+	queuesMu *sync.Mutex
+}
+
+var (
+	// ReplicaAttempts - how many times a request to a replica is sent
+	// before it is given up on, and left to anti-entropy to fix
+	ReplicaAttempts = 4
+	// ReplicaRetryBackoff - how long to wait before sending a failed request
+	// to a replica again, doubled on every attempt
+	ReplicaRetryBackoff = 250 * time.Millisecond
+)
+
+// replicaOp - a request waiting to be sent to a replica, the outcome is
+// sent on done if it is not nil
+type replicaOp struct {
+	node     models.Node
+	method   protocol.RequestMethod
+	key      [20]byte
+	dataPath string
+	done     chan error
+}
+
+// replicaQueue - the requests waiting to be sent to one replica server, and
+// whether they are being sent
+type replicaQueue struct {
+	ops      []replicaOp
+	draining bool
+	mu       *sync.Mutex
+}
+
+// NewReplicator - create a new replicator sending over network, successors
+// is used to find the nodes that follow the node in charge of a key on the
+// ring, and addr is the address of this server
+func NewReplicator(network protocol.Network, factor uint, successors func(key [20]byte) []models.Node, addr string, key *rsa.PrivateKey) *Replicator {
+	return &Replicator{
+		network:    network,
+		factor:     factor,
+		successors: successors,
+		addr:       addr,
+		key:        key,
+		queues:     make(map[[20]byte]*replicaQueue),
+		queuesMu:   new(sync.Mutex),
+	}
+}
+
+// replicas - the nodes that should hold a replica of key.  Virtual nodes
+// hosted by this server share our data path, so they are skipped, as a
+// replica on them would not survive this server going down.  Likewise only
+// one virtual node of each other server is used, as they all store to the
+// same place.
+func (r *Replicator) replicas(key [20]byte) []models.Node {
+	var (
+		replicas = []models.Node{}
+		servers  = map[[20]byte]bool{}
+	)
+	if self, err := crypto.KeyID(&r.key.PublicKey); err == nil {
+		servers[self] = true
+	}
+	for _, node := range r.successors(key) {
+		if uint(len(replicas))+1 >= r.factor {
+			break
+		}
+		server, err := crypto.KeyID(node.PublicKey)
+		if err != nil || servers[server] || node.Addr == r.addr {
+			continue
+		}
+		servers[server] = true
+		replicas = append(replicas, node)
+	}
+	return replicas
+}
+
+// Replicate - push the blob stored under key to all replicas, each replica
+// has the blob streamed to it straight from storage when its turn comes
+func (r *Replicator) Replicate(dataPath string, key [20]byte) {
+	for _, node := range r.replicas(key) {
+		if err := r.enqueue(replicaOp{
+			node: node, method: protocol.StoreReplicaMethod, key: key, dataPath: dataPath,
+		}); err != nil {
+			glog.Infof("failed to replicate key=%s to %s: %v",
+				hex.EncodeToString(key[:]), node.ToString(), err)
+		}
+	}
+}
+
+// Delete - remove the blob stored under key from all replicas
+func (r *Replicator) Delete(key [20]byte) {
+	for _, node := range r.replicas(key) {
+		if err := r.enqueue(replicaOp{
+			node: node, method: protocol.DeleteReplicaMethod, key: key,
+		}); err != nil {
+			glog.Infof("failed to delete replica key=%s on %s: %v",
+				hex.EncodeToString(key[:]), node.ToString(), err)
+		}
+	}
+}
+
+// sendInOrder - send the request to node behind the ones already queued for
+// it, and wait on the outcome
+func (r *Replicator) sendInOrder(node models.Node, method protocol.RequestMethod, key [20]byte, dataPath string) error {
+	done := make(chan error, 1)
+	if err := r.enqueue(replicaOp{
+		node: node, method: method, key: key, dataPath: dataPath, done: done,
+	}); err != nil {
+		return err
+	}
+	return <-done
+}
+
+// enqueue - add op to the queue of the server it is for, and start sending
+// from the queue if nothing is
+func (r *Replicator) enqueue(op replicaOp) error {
+	server, err := crypto.KeyID(op.node.PublicKey)
+	if err != nil {
+		return errors.Wrap(err, "failed to derive replica server id: ")
+	}
+	r.queuesMu.Lock()
+	q, ok := r.queues[server]
+	if !ok {
+		q = &replicaQueue{mu: new(sync.Mutex)}
+		r.queues[server] = q
+	}
+	r.queuesMu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ops = append(q.ops, op)
+	if !q.draining {
+		q.draining = true
+		go r.drain(q)
+	}
+	return nil
+}
+
+// drain - send the requests in q one at a time, until it is empty
+func (r *Replicator) drain(q *replicaQueue) {
+	for {
+		q.mu.Lock()
+		if len(q.ops) == 0 {
+			q.draining = false
+			q.mu.Unlock()
+			return
+		}
+		op := q.ops[0]
+		q.ops = q.ops[1:]
+		q.mu.Unlock()
+
+		err := r.apply(op)
+		if err != nil {
+			glog.Infof("gave up on %s of key=%s on %s: %v",
+				protocol.RequestMethodToString[op.method],
+				hex.EncodeToString(op.key[:]), op.node.ToString(), err)
+		}
+		if op.done != nil {
+			op.done <- err
+		}
+	}
+}
+
+// apply - send op to its replica, trying again after a backoff when it
+// fails in a way which may pass, up to ReplicaAttempts times
+func (r *Replicator) apply(op replicaOp) error {
+	backoff := ReplicaRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := r.sendOp(op)
+		if err == nil {
+			return nil
+		}
+		if os.IsNotExist(errors.Cause(err)) {
+			// the key was deleted since, the delete is queued behind us
+			return nil
+		}
+		if _, answered := errors.Cause(err).(*protocol.ResponseError); answered && !protocol.IsRetryable(err) {
+			// the replica will only say the same again
+			return err
+		}
+		if attempt >= ReplicaAttempts {
+			return errors.Wrapf(err, "failed after %d attempts: ", attempt)
+		}
+		glog.Infof("failed %s of key=%s on %s, trying again: %v",
+			protocol.RequestMethodToString[op.method],
+			hex.EncodeToString(op.key[:]), op.node.ToString(), err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// sendOp - send op to its replica, streaming the blob from storage with a
+// store
+func (r *Replicator) sendOp(op replicaOp) error {
+	if op.method != protocol.StoreReplicaMethod {
+		return r.send(op.node, op.method, op.key, nil)
+	}
+	blob, err := OpenBlob(op.dataPath, op.key)
+	if err != nil {
+		return errors.Wrap(err, "failed to open key: ")
+	}
+	defer blob.Close()
+	return r.send(op.node, op.method, op.key, blob)
+}
+
+// send - perform a replica request against node, streaming blob with it if
+// it is not nil
+func (r *Replicator) send(node models.Node, method protocol.RequestMethod, key [20]byte, blob io.Reader) error {
+	_, err := r.request(node, method, key, nil, blob)
+	return err
+}
+
+// request - perform a request against node, returning the response.  The
+// request carries data, or has body streamed after it if body is not nil.
+func (r *Replicator) request(node models.Node, method protocol.RequestMethod, key [20]byte, data []byte, body io.Reader) (protocol.Response, error) {
+	return r.roundTrip(node, method, key, data, body, (*protocol.Transport).RoundTrip)
+}
+
+// requestStream - perform a request against node like request, leaving a
+// streamed response to be read from its body, the response has to be
+// closed
+func (r *Replicator) requestStream(node models.Node, method protocol.RequestMethod, key [20]byte) (protocol.Response, error) {
+	return r.roundTrip(node, method, key, nil, nil, (*protocol.Transport).RoundTripStream)
+}
+
+// roundTrip - perform a request against node with roundTrip
+func (r *Replicator) roundTrip(node models.Node, method protocol.RequestMethod, key [20]byte, data []byte, body io.Reader, roundTrip func(*protocol.Transport, *protocol.Request) (protocol.Response, error)) (protocol.Response, error) {
+	// like the chord remote calls, the request is made as this server
+	id, err := crypto.KeyID(&r.key.PublicKey)
+	if err != nil {
+		return protocol.Response{}, errors.Wrap(err, "failed to derive our id: ")
+	}
+	t, err := protocol.NewTransport(r.network, "tcp", node.Addr, protocol.NodeType, id, node.PublicKey, r.key)
+	if err != nil {
+		return protocol.Response{}, errors.Wrap(err, "failed creating transport: ")
+	}
+	defer t.Close()
+
+	request := &protocol.Request{
+		Header: protocol.Header{
+			Key:        key,
+			From:       id,
+			To:         node.ID,
+			Type:       protocol.NodeType,
+			PubKey:     &r.key.PublicKey,
+			DataLength: uint64(len(data)),
+		},
+		Method: method,
+		Data:   data,
+	}
+	if body != nil {
+		request.SetBody(body)
+	}
+	resp, err := roundTrip(t, request)
+	if err != nil {
+		return protocol.Response{}, errors.Wrap(err, "failed round trip: ")
+	}
+	return resp, nil
+}
@@ -0,0 +1,147 @@
+package file
+
+import (
+	"context"
+	"crypto/rsa"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/husobee/peerstore/protocol"
+)
+
+func TestReplicasOnePerServer(t *testing.T) {
+	keys := []*rsa.PrivateKey{}
+	for i := 0; i < 3; i++ {
+		key, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	vnode := func(i int, addr string, index uint) models.Node {
+		id, err := crypto.VirtualKeyID(&keys[i].PublicKey, index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return models.Node{
+			ID: id, Addr: addr, PublicKey: &keys[i].PublicKey, VNode: index,
+		}
+	}
+
+	// our own virtual node, and two virtual nodes of the same server come
+	// before the second server
+	successors := []models.Node{
+		vnode(0, "self", 1),
+		vnode(1, "one", 0),
+		vnode(1, "one", 2),
+		vnode(2, "two", 1),
+	}
+	r := NewReplicator(protocol.NewMemoryNetwork(), 3, func(key [20]byte) []models.Node {
+		return successors
+	}, "self", keys[0])
+
+	replicas := r.replicas([20]byte{})
+	if len(replicas) != 2 ||
+		replicas[0].ID != successors[1].ID || replicas[1].ID != successors[3].ID {
+		t.Errorf("expected one replica on each other server, got %+v", replicas)
+	}
+}
+
+func TestReplicatorOrder(t *testing.T) {
+	network := protocol.NewMemoryNetwork()
+	backoff := ReplicaRetryBackoff
+	ReplicaRetryBackoff = time.Millisecond
+	defer func() { ReplicaRetryBackoff = backoff }()
+
+	keys := []*rsa.PrivateKey{}
+	for i := 0; i < 2; i++ {
+		key, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	primaryID, _ := crypto.KeyID(&keys[0].PublicKey)
+	replicaID, _ := crypto.KeyID(&keys[1].PublicKey)
+	replicaPath := t.TempDir()
+	s, err := protocol.NewServer(network, keys[1], []models.Node{{
+		ID: primaryID, Addr: "primary", PublicKey: &keys[0].PublicKey,
+	}}, "replica", replicaPath, 16, 4)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	// the store is slow, and the first delete fails, neither of which lets
+	// the delete overtake the store
+	var (
+		mu      sync.Mutex
+		methods []string
+	)
+	record := func(method string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		methods = append(methods, method)
+		return len(methods)
+	}
+	s.Handle(protocol.StoreReplicaMethod, func(ctx context.Context, r *protocol.Request) protocol.Response {
+		record("store")
+		time.Sleep(100 * time.Millisecond)
+		return StoreReplicaHandler(ctx, r)
+	})
+	s.Handle(protocol.DeleteReplicaMethod, func(ctx context.Context, r *protocol.Request) protocol.Response {
+		if record("delete") == 2 {
+			return protocol.NewErrorResponse(protocol.Unavailable, "busy")
+		}
+		return DeleteReplicaHandler(ctx, r)
+	})
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	replica := models.Node{ID: replicaID, Addr: "replica", PublicKey: &keys[1].PublicKey}
+	r := NewReplicator(network, 2, func(key [20]byte) []models.Node {
+		return []models.Node{replica}
+	}, "primary", keys[0])
+	primaryPath := t.TempDir()
+	key := [20]byte{1}
+	if err := PutBlob(primaryPath, key, []byte("blob")); err != nil {
+		t.Fatal(err)
+	}
+	r.Replicate(primaryPath, key)
+	r.Delete(key)
+
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		mu.Lock()
+		n := len(methods)
+		mu.Unlock()
+		if n == 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the store and two tries at the delete, got %v", methods)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	if !(methods[0] == "store" && methods[1] == "delete" && methods[2] == "delete") {
+		t.Errorf("expected the delete to follow the store, got %v", methods)
+	}
+	mu.Unlock()
+	// the delete is answered after it was recorded
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := GetBlob(replicaPath, key); os.IsNotExist(err) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the replica to be deleted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 
 	"github.com/golang/glog"
@@ -32,35 +33,60 @@ func Get(path string, key [20]byte) (io.ReadCloser, error) {
 }
 
 // Post - create or update a file based on the key, returns
-// boolean success as well as an error
+// boolean success as well as an error.  The data is written to a temporary
+// file which replaces the file once it is complete, so readers never see a
+// partly written file, and a failed post leaves the old file in place.
 func Post(path string, key [20]byte, data io.Reader) error {
 	glog.Info("opening destination file",
 		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
 	)
-	// rm existing file first...
-	os.Remove(fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])))
-
-	f, err := os.OpenFile(
-		fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
-		os.O_RDWR|os.O_CREATE, 0600,
-	)
+	f, err := ioutil.TempFile(path, ".post-")
 	if err != nil {
 		glog.Info(err)
 		return errors.Wrap(err, "error opening file")
 	}
 	glog.Info("Writing file to storage")
 	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
 		return errors.Wrap(err, "error writing file")
 	}
 
 	glog.Info("Closing file to storage")
 	if err := f.Close(); err != nil {
 		glog.Info(err)
+		os.Remove(f.Name())
 		return errors.Wrap(err, "error closing file")
 	}
+	if err := os.Rename(
+		f.Name(), fmt.Sprintf("%s/%s", path, hex.EncodeToString(key[:])),
+	); err != nil {
+		os.Remove(f.Name())
+		return errors.Wrap(err, "error replacing file")
+	}
 	return nil
 }
 
+// spool - write data to a temporary file in path, returned ready to be read
+// back from the start.  The caller closes and removes the file.
+func spool(path string, data io.Reader) (*os.File, error) {
+	f, err := ioutil.TempFile(path, ".spool-")
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening spool file: ")
+	}
+	if _, err := io.Copy(f, data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "error writing spool file: ")
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, errors.Wrap(err, "error rewinding spool file: ")
+	}
+	return f, nil
+}
+
 // Delete - delete a file based on the key, returns
 // boolean success as well as an error
 func Delete(path string, key [20]byte) error {
@@ -71,3 +97,26 @@ func Delete(path string, key [20]byte) error {
 	}
 	return nil
 }
+
+// List - list the keys of all the files stored in path, files which are not
+// named by a key (such as the node's key pair) are skipped
+func List(path string) ([][20]byte, error) {
+	infos, err := ioutil.ReadDir(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read data dir: ")
+	}
+	keys := [][20]byte{}
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		b, err := hex.DecodeString(info.Name())
+		if err != nil || len(b) != 20 {
+			continue
+		}
+		var key [20]byte
+		copy(key[:], b)
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
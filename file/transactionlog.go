@@ -19,7 +19,7 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	id := models.Identifier(sha1.Sum(append(gobKey, []byte("-transaction-log")...)))
 
 	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 	}
@@ -57,7 +57,7 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	glog.Info("Peer holding TransactionLog: %s", node.ToString())
 
 	// now connect to the node holding the transaction log
-	st, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, thisID, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.NodeType, thisID, node.PublicKey, selfKey)
 	if err != nil {
 		log.Printf("ERR: %v", err)
 	}
@@ -75,11 +75,6 @@ func GetTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 		return models.TransactionLog{}, errors.Wrap(err, "failed to get file")
 	}
 
-	if resp.Status == protocol.Error {
-		log.Printf("failed to get resource requested.")
-		return models.TransactionLog{}, errors.Wrap(err, "failed to get file, protocol error")
-	}
-
 	var transactionLog = models.TransactionLog{}
 	dec = gob.NewDecoder(bytes.NewBuffer(resp.Data))
 	err = dec.Decode(&transactionLog)
@@ -100,7 +95,7 @@ func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	glog.Infof("Trying to PUT Transaction LOG, ID: %x", id)
 
 	// create a connection to our peer
-	t, err := protocol.NewTransport("tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
+	t, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", peer.Addr, protocol.NodeType, id, peer.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 	}
@@ -145,7 +140,7 @@ func PutTransactionLog(thisID models.Identifier, peer models.Node, userKey *rsa.
 	}
 
 	// figure out where to connect to
-	st, err := protocol.NewTransport("tcp", node.Addr, protocol.NodeType, id, node.PublicKey, selfKey)
+	st, err := protocol.NewTransport(protocol.TCPNetwork{}, "tcp", node.Addr, protocol.NodeType, id, node.PublicKey, selfKey)
 	if err != nil {
 		glog.Error("ERR: %v", err)
 		return errors.Wrap(err, "failed serialize transaction log: ")
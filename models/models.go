@@ -36,6 +36,12 @@ func IncrementClock(base uint64) uint64 {
 
 func init() {
 	gob.Register(SuccessorRequest{})
+	gob.Register(KeyRangeRequest{})
+	gob.Register(LeaveRequest{})
+	gob.Register(ClosestPrecedingRequest{})
+	gob.Register(ClosestPrecedingResponse{})
+	gob.Register(MerkleRequest{})
+	gob.Register(MerkleResponse{})
 	gob.Register(TransactionLog{})
 }
 
@@ -68,6 +74,70 @@ type SuccessorRequest struct {
 	ID Identifier
 }
 
+// KeyRangeRequest - this is the request structure used when a node asks
+// another node for the keys it holds within a range of the ring.  Low is
+// excluded from the range, High is included.
+type KeyRangeRequest struct {
+	Low  Identifier
+	High Identifier
+}
+
+// Contains - does the key range contain the given id, taking into account
+// wrapping around the ring
+func (krr KeyRangeRequest) Contains(id Identifier) bool {
+	return BetweenRightIncl(krr.Low, id, krr.High)
+}
+
+// LeaveRequest - this is the request structure a node sends to its
+// neighbors when it leaves the ring, Replacement is the node that takes the
+// place of Leaving for the receiver
+type LeaveRequest struct {
+	Leaving     Node
+	Replacement Node
+}
+
+// ClosestPrecedingRequest - this is the request structure for a single hop
+// of an iterative lookup, ID is the key being looked up, and Failed are the
+// nodes the caller was unable to reach, which should not be handed back
+type ClosestPrecedingRequest struct {
+	ID     Identifier
+	Failed []Identifier
+}
+
+// ClosestPrecedingResponse - the answer to a ClosestPrecedingRequest, the
+// successor of the node asked, and the closest node it knows of preceding
+// the ID, which is the node asked itself when it knows of none closer
+type ClosestPrecedingResponse struct {
+	Successor Node
+	Closest   Node
+}
+
+// MerkleRequest - this is the request structure used when a node compares
+// its merkle tree over a range of the ring with another node's.  Level and
+// Index pick the node of the tree to compare, level 0 being the root.  Sync
+// tells the requests of one comparison apart from the next, the tree is
+// built once for all of the requests with the same Sync, 0 builds it anew.
+type MerkleRequest struct {
+	Range KeyRangeRequest
+	Level uint
+	Index uint
+	Sync  uint64
+}
+
+// MerkleLeaf - a single key in a merkle tree, and the hash of its blob
+type MerkleLeaf struct {
+	Key  Identifier
+	Hash [20]byte
+}
+
+// MerkleResponse - a node of a merkle tree, with the hashes of its children,
+// or the leaves under it when it is at the bottom of the tree
+type MerkleResponse struct {
+	Hash     [20]byte
+	Children [][20]byte
+	Leaves   []MerkleLeaf
+}
+
 // ContextKey - this is a type which is used as keys for the context
 type ContextKey uint64
 
@@ -89,6 +159,12 @@ const (
 	SelfNodeContextKey
 	UserPublicKeyContextKey
 	ResourceNameContextKey
+	// ReplicatorContextKey - the replicator which pushes stored keys to
+	// the successors of this node
+	ReplicatorContextKey
+	// CallerContextKey - who sent the request being handled, as worked out
+	// by the server
+	CallerContextKey
 )
 
 func init() {
@@ -105,6 +181,9 @@ type Node struct {
 	ID        Identifier
 	Addr      string
 	PublicKey *rsa.PublicKey
+	// VNode - which of the virtual nodes hosted at Addr this node is, the
+	// ID of the node is derived from the public key and this index
+	VNode uint
 }
 
 // Compare - Given a Node, compare the parameter nPrime with this
@@ -132,44 +211,89 @@ func (n Node) CompareID(id Identifier) int {
 
 // ToString - Implementation of String
 func (n Node) ToString() string {
-	return fmt.Sprintf("addr=%s, id=%s, pubkey=%v", n.Addr,
-		hex.EncodeToString(n.ID[:]), n.PublicKey)
+	return fmt.Sprintf("addr=%s, vnode=%d, id=%s, pubkey=%v", n.Addr,
+		n.VNode, hex.EncodeToString(n.ID[:]), n.PublicKey)
 }
 
 // M - This is the max number of nodes in a finger table
 const M = 20 * 8
 
+// MaxVirtualNodes - the most virtual nodes a single server may host, this
+// bounds how many ring positions a single key can claim
+const MaxVirtualNodes = 64
+
 // Interval - This is the interval in which a successor in the
 // finger table is responsible
 type Interval struct {
-	Low  uint64 // excluded
-	High uint64 // included
+	Low  Identifier // excluded
+	High Identifier // included
 }
 
 func (i Interval) ToString() string {
-	return fmt.Sprintf("low=%d, high=%d", i.Low, i.High)
+	return fmt.Sprintf("low=%s, high=%s",
+		hex.EncodeToString(i.Low[:]), hex.EncodeToString(i.High[:]))
 }
 
-// KeyToID - helper to convert a key to a chord ring id
-func KeyToID(key Identifier) uint64 {
-	hash := big.NewInt(0)
-	hash.SetBytes(key[:])
-	ID := big.NewInt(0)
-	ID.Mod(hash, big.NewInt(160))
+// Contains - does the interval contain id, taking into account wrapping
+// around the ring
+func (i Interval) Contains(id Identifier) bool {
+	return BetweenRightIncl(i.Low, id, i.High)
+}
 
-	return ID.Uint64()
+// KeyToID - helper to convert a key to its position on the chord ring
+func KeyToID(key Identifier) *big.Int {
+	return big.NewInt(0).SetBytes(key[:])
+}
+
+// Between - is id within the open interval (low, high) on the ring.  The
+// interval wraps around the ring when low is greater than high, and when
+// low equals high it covers the whole ring except low.
+func Between(low, id, high Identifier) bool {
+	lowID, idID, highID := KeyToID(low), KeyToID(id), KeyToID(high)
+
+	if lowID.Cmp(highID) < 0 {
+		return lowID.Cmp(idID) < 0 && idID.Cmp(highID) < 0
+	}
+	// wrapping around the horn
+	return lowID.Cmp(idID) < 0 || idID.Cmp(highID) < 0
+}
+
+// BetweenRightIncl - is id within the half open interval (low, high] on the
+// ring.  When low equals high the interval covers the whole ring.
+func BetweenRightIncl(low, id, high Identifier) bool {
+	return Between(low, id, high) || id == high
+}
+
+// BetweenLeftIncl - is id within the half open interval [low, high) on the
+// ring.  When low equals high the interval covers the whole ring.
+func BetweenLeftIncl(low, id, high Identifier) bool {
+	return Between(low, id, high) || id == low
+}
+
+// FingerStart - the start of the i'th finger of id, which is
+// (id + 2^(i-1)) mod 2^M
+func FingerStart(id Identifier, i uint64) Identifier {
+	start := KeyToID(id)
+	start.Add(start, big.NewInt(0).Lsh(big.NewInt(1), uint(i-1)))
+	start.Mod(start, big.NewInt(0).Lsh(big.NewInt(1), M))
+
+	var out Identifier
+	b := start.Bytes()
+	copy(out[len(out)-len(b):], b)
+	return out
 }
 
 // NewInterval - helper to create a new interval based on two nodes
 func NewInterval(start, end Node) Interval {
 	return Interval{
-		Low:  KeyToID(start.ID),
-		High: KeyToID(end.ID),
+		Low:  start.ID,
+		High: end.ID,
 	}
 }
 
 // Finger - This is a finger entry
 type Finger struct {
+	// I - the index of this finger in the finger table
 	I         uint64
 	Interval  Interval
 	Successor Node
@@ -209,13 +333,38 @@ func (ft *FingerTable) SetIth(i uint64, interval Interval, successor, self Node)
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
 	ft.table[i-1] = Finger{
-		I:         KeyToID(self.ID),
+		I:         i,
 		Interval:  interval,
 		Successor: successor,
 	}
 	return nil
 }
 
+// Evict - clear every entry of the finger table whose successor is node, the
+// cleared entries will be filled in again when the fingers are fixed
+func (ft *FingerTable) Evict(node Node) int {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	evicted := 0
+	for i := range ft.table {
+		if ft.table[i].Successor.Addr != "" && ft.table[i].Successor.ID == node.ID {
+			ft.table[i].Successor = Node{}
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// Fingers - a copy of every entry in the finger table, the table itself has
+// no exported fields so this is what gets sent over the wire
+func (ft *FingerTable) Fingers() []Finger {
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+	fingers := make([]Finger, len(ft.table))
+	copy(fingers, ft.table[:])
+	return fingers
+}
+
 // ToString - string representation of a finger table
 func (ft *FingerTable) ToString() string {
 	ft.mu.RLock()
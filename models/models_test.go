@@ -0,0 +1,86 @@
+package models
+
+import "testing"
+
+func id(b ...byte) Identifier {
+	var out Identifier
+	copy(out[len(out)-len(b):], b)
+	return out
+}
+
+func TestBetween(t *testing.T) {
+	var max Identifier
+	for i := range max {
+		max[i] = 0xff
+	}
+
+	cases := []struct {
+		low, id, high Identifier
+		open, right   bool
+	}{
+		// plain interval
+		{id(1), id(2), id(3), true, true},
+		{id(1), id(3), id(3), false, true},
+		{id(1), id(1), id(3), false, false},
+		{id(1), id(4), id(3), false, false},
+		// wrapping around the ring
+		{id(3), id(4), id(1), true, true},
+		{id(3), id(0), id(1), true, true},
+		{id(3), max, id(1), true, true},
+		{id(3), id(2), id(1), false, false},
+		{id(3), id(1), id(1), false, true},
+		// positions beyond 160 apart must not collide
+		{id(1, 0), id(1, 160), id(2, 0), true, true},
+		{id(0), id(160), id(1, 0), true, true},
+		// low == high covers the whole ring
+		{id(5), id(7), id(5), true, true},
+		{id(5), id(5), id(5), false, true},
+	}
+
+	for i, c := range cases {
+		if got := Between(c.low, c.id, c.high); got != c.open {
+			t.Errorf("case %d: Between = %v, expected %v", i, got, c.open)
+		}
+		if got := BetweenRightIncl(c.low, c.id, c.high); got != c.right {
+			t.Errorf("case %d: BetweenRightIncl = %v, expected %v", i, got, c.right)
+		}
+	}
+}
+
+func TestFingerStart(t *testing.T) {
+	if start := FingerStart(id(1), 1); start != id(2) {
+		t.Errorf("finger 1 start: %x", start)
+	}
+	if start := FingerStart(id(1), 9); start != id(1, 1) {
+		t.Errorf("finger 9 start: %x", start)
+	}
+
+	// the last finger wraps around the ring
+	var half Identifier
+	half[0] = 0x80
+	if start := FingerStart(half, M); start != id(0) {
+		t.Errorf("finger %d start: %x", M, start)
+	}
+}
+
+func TestFingerTableEvict(t *testing.T) {
+	self := Node{ID: id(1), Addr: "a"}
+	dead := Node{ID: id(2), Addr: "b"}
+	alive := Node{ID: id(9), Addr: "c"}
+
+	ft := NewFingerTable()
+	ft.SetIth(1, Interval{}, dead, self)
+	ft.SetIth(2, Interval{}, dead, self)
+	ft.SetIth(4, Interval{}, alive, self)
+
+	if n := ft.Evict(dead); n != 2 {
+		t.Errorf("evicted %d fingers, expected 2", n)
+	}
+	for i, expected := range map[uint64]string{1: "", 2: "", 4: "c"} {
+		finger, _ := ft.GetIth(i)
+		if finger.Successor.Addr != expected {
+			t.Errorf("finger %d: successor addr %q, expected %q",
+				i, finger.Successor.Addr, expected)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rsa"
+
+	"github.com/husobee/peerstore/models"
+)
+
+// Caller - who sent a request, as worked out by the server when it
+// authenticated the request.  Handlers should go by the caller rather than
+// the header of the request, which holds whatever the sender put there.
+type Caller struct {
+	// ID - the id bound to PublicKey
+	ID   models.Identifier
+	Type CallerType
+	// PublicKey - the key the request was verified with, for a user this is
+	// the key they registered with
+	PublicKey *rsa.PublicKey
+	// Verified - whether the request was proven to come from the holder of
+	// PublicKey
+	Verified bool
+}
+
+// CallerFromContext - the caller of the request ctx was made for, an
+// unverified caller if there is none
+func CallerFromContext(ctx context.Context) Caller {
+	caller, _ := ctx.Value(models.CallerContextKey).(Caller)
+	return caller
+}
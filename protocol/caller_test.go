@@ -0,0 +1,85 @@
+package protocol
+
+import (
+	"context"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+)
+
+func TestRequestCaller(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "caller-server", t.TempDir(), 4, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	callers := make(chan Caller, 1)
+	s.Handle(PingMethod, func(ctx context.Context, r *Request) Response {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the request context to have a deadline")
+		}
+		callers <- CallerFromContext(ctx)
+		return Response{Status: Success}
+	})
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	ping := func(from models.Identifier, self *rsa.PrivateKey) error {
+		tr, err := NewTransportWithTimeout(
+			network, "tcp", "caller-server", NodeType, from, &key.PublicKey, self, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+		_, err = tr.RoundTrip(&Request{
+			Header: Header{From: from, Type: NodeType},
+			Method: PingMethod,
+		})
+		return err
+	}
+
+	// the server trusts itself
+	if err := ping(s.id, key); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	caller := <-callers
+	if caller.ID != s.id || !caller.Verified ||
+		caller.Type != NodeType || !caller.PublicKey.Equal(&key.PublicKey) {
+		t.Errorf("expected the caller to be the server, got %+v", caller)
+	}
+
+	// another key claiming to be the server is turned away, as is the key
+	// making requests as itself, as nobody trusts it
+	other, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherID, _ := crypto.KeyID(&other.PublicKey)
+	if err := ping(s.id, other); ErrorCodeOf(err) != Unauthenticated {
+		t.Errorf("expected a foreign key claiming a trusted node to be unauthenticated, got %v", err)
+	}
+	if err := ping(models.Identifier(otherID), other); ErrorCodeOf(err) != Unauthenticated {
+		t.Errorf("expected an untrusted node to be unauthenticated, got %v", err)
+	}
+	select {
+	case caller := <-callers:
+		t.Errorf("expected the handler not to be reached, was by %+v", caller)
+	default:
+	}
+
+	if CallerFromContext(context.Background()).Verified {
+		t.Error("expected a context without a caller to be unverified")
+	}
+}
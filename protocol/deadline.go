@@ -0,0 +1,106 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// aLongTimeAgo - a deadline in the past, which fails any read or write
+// blocked on a connection right away
+var aLongTimeAgo = time.Unix(1, 0)
+
+// earliestDeadline - the deadline of ctx, or timeout from now if that is
+// sooner, the zero time if there is neither
+func earliestDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	deadline, ok := ctx.Deadline()
+	if timeout > 0 {
+		if byTimeout := time.Now().Add(timeout); !ok || byTimeout.Before(deadline) {
+			return byTimeout
+		}
+	}
+	return deadline
+}
+
+// connDeadline - the deadline of a connection for the length of a round
+// trip made with ctx.  When ctx is canceled the deadline is moved into the
+// past, so whatever is blocked on the connection gives up.
+type connDeadline struct {
+	ctx      context.Context
+	timeout  time.Duration
+	pc       *pooledConn
+	mu       *sync.Mutex
+	canceled bool
+	stop     chan struct{}
+	stopped  chan struct{}
+}
+
+// newConnDeadline - start tying the deadline of pc to ctx, and to timeout
+// from now on each extend
+func newConnDeadline(ctx context.Context, pc *pooledConn, timeout time.Duration) *connDeadline {
+	cd := &connDeadline{
+		ctx:     ctx,
+		timeout: timeout,
+		pc:      pc,
+		mu:      new(sync.Mutex),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	if ctx.Done() == nil {
+		// ctx can never be canceled
+		close(cd.stopped)
+		return cd
+	}
+	go func() {
+		defer close(cd.stopped)
+		select {
+		case <-ctx.Done():
+			cd.mu.Lock()
+			defer cd.mu.Unlock()
+			cd.canceled = true
+			cd.pc.SetDeadline(aLongTimeAgo)
+		case <-cd.stop:
+		}
+	}()
+	return cd
+}
+
+// extend - move the deadline timeout on from now, without passing the
+// deadline of ctx
+func (cd *connDeadline) extend() error {
+	cd.mu.Lock()
+	defer cd.mu.Unlock()
+	if cd.canceled {
+		return cd.ctx.Err()
+	}
+	return cd.pc.SetDeadline(earliestDeadline(cd.ctx, cd.timeout))
+}
+
+// done - stop watching ctx, and clear the deadline.  false is returned if
+// ctx was done first, as the connection may have been left part way
+// through a message, and can not be used again.
+func (cd *connDeadline) done() bool {
+	close(cd.stop)
+	<-cd.stopped
+	if cd.canceled {
+		return false
+	}
+	return cd.pc.SetDeadline(time.Time{}) == nil
+}
+
+// err - the error of ctx if it is why err happened, otherwise err
+func (cd *connDeadline) err(err error) error {
+	return contextError(cd.ctx, err)
+}
+
+// contextError - the error of ctx if it is why err happened, otherwise err.
+// A connection can time out a moment before ctx notices its deadline passed.
+func contextError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return err
+}
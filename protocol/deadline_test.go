@@ -0,0 +1,98 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+func TestRoundTripContext(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "deadline-server", t.TempDir(), 4, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	// slow pings are answered once release is closed
+	release := make(chan struct{})
+	deadlines := make(chan time.Duration, 4)
+	gaveUp := make(chan struct{}, 4)
+	s.Handle(PingMethod, func(ctx context.Context, r *Request) Response {
+		if string(r.Data) == "slow" {
+			deadline, _ := ctx.Deadline()
+			deadlines <- time.Until(deadline)
+			select {
+			case <-ctx.Done():
+				gaveUp <- struct{}{}
+			case <-release:
+			}
+			<-release
+		}
+		return Response{Status: Success}
+	})
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	tr, err := NewTransport(network, "tcp", "deadline-server", NodeType, s.id, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+	ping := func(ctx context.Context, data string) error {
+		_, err := tr.RoundTripContext(ctx, &Request{
+			Header: Header{From: s.id, Type: NodeType},
+			Method: PingMethod,
+			Data:   []byte(data),
+		})
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := ping(ctx, "slow"); errors.Cause(err) != context.DeadlineExceeded {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the round trip to give up at the deadline, took %s", elapsed)
+	}
+	// the server gives up on the request along with us
+	if left := <-deadlines; left > time.Second {
+		t.Errorf("expected the deadline to be sent with the request, %s was left", left)
+	}
+	select {
+	case <-gaveUp:
+	case <-time.After(5 * time.Second):
+		t.Error("expected the server to give up on the request")
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		<-deadlines
+		cancel()
+	}()
+	if err := ping(ctx, "slow"); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected the round trip to be canceled, got %v", err)
+	}
+	close(release)
+
+	// a round trip given up on does not leave a broken connection in the
+	// pool for the next one
+	if err := ping(context.Background(), "fast"); err != nil {
+		t.Errorf("expected a round trip after the canceled ones to pass: %v", err)
+	}
+	if err := ping(ctx, "fast"); errors.Cause(err) != context.Canceled {
+		t.Errorf("expected a canceled context to fail right away, got %v", err)
+	}
+}
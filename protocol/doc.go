@@ -1,3 +1,19 @@
 // Package protocol - this package is the application protocol
 // for the application and service.
+//
+// Versions - requests are first sent in SendVersion, servers answer in the
+// version they were asked in.  A server which does not accept the version
+// answers with the versions it does, and hangs up, peers which predate
+// versioning just hang up.  Either way the sender falls back to an older
+// version, never below MinVersion, and remembers it for the peer for a while
+// before trying SendVersion on it again.
+//
+// Upgrading a ring from the legacy protocol goes:
+//
+//  1. run the new servers and clients with -minProtocolVersion 0, they
+//     fall back to the legacy protocol with peers which are yet to be
+//     upgraded, and accept it from them
+//  2. once every server and client is upgraded, restart them without
+//     -minProtocolVersion, so the legacy protocol is no longer accepted or
+//     fallen back to
 package protocol
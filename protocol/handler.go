@@ -24,38 +24,43 @@ type NodeRegistrationResponse struct {
 	Nodes     []models.Node
 }
 
+// PingHandler - this handler answers health checks, if we are able to
+// respond at all we are alive
+func (s *Server) PingHandler(ctx context.Context, r *Request) Response {
+	return Response{Status: Success}
+}
+
 // NodeRegistrationHandler - this handler handles all node registrations.  A node
 // registration consists of the node giving the server it's public key, and the
 // server signing that key, and returning the signed key as well as a list of
 // other nodes with coreseponding public keys that it knows about
 func (s *Server) NodeRegistrationHandler(ctx context.Context, r *Request) Response {
-	// validate invite
-	// add requested node to trustedNodes list
-	if _, err := s.getTrustedNode(r.Header.From); err == nil {
-		// we already have this node, response should error
-		return Response{
-			Status: Error,
-		}
+	// the node's id is the one bound to its public key, otherwise it
+	// could pick any position on the ring it likes
+	caller := CallerFromContext(ctx)
+	if !caller.Verified {
+		return NewErrorResponse(Unauthenticated, "caller is not verified")
 	}
+	// validate invite
+	// add requested node to trustedNodes list, a node we already have
+	// registering again, say after a restart, is answered all the same so
+	// it hears of the nodes which registered while it was away
 	node := models.Node{
-		ID:        r.Header.From,
+		ID:        caller.ID,
 		Addr:      r.Header.FromAddr,
-		PublicKey: r.Header.PubKey,
+		PublicKey: caller.PublicKey,
 	}
 	glog.Infof("adding this node to trustedNode: %s", node.ToString())
-	// we do not have this node, so we should add it
 	s.addTrustedNode(node)
 	// sign the requested node's public key with our private key
 	buf := bytes.NewBuffer([]byte{})
 	encoder := gob.NewEncoder(buf)
-	encoder.Encode(r.Header.PubKey)
+	encoder.Encode(caller.PublicKey)
 
 	signature, err := crypto.Sign(s.PrivateKey, buf.Bytes())
 	if err != nil {
 		glog.Infof("failed to sign signature: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return NewErrorResponse(Internal, "failed to sign node key")
 	}
 
 	nrr := NodeRegistrationResponse{
@@ -85,44 +90,43 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 	// sign the requested node's public key with our private key
 	// send back the signature and the list of trusted Nodes
 
+	caller := CallerFromContext(ctx)
+	if !caller.Verified {
+		return NewErrorResponse(Unauthenticated, "caller is not verified")
+	}
 	// validate invite
 	// add requested node to trustedNodes list
 	signer, err := s.getTrustedNode(r.Header.SignedBy)
-	if err == nil {
-		// we already have this node, response should error
+	if err != nil {
+		// we only take the word of a node we trust
 		glog.Infof("signer node is not trusted")
-		return Response{
-			Status: Error,
-		}
+		return NewErrorResponse(Forbidden, "signer node is not trusted")
 	}
 
 	buf := bytes.NewBuffer([]byte{})
 	encoder := gob.NewEncoder(buf)
-	encoder.Encode(r.Header.PubKey)
+	encoder.Encode(caller.PublicKey)
 
 	if err := crypto.Verify(signer.PublicKey, r.Header.Signature, buf.Bytes()); err != nil {
 		glog.Infof("failed to verify signature of signer: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return NewErrorResponse(Unauthenticated, "failed to verify signature of signer")
 	}
 	// we do not have this node, so we should add it
 	s.addTrustedNode(models.Node{
-		ID:        r.Header.From,
+		ID:        caller.ID,
 		Addr:      r.Header.FromAddr,
-		PublicKey: r.Header.PubKey,
+		PublicKey: caller.PublicKey,
 	})
 	// sign the requested node's public key with our private key
 	signature, err := crypto.Sign(s.PrivateKey, buf.Bytes())
 	if err != nil {
 		glog.Infof("failed to sign signature: %s", err)
-		return Response{
-			Status: Error,
-		}
+		return NewErrorResponse(Internal, "failed to sign node key")
 	}
 
 	nrr := NodeRegistrationResponse{
 		Signature: signature,
+		SignedBy:  s.id,
 		Nodes:     s.getAllTrustedNodes(),
 	}
 
@@ -143,39 +147,45 @@ func (s *Server) NodeTrustHandler(ctx context.Context, r *Request) Response {
 func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Response {
 	// take the request pubkey and figure out which node it belongs to,
 	// and write the public key to a file using the file request to said
-	// node for others to lookup as needed
+	// node for others to lookup as needed.  The key is stored under the
+	// id bound to it, which is where requests from the user are checked
+	// against it.
+	caller := CallerFromContext(ctx)
+	if !caller.Verified {
+		return NewErrorResponse(Unauthenticated, "caller is not verified")
+	}
 	buf := bytes.NewBuffer([]byte{})
-	err := crypto.WritePublicKeyAsPem(buf, r.Header.PubKey)
+	err := crypto.WritePublicKeyAsPem(buf, caller.PublicKey)
 	if err != nil {
 		glog.Infof("failed to write pub key as pem: %s", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Internal, "failed to encode public key")
 	}
 
 	// figure out where to connect to, by asking self
-	t, err := NewTransport("tcp", s.addr, NodeType, s.id, s.PrivateKey.Public().(*rsa.PublicKey), s.PrivateKey)
+	t, err := NewTransportContext(ctx, s.network, "tcp", s.addr, NodeType, s.id, s.PrivateKey.Public().(*rsa.PublicKey), s.PrivateKey)
 	defer t.Close()
 	if err != nil {
 		glog.Infof("ERR: %v", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Unavailable, "failed to connect to ourself")
 	}
 	// serialize our get successor request
 	var idBuf = new(bytes.Buffer)
 	enc := gob.NewEncoder(idBuf)
 	enc.Encode(models.SuccessorRequest{
-		models.Identifier(r.Header.Key),
+		caller.ID,
 	})
 
-	resp, err := t.RoundTrip(&Request{
+	resp, err := t.RoundTripContext(ctx, &Request{
 		Header: Header{
 			From: s.id,
-			Key:  r.Header.From,
+			Key:  caller.ID,
 		},
 		Method: GetSuccessorMethod,
 		Data:   idBuf.Bytes(),
 	})
 	if err != nil {
 		glog.Infof("Failed to round trip the successor request: %v", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Unavailable, "failed to find the node to store the public key on")
 	}
 	// connect to that host for this file
 	// pull node out of response, and connect to that host
@@ -184,22 +194,26 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	err = dec.Decode(&node)
 	if err != nil {
 		glog.Infof("Failed to deserialize the node data: %v", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Unavailable, "failed to find the node to store the public key on")
+	}
+	if err := crypto.VerifyVirtualKeyID(node.ID, node.PublicKey, node.VNode); err != nil {
+		glog.Infof("successor id does not match key: %v", err)
+		return NewErrorResponse(Unavailable, "node to store the public key on is invalid")
 	}
 
 	// OKAY, NOW connect to it, and store the file
 	// figure out where to connect to, by asking self
-	st, err := NewTransport("tcp", node.Addr, NodeType, s.id, node.PublicKey, s.PrivateKey)
+	st, err := NewTransportContext(ctx, s.network, "tcp", node.Addr, NodeType, s.id, node.PublicKey, s.PrivateKey)
 	defer st.Close()
 	if err != nil {
 		glog.Infof("ERR: %v", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Unavailable, "failed to connect to the node to store the public key on")
 	}
 
 	glog.Infof("server id is : %+v", s.id)
-	response, err := st.RoundTrip(&Request{
+	response, err := st.RoundTripContext(ctx, &Request{
 		Header: Header{
-			Key:        r.Header.From,
+			Key:        caller.ID,
 			From:       s.id,
 			DataLength: uint64(len(buf.Bytes())),
 		},
@@ -208,7 +222,7 @@ func (s *Server) UserRegistrationHandler(ctx context.Context, r *Request) Respon
 	})
 	if err != nil {
 		glog.Infof("ERR: %v\n", err)
-		return Response{Status: Error}
+		return NewErrorResponse(Unavailable, "failed to store public key: "+err.Error())
 	}
 	glog.Infof("response from file post: %+v", response)
 
@@ -0,0 +1,84 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+)
+
+func TestNodeTrustHandler(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	keys := []*rsa.PrivateKey{}
+	for i := 0; i < 3; i++ {
+		key, err := crypto.GenerateKeyPair()
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+	key, node, stranger := keys[0], keys[1], keys[2]
+	s, err := NewServer(network, key, nil, "trust-server", t.TempDir(), 4, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.Handle(NodeTrustMethod, s.NodeTrustHandler)
+	s.Handle(PingMethod, s.PingHandler)
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	nodeID, _ := crypto.KeyID(&node.PublicKey)
+	strangerID, _ := crypto.KeyID(&stranger.PublicKey)
+	request := func(method RequestMethod, signedBy models.Identifier, signer *rsa.PrivateKey) error {
+		buf := new(bytes.Buffer)
+		gob.NewEncoder(buf).Encode(&node.PublicKey)
+		signature, err := crypto.Sign(signer, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr, err := NewTransportWithTimeout(
+			network, "tcp", "trust-server", NodeType, nodeID, &key.PublicKey, node, 5*time.Second)
+		if err != nil {
+			return err
+		}
+		defer tr.Close()
+		_, err = tr.RoundTrip(&Request{
+			Header: Header{
+				From:      nodeID,
+				FromAddr:  "trust-node",
+				Type:      NodeType,
+				SignedBy:  signedBy,
+				Signature: signature,
+			},
+			Method: method,
+		})
+		return err
+	}
+
+	// only the word of a trusted node counts, and it has to be its word
+	if err := request(NodeTrustMethod, strangerID, stranger); ErrorCodeOf(err) != Forbidden {
+		t.Errorf("expected a signer which is not trusted to be forbidden, got %v", err)
+	}
+	if err := request(NodeTrustMethod, s.id, stranger); ErrorCodeOf(err) != Unauthenticated {
+		t.Errorf("expected a forged signature to be unauthenticated, got %v", err)
+	}
+	if err := request(PingMethod, s.id, key); ErrorCodeOf(err) != Unauthenticated {
+		t.Errorf("expected the node not to be trusted yet, got %v", err)
+	}
+
+	if err := request(NodeTrustMethod, s.id, key); err != nil {
+		t.Fatalf("expected the node to be trusted on the word of the server: %v", err)
+	}
+	if err := request(PingMethod, s.id, key); err != nil {
+		t.Errorf("expected the trusted node to be let in: %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+// memoryAcceptBuffer - the number of connections that can wait on a memory
+// listener to be accepted before dials are refused
+const memoryAcceptBuffer = 128
+
+// MemoryNetwork - a simulated network within a single process, so many
+// servers can be run against each other in tests.  Latency can be added to
+// any address, addresses can be partitioned from each other, and crashed.
+// Servers are told apart by the key they listen with, so dials made with a
+// server's key come from that server's address.
+type MemoryNetwork struct {
+	mu        *sync.Mutex
+	listeners map[string]*memoryListener
+	hosts     map[[20]byte]string
+	latency   map[string]time.Duration
+	cut       map[memoryLink]bool
+	crashed   map[string]bool
+	conns     map[*memoryConn]bool
+	pool      *Pool
+}
+
+// memoryLink - a pair of addresses, in order so either direction matches
+type memoryLink struct {
+	a, b string
+}
+
+func newMemoryLink(a, b string) memoryLink {
+	if a > b {
+		a, b = b, a
+	}
+	return memoryLink{a, b}
+}
+
+// NewMemoryNetwork - create a new, empty, simulated network
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		mu:        new(sync.Mutex),
+		listeners: make(map[string]*memoryListener),
+		hosts:     make(map[[20]byte]string),
+		latency:   make(map[string]time.Duration),
+		cut:       make(map[memoryLink]bool),
+		crashed:   make(map[string]bool),
+		conns:     make(map[*memoryConn]bool),
+		pool: NewPool(
+			DefaultMaxIdleConns, DefaultMaxIdleConnsPerPeer, DefaultIdleConnTimeout),
+	}
+}
+
+// Pool - the pool of idle connections over the simulated network
+func (n *MemoryNetwork) Pool() *Pool {
+	return n.pool
+}
+
+// Listen - listen on addr, as the server holding key
+func (n *MemoryNetwork) Listen(proto, addr string, key *rsa.PublicKey) (net.Listener, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, errors.New("memory network: address already in use")
+	}
+	if key != nil {
+		id, err := crypto.KeyID(key)
+		if err != nil {
+			return nil, errors.Wrap(err, "memory network: ")
+		}
+		n.hosts[id] = addr
+	}
+	l := &memoryListener{
+		network: n,
+		addr:    addr,
+		conns:   make(chan net.Conn, memoryAcceptBuffer),
+		closed:  make(chan struct{}),
+	}
+	n.listeners[addr] = l
+	return l, nil
+}
+
+// Dial - dial addr, as whoever holds key.  Dials fail when either end is
+// crashed, or the two ends are partitioned from each other.
+func (n *MemoryNetwork) Dial(proto, addr string, key *rsa.PublicKey, timeout time.Duration) (net.Conn, error) {
+	from := ""
+	if key != nil {
+		if id, err := crypto.KeyID(key); err == nil {
+			from = n.hostOf(id)
+		}
+	}
+
+	n.mu.Lock()
+	l, ok := n.listeners[addr]
+	if !ok || n.crashed[addr] || n.crashed[from] || n.cut[newMemoryLink(from, addr)] {
+		n.mu.Unlock()
+		return nil, errors.New("memory network: connection refused")
+	}
+	client, server := net.Pipe()
+	clientConn := &memoryConn{Conn: client, network: n, from: from, to: addr}
+	serverConn := &memoryConn{Conn: server, network: n, from: addr, to: from}
+	n.conns[clientConn] = true
+	n.conns[serverConn] = true
+	n.mu.Unlock()
+
+	select {
+	case l.conns <- serverConn:
+		return clientConn, nil
+	case <-l.closed:
+	default:
+	}
+	clientConn.Close()
+	serverConn.Close()
+	return nil, errors.New("memory network: connection refused")
+}
+
+// hostOf - the address of the server listening with the key id
+func (n *MemoryNetwork) hostOf(id [20]byte) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.hosts[id]
+}
+
+// SetLatency - delay every write to and from addr by latency
+func (n *MemoryNetwork) SetLatency(addr string, latency time.Duration) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.latency[addr] = latency
+}
+
+// Partition - cut every link between the addresses in a and the addresses
+// in b, open connections across the cut are closed
+func (n *MemoryNetwork) Partition(a, b []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, x := range a {
+		for _, y := range b {
+			n.cut[newMemoryLink(x, y)] = true
+		}
+	}
+	for c := range n.conns {
+		if n.cut[newMemoryLink(c.from, c.to)] {
+			c.Conn.Close()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// Heal - undo all partitions
+func (n *MemoryNetwork) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.cut = make(map[memoryLink]bool)
+}
+
+// Crash - crash the server at addr, it can not be dialed, nor dial anyone,
+// and all of its open connections are closed
+func (n *MemoryNetwork) Crash(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.crashed[addr] = true
+	for c := range n.conns {
+		if c.from == addr || c.to == addr {
+			c.Conn.Close()
+			delete(n.conns, c)
+		}
+	}
+}
+
+// Recover - bring a crashed server back, with whatever state it had
+func (n *MemoryNetwork) Recover(addr string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.crashed, addr)
+}
+
+// delay - how long a write between from and to takes
+func (n *MemoryNetwork) delay(from, to string) time.Duration {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.latency[from] + n.latency[to]
+}
+
+// memoryConn - one end of a connection on the memory network
+type memoryConn struct {
+	net.Conn
+	network  *MemoryNetwork
+	from, to string
+}
+
+// Write - write b, after the latency between the two ends has passed
+func (c *memoryConn) Write(b []byte) (int, error) {
+	if d := c.network.delay(c.from, c.to); d > 0 {
+		time.Sleep(d)
+	}
+	return c.Conn.Write(b)
+}
+
+// Close - close the connection, and forget about it
+func (c *memoryConn) Close() error {
+	c.network.mu.Lock()
+	delete(c.network.conns, c)
+	c.network.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// memoryListener - a listener on the memory network
+type memoryListener struct {
+	network *MemoryNetwork
+	addr    string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// Accept - wait for the next connection, or for the listener to be closed
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("memory network: listener closed")
+	}
+}
+
+// Close - stop listening, and free up the address
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.mu.Lock()
+		delete(l.network.listeners, l.addr)
+		l.network.mu.Unlock()
+	})
+	return nil
+}
+
+// Addr - the address listened on
+func (l *memoryListener) Addr() net.Addr {
+	return memoryAddr(l.addr)
+}
+
+// memoryAddr - an address on the memory network
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return "memory" }
+func (a memoryAddr) String() string  { return string(a) }
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"context"
+	"encoding/hex"
+	"runtime/debug"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/models"
+)
+
+// Middleware - wraps a handler, to do something before or after it, or to
+// answer the request instead of it
+type Middleware func(Handler) Handler
+
+// contextKey - keys of values in the context of a request which are only
+// of use within the protocol package
+type contextKey int
+
+const (
+	// serverRequestContextKey - the request as it came off the connection,
+	// which authentication needs
+	serverRequestContextKey contextKey = iota
+)
+
+// chain - wrap handler in middleware, the first of which runs first
+func chain(handler Handler, middleware []Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		handler = middleware[i](handler)
+	}
+	return handler
+}
+
+// Recover - answer a request whose handler panics with an Internal error,
+// rather than taking the whole server down with it
+func Recover(next Handler) Handler {
+	return func(ctx context.Context, r *Request) (response Response) {
+		defer func() {
+			if p := recover(); p != nil {
+				glog.Errorf("handler for %s panicked: %v\n%s",
+					RequestMethodToString[r.Method], p, debug.Stack())
+				response = NewErrorResponse(Internal, "handler failed")
+			}
+		}()
+		return next(ctx, r)
+	}
+}
+
+// LogRequests - log each request, and how it was answered
+func LogRequests(next Handler) Handler {
+	return func(ctx context.Context, r *Request) Response {
+		glog.Infof("Request: %14s - header_key: %s, %+v\n",
+			RequestMethodToString[r.Method],
+			hex.EncodeToString(r.Header.From[:]),
+			r,
+		)
+		start := time.Now()
+		response := next(ctx, r)
+		if err := response.Err(); err != nil {
+			glog.Infof("Response: %14s - failed in %s: %v\n",
+				RequestMethodToString[r.Method], time.Since(start), err)
+		} else {
+			glog.Infof("Response: %14s - succeeded in %s\n",
+				RequestMethodToString[r.Method], time.Since(start))
+		}
+		return response
+	}
+}
+
+// Authenticate - work out who sent the request, and make them available to
+// the handler with CallerFromContext.  A request whose caller can not prove
+// who they are is failed, and the connection it came over is closed.
+func (s *Server) Authenticate(next Handler) Handler {
+	return func(ctx context.Context, r *Request) Response {
+		sr, ok := ctx.Value(serverRequestContextKey).(*serverRequest)
+		if !ok {
+			return NewErrorResponse(Internal, "request did not come over a connection")
+		}
+		caller, failure := s.authenticate(ctx, *sr)
+		if failure != nil {
+			// answering any more requests would leave the client a
+			// response out of step
+			sr.hangUp = true
+			return NewErrorResponse(failure.Code, failure.Message)
+		}
+		ctx = context.WithValue(ctx, models.CallerContextKey, caller)
+		ctx = context.WithValue(ctx, models.UserPublicKeyContextKey, caller.PublicKey)
+		return next(ctx, r)
+	}
+}
+
+// RequireNode - only let nodes this server trusts through to the handler,
+// a node verified against a key it made up is turned away
+func (s *Server) RequireNode(next Handler) Handler {
+	return func(ctx context.Context, r *Request) Response {
+		if !s.isTrustedNode(CallerFromContext(ctx)) {
+			glog.Infof("%s is only available to trusted nodes\n", RequestMethodToString[r.Method])
+			return NewErrorResponse(Forbidden,
+				RequestMethodToString[r.Method]+" is only available to trusted nodes")
+		}
+		return next(ctx, r)
+	}
+}
+
+// RequireNodeOrAdmin - only let nodes this server trusts, or the users it
+// was told are admins, through to the handler
+func (s *Server) RequireNodeOrAdmin(next Handler) Handler {
+	return func(ctx context.Context, r *Request) Response {
+		caller := CallerFromContext(ctx)
+		if !s.isTrustedNode(caller) && !s.isAdmin(caller) {
+			glog.Infof("%s is only available to trusted nodes and admins\n", RequestMethodToString[r.Method])
+			return NewErrorResponse(Forbidden,
+				RequestMethodToString[r.Method]+" is only available to trusted nodes and admins")
+		}
+		return next(ctx, r)
+	}
+}
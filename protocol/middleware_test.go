@@ -0,0 +1,70 @@
+package protocol
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+)
+
+func TestMiddleware(t *testing.T) {
+	var order []string
+	trace := func(name string) Middleware {
+		return func(next Handler) Handler {
+			return func(ctx context.Context, r *Request) Response {
+				order = append(order, name)
+				return next(ctx, r)
+			}
+		}
+	}
+	ok := func(ctx context.Context, r *Request) Response {
+		order = append(order, "handler")
+		return Response{Status: Success}
+	}
+	chain(ok, []Middleware{trace("first"), trace("second")})(context.Background(), &Request{})
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "handler" {
+		t.Errorf("expected middleware to run in order before the handler, got %v", order)
+	}
+
+	// a panicking handler is answered with an internal error
+	panics := func(ctx context.Context, r *Request) Response { panic("oops") }
+	if resp := Recover(panics)(context.Background(), &Request{}); ErrorCodeOf(resp.Err()) != Internal {
+		t.Errorf("expected an internal error, got %+v", resp)
+	}
+
+	// only verified nodes the server trusts get through to node handlers
+	trusted, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedID, _ := crypto.KeyID(&trusted.PublicKey)
+	strangerID, _ := crypto.KeyID(&stranger.PublicKey)
+	s := &Server{
+		trustedNodes: map[models.Identifier]models.Node{
+			trustedID: {ID: trustedID, PublicKey: &trusted.PublicKey},
+		},
+		trustedNodesMapMu: new(sync.RWMutex),
+	}
+	for _, c := range []struct {
+		caller  Caller
+		allowed bool
+	}{
+		{Caller{ID: trustedID, PublicKey: &trusted.PublicKey, Type: NodeType, Verified: true}, true},
+		{Caller{ID: trustedID, PublicKey: &trusted.PublicKey, Type: NodeType}, false},
+		{Caller{ID: trustedID, PublicKey: &trusted.PublicKey, Type: UserType, Verified: true}, false},
+		{Caller{ID: strangerID, PublicKey: &stranger.PublicKey, Type: NodeType, Verified: true}, false},
+		{Caller{ID: trustedID, PublicKey: &stranger.PublicKey, Type: NodeType, Verified: true}, false},
+	} {
+		ctx := context.WithValue(context.Background(), models.CallerContextKey, c.caller)
+		resp := s.RequireNode(ok)(ctx, &Request{})
+		if allowed := resp.Status == Success; allowed != c.allowed {
+			t.Errorf("expected %+v to be allowed: %v, got %+v", c.caller, c.allowed, resp)
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"net"
+	"time"
+)
+
+// Network - the network servers listen on, and transports dial over.  The
+// key is the public key of whoever is listening or dialing, the real network
+// has no use for it, but a simulated network uses it to know who is talking
+// to whom.  Pool is where transports keep their idle connections over the
+// network, a connection is of no use on any other network.
+type Network interface {
+	Listen(proto, addr string, key *rsa.PublicKey) (net.Listener, error)
+	Dial(proto, addr string, key *rsa.PublicKey, timeout time.Duration) (net.Conn, error)
+	Pool() *Pool
+}
+
+// TCPNetwork - the real network
+type TCPNetwork struct{}
+
+// Listen - listen on addr
+func (TCPNetwork) Listen(proto, addr string, key *rsa.PublicKey) (net.Listener, error) {
+	return net.Listen(proto, addr)
+}
+
+// Dial - dial addr, a zero timeout waits as long as the OS lets us
+func (TCPNetwork) Dial(proto, addr string, key *rsa.PublicKey, timeout time.Duration) (net.Conn, error) {
+	if timeout == 0 {
+		return net.Dial(proto, addr)
+	}
+	return net.DialTimeout(proto, addr, timeout)
+}
+
+// Pool - the DefaultPool
+func (TCPNetwork) Pool() *Pool {
+	return DefaultPool
+}
+
+// publicKey - the public half of key, nil if there is no key
+func publicKey(key *rsa.PrivateKey) *rsa.PublicKey {
+	if key == nil {
+		return nil
+	}
+	return &key.PublicKey
+}
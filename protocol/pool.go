@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"bufio"
+	"crypto/rsa"
+	"encoding/gob"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+const (
+	// DefaultMaxIdleConns - the most idle connections the default pool keeps
+	// open across all peers
+	DefaultMaxIdleConns = 64
+	// DefaultMaxIdleConnsPerPeer - the most idle connections the default pool
+	// keeps open to any one peer
+	DefaultMaxIdleConnsPerPeer = 4
+	// DefaultIdleConnTimeout - how long the default pool keeps a connection
+	// open without it being used, which has to be shorter than
+	// ServerIdleTimeout so we give up on a connection before the server does
+	DefaultIdleConnTimeout = 30 * time.Second
+	// healthCheckWait - how long an idle connection is watched for being
+	// closed by the peer before it is reused
+	healthCheckWait = time.Millisecond
+)
+
+// DefaultPool - the pool transports over the real network take their
+// connections from
+var DefaultPool = NewPool(
+	DefaultMaxIdleConns, DefaultMaxIdleConnsPerPeer, DefaultIdleConnTimeout)
+
+// Pool - idle connections to peers, kept open so a round trip does not need
+// a new connection to be set up every time.  Connections are pooled by the
+// address and key of the peer, along with the key they were dialed with, as
+// a simulated network tells who is talking by the key they dial with.  A
+// pool only holds connections over one network.
+type Pool struct {
+	maxIdle        int
+	maxIdlePerPeer int
+	idleTimeout    time.Duration
+	mu             *sync.Mutex
+	idle           map[poolKey][]*pooledConn
+	numIdle        int
+	// fallbacks - the peers found not to accept SendVersion, and the
+	// version they are spoken to in instead
+	fallbacks map[poolKey]versionFallback
+}
+
+// versionFallback - an older version of the protocol a peer is spoken to
+// in, and when the peer was found to need it
+type versionFallback struct {
+	version uint8
+	since   time.Time
+}
+
+// NewPool - create a new, empty, connection pool
+func NewPool(maxIdle, maxIdlePerPeer int, idleTimeout time.Duration) *Pool {
+	return &Pool{
+		maxIdle:        maxIdle,
+		maxIdlePerPeer: maxIdlePerPeer,
+		idleTimeout:    idleTimeout,
+		mu:             new(sync.Mutex),
+		idle:           make(map[poolKey][]*pooledConn),
+		fallbacks:      make(map[poolKey]versionFallback),
+	}
+}
+
+// poolKey - what a pooled connection can be reused for
+type poolKey struct {
+	addr string
+	peer [20]byte
+	self [20]byte
+}
+
+// newPoolKey - the key connections to addr, held by peerKey, dialed with
+// selfKey are pooled under
+func newPoolKey(addr string, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) poolKey {
+	key := poolKey{addr: addr}
+	if peerKey != nil {
+		key.peer, _ = crypto.KeyID(peerKey)
+	}
+	if selfKey != nil {
+		key.self, _ = crypto.KeyID(publicKey(selfKey))
+	}
+	return key
+}
+
+// pooledConn - a connection along with the gob streams running over it,
+// which have to live as long as the connection does
+type pooledConn struct {
+	net.Conn
+	reader *bufio.Reader
+	enc    encoder
+	dec    decoder
+	// session - the session set up at the start of the connection, nil if
+	// every message is encrypted on its own
+	session *session
+	// version - the version of the protocol spoken over the connection
+	version uint8
+	// answered - whether the peer has answered a message over the
+	// connection, a peer hanging up before then may not speak the version
+	answered  bool
+	idleSince time.Time
+}
+
+// newPooledConn - start the gob streams over conn
+func newPooledConn(conn net.Conn) *pooledConn {
+	reader := bufio.NewReader(conn)
+	return &pooledConn{
+		Conn:   conn,
+		reader: reader,
+		enc:    gob.NewEncoder(conn),
+		dec:    gob.NewDecoder(reader),
+	}
+}
+
+// healthy - check the peer has not closed the connection while it sat
+// idle.  Nothing should arrive on an idle connection, so waiting for a read
+// to time out tells us it is still open, anything else means it is of no
+// use to us.  Anything read is kept in the buffer, so the gob stream is left
+// as it was.
+func (pc *pooledConn) healthy() bool {
+	if err := pc.SetReadDeadline(time.Now().Add(healthCheckWait)); err != nil {
+		return false
+	}
+	_, err := pc.reader.Peek(1)
+	if err := pc.SetReadDeadline(time.Time{}); err != nil {
+		return false
+	}
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// get - an idle connection for key which is still healthy, if there is one
+func (p *Pool) get(key poolKey) *pooledConn {
+	for {
+		p.mu.Lock()
+		conns := p.idle[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		// the most recently used connection is the least likely to have
+		// been closed on us
+		pc := conns[len(conns)-1]
+		p.remove(key, len(conns)-1)
+		p.mu.Unlock()
+
+		if time.Since(pc.idleSince) < p.idleTimeout && pc.healthy() {
+			return pc
+		}
+		pc.Close()
+	}
+}
+
+// put - keep pc open for reuse under key, unless the pool is full
+func (p *Pool) put(key poolKey, pc *pooledConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.expire()
+	if len(p.idle[key]) >= p.maxIdlePerPeer || p.numIdle >= p.maxIdle {
+		pc.Close()
+		return
+	}
+	pc.idleSince = time.Now()
+	p.idle[key] = append(p.idle[key], pc)
+	p.numIdle++
+}
+
+// version - the version of the protocol to speak to the peer under key,
+// SendVersion unless the peer was found not to accept it
+func (p *Pool) version(key poolKey) uint8 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fallback, ok := p.fallbacks[key]
+	if !ok || fallback.version >= SendVersion {
+		return SendVersion
+	}
+	if time.Since(fallback.since) > versionRecheck {
+		// the peer may have been upgraded since
+		delete(p.fallbacks, key)
+		return SendVersion
+	}
+	return fallback.version
+}
+
+// fellBack - remember the peer under key is to be spoken to in version
+func (p *Pool) fellBack(key poolKey, version uint8) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if fallback, ok := p.fallbacks[key]; ok && fallback.version <= version {
+		return
+	}
+	p.fallbacks[key] = versionFallback{version: version, since: time.Now()}
+}
+
+// Close - close every idle connection in the pool, the pool can still be
+// used afterwards
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key, conns := range p.idle {
+		for _, pc := range conns {
+			pc.Close()
+		}
+		delete(p.idle, key)
+	}
+	p.numIdle = 0
+}
+
+// expire - close the connections which have been idle for too long, the
+// caller must hold the pool lock
+func (p *Pool) expire() {
+	for key, conns := range p.idle {
+		// connections are kept in the order they were put back, so the
+		// expired ones are at the front
+		for len(conns) > 0 && time.Since(conns[0].idleSince) >= p.idleTimeout {
+			conns[0].Close()
+			p.remove(key, 0)
+			conns = p.idle[key]
+		}
+	}
+}
+
+// remove - drop the i'th idle connection for key from the pool, without
+// closing it, the caller must hold the pool lock
+func (p *Pool) remove(key poolKey, i int) {
+	conns := p.idle[key]
+	conns = append(conns[:i:i], conns[i+1:]...)
+	if len(conns) == 0 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = conns
+	}
+	p.numIdle--
+}
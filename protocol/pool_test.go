@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func TestTransportPool(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "pool-server", t.TempDir(), 16, 4)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.Handle(PingMethod, s.PingHandler)
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	tr, err := NewTransportWithTimeout(
+		network, "tcp", "pool-server", NodeType, s.id, &key.PublicKey, key, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+
+	// more round trips at once than there are workers, each takes a
+	// connection of its own
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := tr.RoundTrip(&Request{
+				Header: Header{From: s.id, Type: NodeType},
+				Method: PingMethod,
+			})
+			if err != nil || resp.Status != Success {
+				t.Errorf("ping failed: %v, %+v", err, resp)
+			}
+		}()
+	}
+	wg.Wait()
+
+	network.Pool().mu.Lock()
+	idle := len(network.Pool().idle[tr.key])
+	network.Pool().mu.Unlock()
+	if idle != DefaultMaxIdleConnsPerPeer {
+		t.Errorf("expected %d idle connections, found %d",
+			DefaultMaxIdleConnsPerPeer, idle)
+	}
+	if pc := network.Pool().get(tr.key); pc == nil {
+		t.Error("expected an idle connection to be reused")
+	} else {
+		network.Pool().put(tr.key, pc)
+	}
+
+	// connections closed on us fail their health check
+	network.Crash("pool-server")
+	if pc := network.Pool().get(tr.key); pc != nil {
+		t.Error("expected the connections to a crashed server to be dropped")
+	}
+}
@@ -0,0 +1,111 @@
+package protocol
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NonceSize - the length of the nonce every request is sent with
+	NonceSize = 16
+	// ReplayWindow - how far the timestamp of a request can be from our
+	// clock, either way, before it is rejected as stale.  Nonces are only
+	// remembered for this long, anything older is rejected on its timestamp.
+	ReplayWindow = 5 * time.Minute
+	// DefaultReplayCacheSize - the most nonces a server remembers
+	DefaultReplayCacheSize = 1 << 16
+)
+
+// newNonce - generate a nonce for a new request
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce: ")
+	}
+	return nonce, nil
+}
+
+// replayCache - the nonces of the requests seen within the replay window, so
+// a request can only be accepted once.  When the cache is full the nonce
+// with the oldest timestamp is forgotten, and requests no newer than it are
+// rejected from then on, as we can no longer tell if they were seen before.
+type replayCache struct {
+	mu     *sync.Mutex
+	window time.Duration
+	max    int
+	seen   map[string]bool
+	byTime replayHeap
+	// floor - the newest timestamp of a nonce forgotten to make room
+	floor time.Time
+}
+
+// newReplayCache - create a replay cache remembering at most max nonces,
+// for window either side of the current time
+func newReplayCache(window time.Duration, max int) *replayCache {
+	return &replayCache{
+		mu:     new(sync.Mutex),
+		window: window,
+		max:    max,
+		seen:   make(map[string]bool),
+	}
+}
+
+// check - record a request with nonce sent at timestamp, failing if it is
+// stale or has been seen before
+func (rc *replayCache) check(nonce []byte, timestamp, now time.Time) error {
+	if len(nonce) != NonceSize {
+		return errors.New("request has an invalid nonce")
+	}
+	if timestamp.Before(now.Add(-rc.window)) || timestamp.After(now.Add(rc.window)) {
+		return errors.Errorf("request timestamp %s is outside the replay window",
+			timestamp.Format(time.RFC3339))
+	}
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	// forget the nonces which are stale by now
+	for len(rc.byTime) > 0 && rc.byTime[0].timestamp.Before(now.Add(-rc.window)) {
+		delete(rc.seen, heap.Pop(&rc.byTime).(replayEntry).nonce)
+	}
+	if rc.seen[string(nonce)] {
+		return errors.New("request has been seen before")
+	}
+	for len(rc.byTime) >= rc.max {
+		forgotten := heap.Pop(&rc.byTime).(replayEntry)
+		delete(rc.seen, forgotten.nonce)
+		if forgotten.timestamp.After(rc.floor) {
+			rc.floor = forgotten.timestamp
+		}
+	}
+	if !timestamp.After(rc.floor) {
+		return errors.New("request is too old to be checked for replay")
+	}
+	rc.seen[string(nonce)] = true
+	heap.Push(&rc.byTime, replayEntry{nonce: string(nonce), timestamp: timestamp})
+	return nil
+}
+
+// replayEntry - a nonce in the replay cache
+type replayEntry struct {
+	nonce     string
+	timestamp time.Time
+}
+
+// replayHeap - the nonces in the replay cache, oldest timestamp first
+type replayHeap []replayEntry
+
+func (h replayHeap) Len() int            { return len(h) }
+func (h replayHeap) Less(i, j int) bool  { return h[i].timestamp.Before(h[j].timestamp) }
+func (h replayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *replayHeap) Push(x interface{}) { *h = append(*h, x.(replayEntry)) }
+func (h *replayHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
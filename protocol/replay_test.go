@@ -0,0 +1,95 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func TestReplayCache(t *testing.T) {
+	now := time.Now()
+	rc := newReplayCache(time.Minute, 2)
+	nonce := func(b byte) []byte {
+		n := make([]byte, NonceSize)
+		n[0] = b
+		return n
+	}
+
+	if err := rc.check(nonce(1), now, now); err != nil {
+		t.Fatalf("expected a fresh request to pass: %v", err)
+	}
+	if err := rc.check(nonce(1), now, now); err == nil {
+		t.Error("expected a replayed request to be rejected")
+	}
+	if err := rc.check(nonce(2), now.Add(-2*time.Minute), now); err == nil {
+		t.Error("expected a stale request to be rejected")
+	}
+	if err := rc.check(nonce(2), now.Add(2*time.Minute), now); err == nil {
+		t.Error("expected a request from the future to be rejected")
+	}
+	if err := rc.check(nonce(2)[:4], now, now); err == nil {
+		t.Error("expected a short nonce to be rejected")
+	}
+
+	// filling the cache forgets the oldest nonce, and anything as old
+	rc.check(nonce(2), now.Add(time.Second), now)
+	if err := rc.check(nonce(3), now.Add(2*time.Second), now); err != nil {
+		t.Errorf("expected a request to pass with the cache full: %v", err)
+	}
+	if err := rc.check(nonce(1), now, now); err == nil {
+		t.Error("expected a forgotten request to still be rejected")
+	}
+
+	// once the window has passed the nonces are forgotten, as their
+	// timestamps are too old to pass anyway
+	later := now.Add(2 * time.Minute)
+	if err := rc.check(nonce(4), later, later); err != nil {
+		t.Errorf("expected a fresh request to pass: %v", err)
+	}
+	if len(rc.seen) != 1 {
+		t.Errorf("expected stale nonces to be forgotten, %d remain", len(rc.seen))
+	}
+}
+
+func TestCheckReplay(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "replay-server", t.TempDir(), 1, 1)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	nonce, _ := newNonce()
+	request := &Request{
+		Header: Header{
+			Nonce:     nonce,
+			Timestamp: time.Now().UnixNano(),
+			Audience:  s.id,
+		},
+	}
+	em := &EncryptedMessage{Version: GCMVersion}
+	if err := s.checkReplay(em, request); err != nil {
+		t.Fatalf("expected the request to pass: %v", err)
+	}
+	if err := s.checkReplay(em, request); err == nil {
+		t.Error("expected the replayed request to be rejected")
+	}
+
+	request.Header.Nonce, _ = newNonce()
+	request.Header.Audience[0]++
+	if err := s.checkReplay(em, request); err == nil {
+		t.Error("expected a request meant for another server to be rejected")
+	}
+
+	// only legacy peers get away without the replay fields
+	if err := s.checkReplay(em, &Request{}); err == nil {
+		t.Error("expected a request without a nonce to be rejected")
+	}
+	if err := s.checkReplay(&EncryptedMessage{}, &Request{}); err != nil {
+		t.Errorf("expected a legacy request to pass: %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/gob"
+	"io"
 
 	"github.com/pkg/errors"
 )
@@ -16,18 +18,28 @@ type RequestMethod uint64
 
 // RequestMethodToString - Convert from a Request Method to String
 var RequestMethodToString = map[RequestMethod]string{
-	GetFileMethod:          "GetFile",
-	PostFileMethod:         "PostFile",
-	GetPublicKeyMethod:     "GetPublicKey",
-	PostPublicKeyMethod:    "PostPublicKey",
-	DeleteFileMethod:       "DeleteFile",
-	GetSuccessorMethod:     "GetSuccessor",
-	SetPredecessorMethod:   "SetPredecessor",
-	GetPredecessorMethod:   "GetPredecessor",
-	GetFingerTableMethod:   "GetFingerTable",
-	UserRegistrationMethod: "UserRegistrationMethod",
-	NodeRegistrationMethod: "NodeRegistrationMethod",
-	NodeTrustMethod:        "NodeTrustMethod",
+	GetFileMethod:              "GetFile",
+	PostFileMethod:             "PostFile",
+	GetPublicKeyMethod:         "GetPublicKey",
+	PostPublicKeyMethod:        "PostPublicKey",
+	DeleteFileMethod:           "DeleteFile",
+	GetSuccessorMethod:         "GetSuccessor",
+	SetPredecessorMethod:       "SetPredecessor",
+	GetPredecessorMethod:       "GetPredecessor",
+	GetFingerTableMethod:       "GetFingerTable",
+	UserRegistrationMethod:     "UserRegistrationMethod",
+	NodeRegistrationMethod:     "NodeRegistrationMethod",
+	NodeTrustMethod:            "NodeTrustMethod",
+	ListKeysMethod:             "ListKeys",
+	TransferKeyMethod:          "TransferKey",
+	GetSuccessorListMethod:     "GetSuccessorList",
+	StoreReplicaMethod:         "StoreReplica",
+	DeleteReplicaMethod:        "DeleteReplica",
+	SuccessorLeaveMethod:       "SuccessorLeave",
+	PredecessorLeaveMethod:     "PredecessorLeave",
+	PingMethod:                 "Ping",
+	ClosestPrecedingNodeMethod: "ClosestPrecedingNode",
+	MerkleTreeMethod:           "MerkleTree",
 }
 
 const (
@@ -53,15 +65,61 @@ const (
 	NodeTrustMethod
 	GetPublicKeyMethod
 	PostPublicKeyMethod
+	// ListKeysMethod - Chord Method to list the keys a node holds in a range
+	ListKeysMethod
+	// TransferKeyMethod - Chord Method to pull a stored blob, including the
+	// owner/secret header, from a node
+	TransferKeyMethod
+	// GetSuccessorListMethod - Chord Method to get the successor list
+	GetSuccessorListMethod
+	// StoreReplicaMethod - Replication Method to store a replica of a blob
+	StoreReplicaMethod
+	// DeleteReplicaMethod - Replication Method to delete a replica of a blob
+	DeleteReplicaMethod
+	// SuccessorLeaveMethod - Chord Method to tell a node its successor is
+	// leaving the ring
+	SuccessorLeaveMethod
+	// PredecessorLeaveMethod - Chord Method to tell a node its predecessor
+	// is leaving the ring
+	PredecessorLeaveMethod
+	// PingMethod - health check, to see if a node is still alive
+	PingMethod
+	// ClosestPrecedingNodeMethod - Chord Method to get a node's successor and
+	// the closest node it knows preceding an id, one hop of an iterative lookup
+	ClosestPrecedingNodeMethod
+	// MerkleTreeMethod - Replication Method to get a node of the merkle tree
+	// over the keys a node holds in a range, to compare it with a replica
+	MerkleTreeMethod
 )
 
 // Request - the standard request, includes a header,
 // method and data.  The resource is defined in the header
 // and the data length is defined in the header as well.
+// Bodies too big to hold in Data are streamed after the request instead,
+// see SetBody.
 type Request struct {
 	Header Header
 	Method RequestMethod
 	Data   []byte
+	// StreamKey - the key of the frames streamed after the request, empty
+	// if the body is in Data
+	StreamKey []byte
+	body      io.Reader
+}
+
+// Body - the body of the request, read from the stream following it if it
+// was streamed, otherwise from Data
+func (r *Request) Body() io.Reader {
+	if r.body != nil {
+		return r.body
+	}
+	return bytes.NewReader(r.Data)
+}
+
+// SetBody - stream body after the request, in frames, instead of sending
+// Data
+func (r *Request) SetBody(body io.Reader) {
+	r.body = body
 }
 
 // Validate - implementation of Validatable, makes sure the request is
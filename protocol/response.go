@@ -1,7 +1,10 @@
 package protocol
 
 import (
+	"bytes"
 	"encoding/gob"
+	"fmt"
+	"io"
 
 	"github.com/pkg/errors"
 )
@@ -27,11 +30,151 @@ var (
 	}
 )
 
-// Response - the response structure for any given request
+// ErrorCode - why a request failed, sent along with the Error status
+type ErrorCode int64
+
+const (
+	// Unknown - the server did not say why the request failed, which is
+	// all servers from before error codes can tell us
+	Unknown ErrorCode = iota
+	// BadRequest - the request was malformed, or for an unknown method
+	BadRequest
+	// NotFound - the resource requested does not exist
+	NotFound
+	// Forbidden - the caller is not allowed to do what was requested, such
+	// as reading a file it is not an owner of
+	Forbidden
+	// Conflict - the request clashes with the state of the server, such as
+	// a node leaving which is not our neighbor
+	Conflict
+	// Unauthenticated - the caller could not be verified to be who it
+	// claims to be
+	Unauthenticated
+	// TooLarge - there is not room for what was sent
+	TooLarge
+	// Unavailable - the server could not answer the request at the moment,
+	// such as when a peer it relies on did not answer
+	Unavailable
+	// Internal - the server failed to answer the request
+	Internal
+)
+
+var (
+	// ErrorCodeToString - the names of the error codes, for logging
+	ErrorCodeToString = map[ErrorCode]string{
+		Unknown:         "Unknown",
+		BadRequest:      "BadRequest",
+		NotFound:        "NotFound",
+		Forbidden:       "Forbidden",
+		Conflict:        "Conflict",
+		Unauthenticated: "Unauthenticated",
+		TooLarge:        "TooLarge",
+		Unavailable:     "Unavailable",
+		Internal:        "Internal",
+	}
+)
+
+// ResponseError - why a request failed, as told by the server.  It is sent
+// in the Failure of an Error response, and returned as the error of a round
+// trip which failed on the server.
+type ResponseError struct {
+	Code    ErrorCode
+	Message string
+	// Retryable - whether the same request might succeed if it is sent
+	// again later
+	Retryable bool
+}
+
+// Error - implementation of error
+func (e *ResponseError) Error() string {
+	code, ok := ErrorCodeToString[e.Code]
+	if !ok {
+		code = fmt.Sprintf("code %d", e.Code)
+	}
+	if e.Message == "" {
+		return fmt.Sprintf("request failed: %s", code)
+	}
+	return fmt.Sprintf("request failed: %s: %s", code, e.Message)
+}
+
+// ErrorCodeOf - the error code of err if the request failed on the server,
+// Unknown otherwise
+func ErrorCodeOf(err error) ErrorCode {
+	if re, ok := errors.Cause(err).(*ResponseError); ok {
+		return re.Code
+	}
+	return Unknown
+}
+
+// IsRetryable - whether err is from a request which might succeed if it is
+// sent again later
+func IsRetryable(err error) bool {
+	re, ok := errors.Cause(err).(*ResponseError)
+	return ok && re.Retryable
+}
+
+// NewErrorResponse - a response failing the request with code, and message
+// to tell the caller why.  Only Unavailable is retryable.
+func NewErrorResponse(code ErrorCode, message string) Response {
+	return Response{
+		Status: Error,
+		Failure: &ResponseError{
+			Code:      code,
+			Message:   message,
+			Retryable: code == Unavailable,
+		},
+	}
+}
+
+// Response - the response structure for any given request.  Bodies too big
+// to hold in Data are streamed after the response instead, see SetBody.
 type Response struct {
 	Header Header
 	Status ResponseStatus
-	Data   []byte
+	// Failure - why the request failed, if the status is Error
+	Failure *ResponseError
+	Data    []byte
+	// StreamKey - the key of the frames streamed after the response, empty
+	// if the body is in Data
+	StreamKey []byte
+	body      io.Reader
+}
+
+// Body - the body of the response, read from the stream following it if it
+// was streamed, otherwise from Data
+func (r *Response) Body() io.Reader {
+	if r.body != nil {
+		return r.body
+	}
+	return bytes.NewReader(r.Data)
+}
+
+// SetBody - stream body after the response, in frames, instead of sending
+// Data.  If body is an io.Closer it is closed once it has been sent.
+func (r *Response) SetBody(body io.Reader) {
+	r.body = body
+}
+
+// Close - finish with the body of the response.  A streamed response from
+// RoundTripStream has to be closed before the connection it came over can
+// be used again.
+func (r *Response) Close() error {
+	if closer, ok := r.body.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// Err - the error the response failed the request with, nil if it
+// succeeded
+func (r *Response) Err() error {
+	if r.Status != Error {
+		return nil
+	}
+	if r.Failure == nil {
+		return &ResponseError{Code: Unknown}
+	}
+	return r.Failure
 }
 
 // Validate - implementation of Validatable, makes sure the response is
@@ -44,5 +187,9 @@ func (r *Response) Validate() error {
 	if !ValidResponseStatus[r.Status] {
 		return errors.New("failed to validate response status")
 	}
+	// codes we do not know of are let through, they are from newer peers
+	if r.Failure != nil && r.Status != Error {
+		return errors.New("failed to validate response, failure on a success")
+	}
 	return nil
 }
@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+func TestResponseErrors(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "response-server", t.TempDir(), 4, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.Handle(GetFileMethod, func(ctx context.Context, r *Request) Response {
+		return NewErrorResponse(NotFound, "no such file")
+	})
+	s.Handle(PingMethod, func(ctx context.Context, r *Request) Response {
+		return NewErrorResponse(Unavailable, "try again later")
+	})
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	tr, err := NewTransportWithTimeout(
+		network, "tcp", "response-server", NodeType, s.id, &key.PublicKey, key, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+	roundTrip := func(method RequestMethod) (Response, error) {
+		return tr.RoundTrip(&Request{
+			Header: Header{From: s.id, Type: NodeType},
+			Method: method,
+		})
+	}
+
+	resp, err := roundTrip(GetFileMethod)
+	re, ok := errors.Cause(err).(*ResponseError)
+	if !ok {
+		t.Fatalf("expected a response error, got %v", err)
+	}
+	if re.Code != NotFound || re.Message != "no such file" || re.Retryable {
+		t.Errorf("unexpected response error: %+v", re)
+	}
+	if resp.Status != Error {
+		t.Errorf("expected the failed response along with the error, got %+v", resp)
+	}
+
+	_, err = roundTrip(PingMethod)
+	if ErrorCodeOf(err) != Unavailable || !IsRetryable(err) {
+		t.Errorf("expected a retryable unavailable error, got %v", err)
+	}
+	if _, err := roundTrip(DeleteFileMethod); ErrorCodeOf(err) != BadRequest {
+		t.Errorf("expected an unknown method to be a bad request, got %v", err)
+	}
+
+	// a failed request leaves the connection fit to use again
+	network.Pool().mu.Lock()
+	idle := len(network.Pool().idle[tr.key])
+	network.Pool().mu.Unlock()
+	if idle != 1 {
+		t.Errorf("expected the connection to be reused, %d are idle", idle)
+	}
+}
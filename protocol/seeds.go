@@ -0,0 +1,206 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// ParseSeeds - the seed peers given on the command line, addrs and keyFiles
+// are comma separated lists, the nth key file being the key of the nth
+// address.  No key files means no seeds, as is the case for the first server
+// of a network.
+func ParseSeeds(addrs, keyFiles string) ([]models.Node, error) {
+	if keyFiles == "" {
+		return nil, nil
+	}
+	addrList := strings.Split(addrs, ",")
+	keyFileList := strings.Split(keyFiles, ",")
+	if len(addrList) != len(keyFileList) {
+		return nil, errors.Errorf("%d seed addresses given with %d key files",
+			len(addrList), len(keyFileList))
+	}
+
+	seeds := []models.Node{}
+	for i := range addrList {
+		seed, err := readSeed(
+			strings.TrimSpace(addrList[i]), strings.TrimSpace(keyFileList[i]))
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	return seeds, nil
+}
+
+// ReadSeedsFile - the seed peers listed in a seeds file, one "addr keyfile"
+// pair per line.  Blank lines and lines starting with # are skipped, and key
+// files are relative to the directory of the seeds file.
+func ReadSeedsFile(path string) ([]models.Node, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open seeds file: ")
+	}
+	defer f.Close()
+
+	seeds := []models.Node{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, errors.Errorf(
+				"seeds file line %d should be an address and a key file", line)
+		}
+		keyFile := fields[1]
+		if !filepath.IsAbs(keyFile) {
+			keyFile = filepath.Join(filepath.Dir(path), keyFile)
+		}
+		seed, err := readSeed(fields[0], keyFile)
+		if err != nil {
+			return nil, err
+		}
+		seeds = append(seeds, seed)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "failed to read seeds file: ")
+	}
+	return seeds, nil
+}
+
+// readSeed - the seed at addr, with the public key held in keyFile
+func readSeed(addr, keyFile string) (models.Node, error) {
+	if addr == "" {
+		return models.Node{}, errors.New("seed address must be set")
+	}
+	f, err := os.Open(keyFile)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to open seed key file: ")
+	}
+	defer f.Close()
+
+	key, err := crypto.ReadPublicKeyAsPem(f)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to read seed key: ")
+	}
+	id, err := crypto.KeyID(&key)
+	if err != nil {
+		return models.Node{}, errors.Wrap(err, "failed to derive seed id: ")
+	}
+	return models.Node{
+		ID:        id,
+		Addr:      addr,
+		PublicKey: &key,
+	}, nil
+}
+
+// FirstSeed - send request over network to each of the seeds in order,
+// giving up on each after timeout, and return the first seed to answer along with its
+// response.  A seed which answers with an error status has still answered,
+// it is up to the caller what to make of the status.
+func FirstSeed(network Network, seeds []models.Node, t CallerType, id models.Identifier, selfKey *rsa.PrivateKey, timeout time.Duration, request *Request) (models.Node, Response, error) {
+	for _, seed := range seeds {
+		st, err := NewTransportWithTimeout(
+			network, "tcp", seed.Addr, t, id, seed.PublicKey, selfKey, timeout)
+		if err != nil {
+			glog.Infof("seed %s did not answer: %v", seed.Addr, err)
+			continue
+		}
+		resp, err := st.RoundTrip(request)
+		st.Close()
+		if _, answered := errors.Cause(err).(*ResponseError); err != nil && !answered {
+			glog.Infof("seed %s did not answer: %v", seed.Addr, err)
+			continue
+		}
+		return seed, resp, nil
+	}
+	return models.Node{}, Response{}, errors.Errorf(
+		"none of the %d seeds answered", len(seeds))
+}
+
+// Register - register with the first of seeds to answer, giving up on each
+// after timeout, and trust the nodes it trusts.  Each of those nodes is
+// asked to trust us in return, on the word of the seed, so that every node
+// can make requests of every other.  A node which can not be reached is
+// skipped, it hears of us from the seed when it registers again.
+func (s *Server) Register(seeds []models.Node, timeout time.Duration) error {
+	// a seeds file shared by the network lists us too
+	others := []models.Node{}
+	for _, seed := range seeds {
+		if seed.Addr != s.addr {
+			others = append(others, seed)
+		}
+	}
+	seed, resp, err := FirstSeed(
+		s.network, others, NodeType, s.id, s.PrivateKey, timeout,
+		&Request{
+			Header: Header{
+				From:     s.id,
+				FromAddr: s.addr,
+				Type:     NodeType,
+				PubKey:   publicKey(s.PrivateKey),
+			},
+			Method: NodeRegistrationMethod,
+		})
+	if err != nil {
+		return err
+	}
+	if err := resp.Err(); err != nil {
+		return errors.Wrap(err, "registration with "+seed.Addr+" refused: ")
+	}
+	var nrr NodeRegistrationResponse
+	if err := gob.NewDecoder(bytes.NewBuffer(resp.Data)).Decode(&nrr); err != nil {
+		return errors.Wrap(err, "failed to decode registration response: ")
+	}
+	glog.Infof("registered with %s, which trusts %d nodes", seed.Addr, len(nrr.Nodes))
+
+	for _, node := range nrr.Nodes {
+		if node.ID == s.id || node.ID == seed.ID || node.Addr == "" ||
+			crypto.VerifyKeyID(node.ID, node.PublicKey) != nil {
+			continue
+		}
+		s.addTrustedNode(node)
+		if err := s.requestTrust(node, nrr, timeout); err != nil {
+			glog.Infof("failed to be trusted by %s: %v", node.Addr, err)
+		}
+	}
+	return nil
+}
+
+// requestTrust - ask node to trust us, showing it our key signed by the
+// node we registered with
+func (s *Server) requestTrust(node models.Node, nrr NodeRegistrationResponse, timeout time.Duration) error {
+	t, err := NewTransportWithTimeout(
+		s.network, "tcp", node.Addr, NodeType, s.id, node.PublicKey, s.PrivateKey, timeout)
+	if err != nil {
+		return errors.Wrap(err, "failed creating transport: ")
+	}
+	defer t.Close()
+	if _, err := t.RoundTrip(&Request{
+		Header: Header{
+			From:      s.id,
+			FromAddr:  s.addr,
+			Type:      NodeType,
+			PubKey:    publicKey(s.PrivateKey),
+			SignedBy:  nrr.SignedBy,
+			Signature: nrr.Signature,
+		},
+		Method: NodeTrustMethod,
+	}); err != nil {
+		return errors.Wrap(err, "failed round trip: ")
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func writeSeedKey(t *testing.T, path string) *rsa.PrivateKey {
+	k, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := crypto.WritePublicKeyAsPem(f, k.Public().(*rsa.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func TestReadSeeds(t *testing.T) {
+	dir := t.TempDir()
+	a := writeSeedKey(t, filepath.Join(dir, "a.pem"))
+	b := writeSeedKey(t, filepath.Join(dir, "b.pem"))
+
+	seedsFile := filepath.Join(dir, "seeds")
+	if err := ioutil.WriteFile(seedsFile, []byte(fmt.Sprintf(
+		"# seeds\n\nhost-a:3000 a.pem\nhost-b:3000 %s\n",
+		filepath.Join(dir, "b.pem"))), 0600); err != nil {
+		t.Fatal(err)
+	}
+	seeds, err := ReadSeedsFile(seedsFile)
+	if err != nil {
+		t.Fatalf("failed to read seeds file: %v", err)
+	}
+	if len(seeds) != 2 || seeds[0].Addr != "host-a:3000" || seeds[1].Addr != "host-b:3000" {
+		t.Fatalf("unexpected seeds: %+v", seeds)
+	}
+	for i, k := range []*rsa.PrivateKey{a, b} {
+		id, _ := crypto.KeyID(k.Public().(*rsa.PublicKey))
+		if seeds[i].ID != id {
+			t.Errorf("seed %d has the wrong id", i)
+		}
+	}
+
+	seeds, err = ParseSeeds("host-a:3000, host-b:3000",
+		filepath.Join(dir, "a.pem")+","+filepath.Join(dir, "b.pem"))
+	if err != nil || len(seeds) != 2 || seeds[1].Addr != "host-b:3000" {
+		t.Errorf("unexpected seeds: %+v, %v", seeds, err)
+	}
+	if _, err := ParseSeeds("host-a:3000,host-b:3000", filepath.Join(dir, "a.pem")); err == nil {
+		t.Error("expected an error for an address without a key file")
+	}
+	if seeds, err := ParseSeeds("x", ""); err != nil || len(seeds) != 0 {
+		t.Errorf("expected no seeds without key files, got %+v, %v", seeds, err)
+	}
+}
@@ -4,9 +4,7 @@ import (
 	"bytes"
 	"context"
 	"crypto/rsa"
-	"crypto/sha1"
 	"encoding/gob"
-	"encoding/hex"
 	"net"
 	"os"
 	"sync"
@@ -18,23 +16,56 @@ import (
 	"github.com/pkg/errors"
 )
 
+const (
+	// ServerIdleTimeout - how long the server keeps a connection open
+	// waiting on the next request, clients pool their connections for less
+	// than this
+	ServerIdleTimeout = time.Minute
+	// RequestTimeout - the deadline of the context a handler is called
+	// with, anything the handler waits on should be given up on by then
+	RequestTimeout = time.Minute
+	// ShutdownTimeout - how long a server told to quit waits on its
+	// shutdown hooks and the requests it is answering before hanging up on
+	// them
+	ShutdownTimeout = 30 * time.Second
+	// shutdownPollInterval - how often Shutdown checks if the server has
+	// finished answering requests
+	shutdownPollInterval = 100 * time.Millisecond
+)
+
 // Server - base server type, contains a listener to listen for sockets
 type Server struct {
-	PrivateKey        *rsa.PrivateKey
-	id                models.Identifier
-	addr              string
-	listener          net.Listener
-	ctx               context.Context
-	connChan          chan net.Conn
-	handlerMap        map[RequestMethod]Handler
-	handlerMapMu      *sync.RWMutex
-	trustedNodes      map[models.Identifier]models.Node
+	PrivateKey   *rsa.PrivateKey
+	id           models.Identifier
+	addr         string
+	network      Network
+	listener     net.Listener
+	ctx          context.Context
+	requestChan  chan serverRequest
+	stopped      chan struct{}
+	replay       *replayCache
+	handlerMap   map[RequestMethod]Handler
+	middleware   []Middleware
+	handlerMapMu *sync.RWMutex
+	trustedNodes map[models.Identifier]models.Node
+	// admins - the users allowed to change the ring like a node can, to
+	// repair it, guarded by trustedNodesMapMu
+	admins            map[models.Identifier]*rsa.PublicKey
 	trustedNodesMapMu *sync.RWMutex
+	// conns - the open connections, and whether a request read off each
+	// is being answered
+	conns         map[net.Conn]bool
+	inShutdown    bool
+	shutdownHooks []func(context.Context)
+	connsMu       *sync.Mutex
+	shutdownOnce  *sync.Once
+	stoppedOnce   *sync.Once
 }
 
-// NewServer - create a new server
-func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string, bufferSize, numWorkers uint) (*Server, error) {
-	listener, err := net.Listen("tcp", address)
+// NewServer - create a new server listening on network, which trusts the
+// given peers from the start
+func NewServer(network Network, key *rsa.PrivateKey, peers []models.Node, address, dataPath string, bufferSize, numWorkers uint) (*Server, error) {
+	listener, err := network.Listen("tcp", address, publicKey(key))
 	if err != nil {
 		return nil, errors.Wrap(err, "failure to create server: ")
 	}
@@ -43,9 +74,12 @@ func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string,
 		return nil, errors.Wrap(err, "failed to create data dir: ")
 	}
 
-	id := models.Identifier(
-		sha1.Sum([]byte(address)),
-	)
+	// our id is bound to our public key, not where we happen to listen
+	keyID, err := crypto.KeyID(key.Public().(*rsa.PublicKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive server id: ")
+	}
+	id := models.Identifier(keyID)
 	trustedNodes := map[models.Identifier]models.Node{
 		id: models.Node{
 			Addr:      address,
@@ -53,22 +87,22 @@ func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string,
 			PublicKey: key.Public().(*rsa.PublicKey),
 		},
 	}
-	if peer.Addr != "" {
-		trustedNodes[peer.ID] = peer
-	}
 	ctx := context.WithValue(context.Background(), models.DataPathContextKey, dataPath)
 	ctx = context.WithValue(ctx, models.NumRequestWorkerContextKey, numWorkers)
 	ctx = context.WithValue(ctx, models.SelfPrivateKeyContextKey, key)
 	ctx = context.WithValue(ctx, models.SelfIDContextKey, id)
 	ctx = context.WithValue(ctx, models.SelfNodeContextKey, trustedNodes[id])
 
-	return &Server{
+	s := &Server{
 		PrivateKey:   key,
 		listener:     listener,
 		id:           id,
 		addr:         address,
+		network:      network,
 		ctx:          ctx,
-		connChan:     make(chan net.Conn, bufferSize),
+		requestChan:  make(chan serverRequest, bufferSize),
+		replay:       newReplayCache(ReplayWindow, DefaultReplayCacheSize),
+		stopped:      make(chan struct{}),
 		handlerMap:   make(map[RequestMethod]Handler),
 		handlerMapMu: new(sync.RWMutex),
 		trustedNodes: map[models.Identifier]models.Node{
@@ -77,10 +111,48 @@ func NewServer(key *rsa.PrivateKey, peer models.Node, address, dataPath string,
 				ID:        id,
 				PublicKey: key.Public().(*rsa.PublicKey),
 			},
-			peer.ID: peer,
 		},
+		admins:            make(map[models.Identifier]*rsa.PublicKey),
 		trustedNodesMapMu: new(sync.RWMutex),
-	}, nil
+		conns:             make(map[net.Conn]bool),
+		connsMu:           new(sync.Mutex),
+		shutdownOnce:      new(sync.Once),
+		stoppedOnce:       new(sync.Once),
+	}
+	for _, peer := range peers {
+		s.trustedNodes[peer.ID] = peer
+	}
+
+	s.Use(Recover, LogRequests, s.Authenticate)
+
+	// trust the nodes we trusted before we were restarted
+	trusted, err := loadTrustedNodes(dataPath)
+	if err != nil {
+		glog.Infof("failed to load trusted nodes: %v", err)
+	}
+	for _, node := range trusted {
+		if _, ok := s.trustedNodes[node.ID]; !ok {
+			s.trustedNodes[node.ID] = node
+		}
+	}
+	return s, nil
+}
+
+// Network - the network this server listens on, which anything making
+// requests on its behalf should dial over as well
+func (s *Server) Network() Network {
+	return s.network
+}
+
+// DataPath - the path where this server stores its data
+func (s *Server) DataPath() string {
+	return s.ctx.Value(models.DataPathContextKey).(string)
+}
+
+// SetContextValue - make value available to all handlers under key, this
+// should be done before the server starts serving requests
+func (s *Server) SetContextValue(key, value interface{}) {
+	s.ctx = context.WithValue(s.ctx, key, value)
 }
 
 // addTrustedNode - Add a node as a trusted node in the trustedNodes structure
@@ -89,6 +161,9 @@ func (s *Server) addTrustedNode(node models.Node) {
 	defer s.trustedNodesMapMu.Unlock()
 	glog.Infof("adding a trusted node: %s", node)
 	s.trustedNodes[node.ID] = node
+	if err := s.saveTrustedNodes(); err != nil {
+		glog.Infof("failed to save trusted nodes: %v", err)
+	}
 }
 
 // getTrustedNode - Get a node from the trustedNodes structure
@@ -104,6 +179,47 @@ func (s *Server) getTrustedNode(id models.Identifier) (models.Node, error) {
 	return models.Node{}, errors.New("node does not exist in trustedNodes")
 }
 
+// isTrustedNode - whether caller is a verified node, with the key we trust
+// it with
+func (s *Server) isTrustedNode(caller Caller) bool {
+	if caller.Type != NodeType || !caller.Verified {
+		return false
+	}
+	node, err := s.getTrustedNode(caller.ID)
+	return err == nil && node.PublicKey != nil && node.PublicKey.Equal(caller.PublicKey)
+}
+
+// AddAdmin - allow the user with key to make the requests only nodes may
+// make otherwise, such as repairing the ring
+func (s *Server) AddAdmin(key *rsa.PublicKey) error {
+	id, err := crypto.KeyID(key)
+	if err != nil {
+		return errors.Wrap(err, "failed to derive admin id: ")
+	}
+	s.trustedNodesMapMu.Lock()
+	defer s.trustedNodesMapMu.Unlock()
+	s.admins[models.Identifier(id)] = key
+	return nil
+}
+
+// isAdmin - whether caller is a verified user we were told to let in as an
+// admin
+func (s *Server) isAdmin(caller Caller) bool {
+	if caller.Type != UserType || !caller.Verified {
+		return false
+	}
+	s.trustedNodesMapMu.RLock()
+	defer s.trustedNodesMapMu.RUnlock()
+	key, ok := s.admins[caller.ID]
+	return ok && key.Equal(caller.PublicKey)
+}
+
+// TrustedNodes - the nodes this server trusts, including the ones it
+// trusted before it was restarted
+func (s *Server) TrustedNodes() []models.Node {
+	return s.getAllTrustedNodes()
+}
+
 // getAllTrustedNodes - Get a list of trustedNodes
 func (s *Server) getAllTrustedNodes() []models.Node {
 	s.trustedNodesMapMu.RLock()
@@ -115,87 +231,215 @@ func (s *Server) getAllTrustedNodes() []models.Node {
 	return resp
 }
 
+// serverRequest - a request read off a connection, waiting on a worker to
+// process it
+type serverRequest struct {
+	conn    net.Conn
+	encoder encoder
+	decoder decoder
+	session *session
+	em      *EncryptedMessage
+	request *Request
+	raw     []byte
+	// done - told whether the connection can carry on once the request
+	// has been answered
+	done chan bool
+	// hangUp - set by middleware when the connection should be closed once
+	// the request has been answered
+	hangUp bool
+}
+
 // startWorkers - we will start the number of numWorkers for the server to
-// process requests
-func (s *Server) startWorkers() ([]chan bool, []chan bool) {
-	var (
-		qChans = []chan bool{}
-		dChans = []chan bool{}
-	)
+// process requests, they run until the server is stopped
+func (s *Server) startWorkers() *sync.WaitGroup {
+	var wg = new(sync.WaitGroup)
 	var i uint
 	for ; i < s.ctx.Value(models.NumRequestWorkerContextKey).(uint); i++ {
-		var (
-			quit = make(chan bool)
-			done = make(chan bool)
-		)
-		qChans = append(qChans, quit)
-		dChans = append(dChans, done)
+		wg.Add(1)
 		go func(i uint) {
-			glog.Infof("Starting worker: %d, waiting for connections", i)
+			defer wg.Done()
+			glog.Infof("Starting worker: %d, waiting for requests", i)
 			defer glog.Infof("Ending worker: %d", i)
 			for {
 				select {
-				case conn := <-s.connChan:
+				case sr := <-s.requestChan:
 					// perform handling
-					glog.Infof("Worker: %d, accepting connection", i)
-					s.handleConnection(conn)
-				case <-quit:
-					// quit processing connections
+					glog.Infof("Worker: %d, accepting request", i)
+					sr.done <- s.handleRequest(sr)
+				case <-s.stopped:
+					// quit processing requests
 					glog.Infof("Worker: %d, quitting.", i)
-					done <- true
 					return
 				}
 			}
 		}(i)
 	}
-	return qChans, dChans
+	return wg
 }
 
-// Serve - process to serve requests, for each request that we accept
-// as a connection, we will fork the handling of that connection.
+// Serve - process to serve requests, for each connection that we accept
+// we will fork the reading of requests off that connection, which are passed
+// on to the workers.  Idle connections cost a goroutine, not a worker, so
+// clients can keep their connections open between requests.  Serve returns
+// once the server has shut down, either by Shutdown, or on a quit signal on
+// q, after which done is signaled.
 func (s *Server) Serve(q chan bool, done chan bool) {
-	workerQChans, workerDChans := s.startWorkers()
-	// start goroutine to accept connections
+	workers := s.startWorkers()
+	go s.acceptConnections()
+
+	select {
+	case <-q:
+		glog.Info("recieved quit signal, shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+		if err := s.Shutdown(ctx); err != nil {
+			glog.Infof("failed to shut down cleanly: %v", err)
+		}
+		cancel()
+		workers.Wait()
+		glog.Info("signaling done.")
+		done <- true
+	case <-s.stopped:
+		workers.Wait()
+	}
+}
+
+// acceptConnections - accept connections until the listener is closed,
+// reading requests off each of them
+func (s *Server) acceptConnections() {
+	var backoff time.Duration
 	for {
-		// watch for our quit signal
-		select {
-		case <-q:
-			glog.Info("recieved quit signal, shutting down workers")
-			// if we are given a quit signal, signal workers to quit
-			// and then return from serving connections
-			for _, qChan := range workerQChans {
-				qChan <- true
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.shuttingDown() {
+				return
 			}
-			for _, dChan := range workerDChans {
-				<-dChan
+			// back off, as whatever is wrong is unlikely to be fixed
+			// right away
+			if backoff == 0 {
+				backoff = 5 * time.Millisecond
+			} else if backoff *= 2; backoff > time.Second {
+				backoff = time.Second
 			}
-			glog.Info("signaling done.")
-			done <- true
+			glog.Errorf("failed to accept connection, retrying in %s: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		if !s.trackConn(conn, false) {
+			conn.Close()
 			return
-		default:
-			// accept a connection
-			s.listener.(*net.TCPListener).SetDeadline(
-				time.Now().Add(2 * time.Second))
-			conn, err := s.listener.Accept()
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok {
-					if opErr.Timeout() {
-						continue
-					}
-				}
-				glog.Infof("ERR in listener accept: %v", err)
-				panic("failed to accept socket")
-			}
-			// pass connection to a worker through channel
-			s.connChan <- conn
 		}
+		// read requests off the connection until it is closed
+		go s.handleConnection(conn)
+	}
+}
+
+// OnShutdown - register hook to be run when the server shuts down, before
+// it stops accepting connections, so the hook can still be answered by the
+// server.  Hooks are run in the order they were registered, with the ctx
+// given to Shutdown, and should give up once it is done.
+func (s *Server) OnShutdown(hook func(context.Context)) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	s.shutdownHooks = append(s.shutdownHooks, hook)
+}
+
+// Shutdown - gracefully shut the server down.  The shutdown hooks are run
+// under ctx, then the server stops accepting connections, idle connections are closed,
+// and the requests which have been read are answered before their
+// connections are closed.  If ctx is done before then, the remaining
+// connections are closed and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.connsMu.Lock()
+		hooks := s.shutdownHooks
+		s.connsMu.Unlock()
+		for _, hook := range hooks {
+			hook(ctx)
+		}
+
+		s.connsMu.Lock()
+		s.inShutdown = true
+		s.connsMu.Unlock()
+		if err := s.listener.Close(); err != nil {
+			glog.Infof("failed to close listener: %v", err)
+		}
+	})
+
+	// the workers are stopped once there is nothing left for them to do
+	defer s.stoppedOnce.Do(func() { close(s.stopped) })
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for !s.closeIdleConns() {
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// shuttingDown - whether the server has started to shut down
+func (s *Server) shuttingDown() bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	return s.inShutdown
+}
+
+// trackConn - record whether conn has a request being answered.  false is
+// returned for an idle connection once the server is shutting down, it
+// should be closed rather than wait on another request.
+func (s *Server) trackConn(conn net.Conn, busy bool) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	if !busy && s.inShutdown {
+		return false
+	}
+	s.conns[conn] = busy
+	return true
+}
+
+// forgetConn - stop tracking conn, which has been closed
+func (s *Server) forgetConn(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	delete(s.conns, conn)
+}
+
+// closeIdleConns - close the connections waiting on a request, true is
+// returned if there are no connections left
+func (s *Server) closeIdleConns() bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for conn, busy := range s.conns {
+		if !busy {
+			conn.Close()
+			delete(s.conns, conn)
+		}
+	}
+	return len(s.conns) == 0
+}
+
+// closeAllConns - close every connection, whether or not a request is being
+// answered on it
+func (s *Server) closeAllConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+		delete(s.conns, conn)
 	}
 }
 
 // handleConnection - this function will "handle" the accepted connection
-// by decoding the request, processing, and returning a response to the request
-// for the lifetime of the connection
+// by decoding each request, and passing it to a worker to be processed and
+// answered, for the lifetime of the connection
 func (s *Server) handleConnection(conn net.Conn) {
+	defer s.forgetConn(conn)
+	defer conn.Close()
 	// perform decryption of message here on the connection,
 	// and take the resulting payload and further decode that
 	// as the actual request object.
@@ -204,179 +448,390 @@ func (s *Server) handleConnection(conn net.Conn) {
 	// which is an RSA encrypted session key, so decrypt
 	// with the server's private key, then use that decrypted
 	// key to decrypt the AES ciphertext, with the IV in the message.
+	// Clients speaking the session version of the protocol start with a
+	// handshake instead, and the messages after it are encrypted with the
+	// session set up by it.
 	decoder := gob.NewDecoder(conn)
 	encoder := gob.NewEncoder(conn)
-Outer:
+	var sess *session
 	for {
-		em, request, raw, err := decryptAndDecodeRequest(decoder, s.PrivateKey)
+		// the connection is idle until the next request is read off it,
+		// and is closed instead if we are shutting down
+		if !s.trackConn(conn, false) {
+			return
+		}
+		// give up on clients which keep the connection open for too long
+		// without using it
+		if err := conn.SetReadDeadline(time.Now().Add(ServerIdleTimeout)); err != nil {
+			glog.Infof("err: %v\n", err)
+			return
+		}
+		em, request, raw, err := decryptAndDecodeRequest(decoder, sess, s.PrivateKey)
 
 		if err != nil {
 			glog.Infof("err: %v\n", err)
+			if _, ok := errors.Cause(err).(*versionError); ok {
+				// tell the peer what we do accept, so it can fall back
+				// to a version we both speak
+				encoder.Encode(&EncryptedMessage{
+					Versions: &VersionRange{Min: MinVersion, Latest: LatestVersion},
+				})
+			}
 			return
 		}
-		// at this point we have a request struct,
-		// we will now figure out what type of message it is and perform
-		// the method specified
-		glog.Infof("Request: %14s - header_key: %s, %+v\n",
-			RequestMethodToString[request.Method],
-			hex.EncodeToString(request.Header.From[:]),
-			request,
-		)
-		glog.Infof("EM is %+v", em)
-
-		// lookup the handler to call
-		s.handlerMapMu.RLock()
-		handler, ok := s.handlerMap[request.Method]
-		s.handlerMapMu.RUnlock()
-		s.ctx = context.WithValue(s.ctx, models.UserPublicKeyContextKey, em.Header.PubKey)
-		s.ctx = context.WithValue(s.ctx, models.ResourceNameContextKey, request.Header.ResourceName)
-
-		if ok {
-			// based on the type, we are going to authenticate this request
-			glog.Infof("header type is: %d", em.Header.Type)
-			switch em.Header.Type {
-			case UserType:
-				// in the event this is a user type we need to call ourself to
-				// figure out which node to talk to in order to get the public
-				// key file.  We will masqurade as the "from" for our request
-				// and get the key file.  When we have the key file from
-				// the dht, we will use that key file to validate the user's
-				// signature of the request.  if the signature is invalid,
-				// we will respond with an error, as this request is not authorized
-
-				// lookup the user based on the From field in the request header
-				if request.Method != UserRegistrationMethod {
-					// lookup the public key based on from header in request
-					// figure out where to connect to
-					t, err := NewTransport("tcp", s.addr, NodeType, s.id, s.PrivateKey.Public().(*rsa.PublicKey), s.PrivateKey)
-					if err != nil {
-						glog.Infof("ERR: %v", err)
-						return
-					}
-					// serialize our get successor request
-					var idBuf = new(bytes.Buffer)
-					enc := gob.NewEncoder(idBuf)
-					enc.Encode(models.SuccessorRequest{
-						models.Identifier(request.Header.Key),
-					})
-
-					glog.Infof("about to round trip to find successor to get file node")
-					resp, err := t.RoundTrip(&Request{
-						Header: Header{
-							From: s.id,
-							Key:  request.Header.From,
-						},
-						Method: GetSuccessorMethod,
-						Data:   idBuf.Bytes(),
-					})
-					t.Close()
-					if err != nil {
-						glog.Infof("Failed to round trip the successor request: %v", err)
-						return
-					}
-					// connect to that host for this file
-					// pull node out of response, and connect to that host
-					var node = models.Node{}
-					dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
-					err = dec.Decode(&node)
-					if err != nil {
-						glog.Infof("Failed to deserialize the node data: %v", err)
-						return
-					}
-
-					glog.Infof("connecting to node with the public key")
-					// OKAY, NOW connect to it, and get the file
-					// figure out where to connect to, by asking self
-					st, err := NewTransport("tcp", node.Addr, NodeType, s.id, node.PublicKey, s.PrivateKey)
-					if err != nil {
-						glog.Infof("ERR: %v", err)
-						return
-					}
-
-					glog.Infof("server id is : %+v", s.id)
-					response, err := st.RoundTrip(&Request{
-						Header: Header{
-							Key:  request.Header.From,
-							From: s.id,
-						},
-						Method: GetPublicKeyMethod,
-					})
-					st.Close()
-					if err != nil {
-						glog.Infof("ERR: %v\n", err)
-						return
-					}
-					glog.Infof("response from file post: %+v", response)
-
-					// response.data has the pem, need to read that
-					pubKey, err := crypto.ReadPublicKeyAsPem(bytes.NewBuffer(response.Data))
-					if err != nil {
-						glog.Infof("ERR: %v\n", err)
-						return
-					}
-					// validate the signature on the request! almost done!
-					if err := crypto.Verify(&pubKey, em.Header.Signature, raw); err != nil {
-
-						glog.Infof("unable to validate signature for user request: %v\n", err)
-						return
-					}
-				}
-
-			case NodeType:
-				// if this is a node type request, we need to validate this node
-				// is in our trustedNodes map, and use the public key from
-				// there to validate the request, if the request signature is not
-				// valid we will return an error
-				// skip this if this is a node registration request
-				if request.Method != NodeRegistrationMethod {
-					node, err := s.getTrustedNode(request.Header.From)
-					if err != nil {
-						glog.Infof("failed to get trusted node: %s", err)
-						// if there was an error, respond with error
-						encryptAndEncode(encoder, Response{
-							Status: Error,
-						}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
-						return
-					}
-					glog.Infof("node from trustedNodes: %s", node.ToString())
-					glog.Infof("bytes are: %x", raw)
-					glog.Infof("signature from header: %x", em.Header.Signature)
-
-					if err := crypto.Verify(em.Header.PubKey, em.Header.Signature, raw); err != nil {
-						glog.Infof("Failed to verify node message: %s", err)
-						encryptAndEncode(encoder, Response{
-							Status: Error,
-						}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
-						return
-					}
-				}
-			default:
-				// has to be one of the above two.
-				encryptAndEncode(encoder, Response{
-					Status: Error,
-				}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+		if em.Handshake != nil {
+			if sess != nil {
+				glog.Infof("err: handshake on a connection with a session\n")
+				return
 			}
+			if sess, err = s.acceptHandshake(encoder, em); err != nil {
+				glog.Infof("err: %v\n", err)
+				return
+			}
+			continue
+		}
+		if err := s.checkReplay(em, request); err != nil {
+			glog.Infof("rejecting request: %v\n", err)
+			return
+		}
 
-			encryptAndEncode(
-				encoder, handler(s.ctx, request), NodeType, em.Header.PubKey, s.id, s.PrivateKey)
-			continue Outer
+		// a request which has been read is answered, even if we start
+		// shutting down
+		s.trackConn(conn, true)
+
+		sr := serverRequest{
+			conn:    conn,
+			encoder: encoder,
+			decoder: decoder,
+			session: sess,
+			em:      em,
+			request: request,
+			raw:     raw,
+			done:    make(chan bool, 1),
+		}
+		select {
+		case s.requestChan <- sr:
+		case <-s.stopped:
+			return
 		}
+		select {
+		case ok := <-sr.done:
+			if !ok {
+				return
+			}
+		case <-s.stopped:
+			return
+		}
+	}
+}
+
+// checkReplay - make sure the request is meant for us, and is not a replay
+// of one we have already seen.  Peers which predate the replay fields only
+// speak the legacy protocol, their requests are let through until
+// MinVersion is raised.
+func (s *Server) checkReplay(em *EncryptedMessage, request *Request) error {
+	if em.Version == LegacyVersion && request.Header.Nonce == nil {
+		return nil
+	}
+	if request.Header.Audience != s.id {
+		return errors.New("request is meant for another server")
+	}
+	return s.replay.check(request.Header.Nonce,
+		time.Unix(0, request.Header.Timestamp), time.Now())
+}
+
+// handleRequest - answer the request with the handler for its method,
+// through the middleware of the server.  false is returned if the
+// connection should be closed, as the request was not allowed.
+func (s *Server) handleRequest(sr serverRequest) bool {
+	request := sr.request
+	if request.StreamKey != nil {
+		// the body follows the request on the connection, as the handler
+		// reads it
+		request.body = newStreamReader(sr.decoder, sr.em.Version, request.StreamKey, func() error {
+			return sr.conn.SetReadDeadline(time.Now().Add(ServerIdleTimeout))
+		})
+	}
+	glog.Infof("EM is %+v", sr.em)
+
+	// lookup the handler to call
+	s.handlerMapMu.RLock()
+	handler, ok := s.handlerMap[request.Method]
+	middleware := s.middleware
+	s.handlerMapMu.RUnlock()
+	if !ok {
 		// no handler to call
 		glog.Infof("Request is an Unknown Request")
-		encryptAndEncode(encoder, Response{
-			Status: Error,
-		}, NodeType, em.Header.PubKey, s.id, s.PrivateKey)
+		return s.respond(sr, NewErrorResponse(BadRequest, "unknown request method"))
+	}
+
+	// every request gets a context of its own, which is given up on once
+	// the sender has given up on the request
+	timeout := RequestTimeout
+	if t := time.Duration(request.Header.Timeout); t != 0 && t < timeout {
+		timeout = t
+	}
+	ctx, cancel := context.WithTimeout(s.ctx, timeout)
+	defer cancel()
+	ctx = context.WithValue(ctx, serverRequestContextKey, &sr)
+	ctx = context.WithValue(ctx, models.ResourceNameContextKey, request.Header.ResourceName)
+
+	response := chain(handler, middleware)(ctx, request)
+	return s.respond(sr, response) && !sr.hangUp
+}
+
+// authenticate - work out who sent the request in sr, failing if they can
+// not prove it.  Every caller has to hold the key it sent the request with,
+// and its id is the one bound to that key.  Looking up the key of a user is
+// given up on once ctx is done.
+func (s *Server) authenticate(ctx context.Context, sr serverRequest) (Caller, *ResponseError) {
+	em, request := sr.em, sr.request
+	caller := Caller{
+		Type:      em.Header.Type,
+		PublicKey: em.Header.PubKey,
 	}
+
+	// based on the type, we are going to authenticate this request
+	glog.Infof("header type is: %d", em.Header.Type)
+	switch em.Header.Type {
+	case UserType:
+		// in the event this is a user type we need to call ourself to
+		// figure out which node to talk to in order to get the public
+		// key file.  We will masqurade as the "from" for our request
+		// and get the key file.  When we have the key file from
+		// the dht, we will use that key file to validate the user's
+		// signature of the request.  if the signature is invalid,
+		// we will respond with an error, as this request is not authorized
+
+		// lookup the user based on the From field in the request header
+		if request.Method != UserRegistrationMethod {
+			pubKey, failure := s.lookupUserKey(ctx, request.Header.From)
+			if failure != nil {
+				return Caller{}, failure
+			}
+			caller.PublicKey = &pubKey
+		}
+
+	case NodeType:
+		// if this is a node type request, we need to validate this node
+		// is in our trustedNodes map, and use the public key from
+		// there to validate the request, if the request signature is not
+		// valid we will return an error.  The key the request came with
+		// has to be the one we trust the node with, otherwise anyone
+		// could claim to be a trusted node.
+		// skip this if the node is asking to be trusted
+		if request.Method != NodeRegistrationMethod &&
+			request.Method != NodeTrustMethod {
+			node, err := s.getTrustedNode(request.Header.From)
+			if err != nil {
+				glog.Infof("failed to get trusted node: %s", err)
+				return Caller{}, &ResponseError{
+					Code: Unauthenticated, Message: "node is not trusted"}
+			}
+			glog.Infof("node from trustedNodes: %s", node.ToString())
+			if node.PublicKey == nil || caller.PublicKey == nil ||
+				!node.PublicKey.Equal(caller.PublicKey) {
+				glog.Infof("request is not signed with the key of node: %s", node.ToString())
+				return Caller{}, &ResponseError{
+					Code: Unauthenticated, Message: "key does not match the trusted node"}
+			}
+			caller.PublicKey = node.PublicKey
+		}
+	default:
+		// has to be one of the above two
+		return Caller{}, &ResponseError{
+			Code: BadRequest, Message: "unknown caller type"}
+	}
+
+	// the request has to come from the holder of the key, which a
+	// registration proves for the key being registered
+	if caller.PublicKey == nil {
+		return Caller{}, &ResponseError{
+			Code: Unauthenticated, Message: "request has no key"}
+	}
+	if err := sr.verify(caller.PublicKey); err != nil {
+		glog.Infof("Failed to verify request: %s", err)
+		return Caller{}, &ResponseError{
+			Code: Unauthenticated, Message: "failed to verify request"}
+	}
+	id, err := crypto.KeyID(caller.PublicKey)
+	if err != nil {
+		return Caller{}, &ResponseError{
+			Code: Unauthenticated, Message: "failed to derive caller id"}
+	}
+	caller.ID = models.Identifier(id)
+	if caller.Type == UserType && request.Method != UserRegistrationMethod &&
+		caller.ID != request.Header.From {
+		// the key registered under the user's id is not theirs
+		return Caller{}, &ResponseError{
+			Code: Unauthenticated, Message: "user id does not match key"}
+	}
+	if caller.Type == NodeType && caller.ID != request.Header.From {
+		// nodes make requests as the server they are hosted by
+		return Caller{}, &ResponseError{
+			Code: Unauthenticated, Message: "node id does not match key"}
+	}
+	caller.Verified = true
+	return caller, nil
+}
+
+// lookupUserKey - find the key the user with id registered with, from the
+// node holding it, giving up once ctx is done
+func (s *Server) lookupUserKey(ctx context.Context, id models.Identifier) (rsa.PublicKey, *ResponseError) {
+	var unavailable = &ResponseError{
+		Code:      Unavailable,
+		Message:   "failed to look up the user key",
+		Retryable: true,
+	}
+	// lookup the public key based on from header in request
+	// figure out where to connect to
+	t, err := NewTransportContext(ctx, s.network, "tcp", s.addr, NodeType, s.id, s.PrivateKey.Public().(*rsa.PublicKey), s.PrivateKey)
+	if err != nil {
+		glog.Infof("ERR: %v", err)
+		return rsa.PublicKey{}, unavailable
+	}
+	// serialize our get successor request
+	var idBuf = new(bytes.Buffer)
+	enc := gob.NewEncoder(idBuf)
+	enc.Encode(models.SuccessorRequest{id})
+
+	glog.Infof("about to round trip to find successor to get file node")
+	resp, err := t.RoundTripContext(ctx, &Request{
+		Header: Header{
+			From: s.id,
+			Key:  id,
+		},
+		Method: GetSuccessorMethod,
+		Data:   idBuf.Bytes(),
+	})
+	t.Close()
+	if err != nil {
+		glog.Infof("Failed to round trip the successor request: %v", err)
+		return rsa.PublicKey{}, unavailable
+	}
+	// connect to that host for this file
+	// pull node out of response, and connect to that host
+	var node = models.Node{}
+	dec := gob.NewDecoder(bytes.NewBuffer(resp.Data))
+	err = dec.Decode(&node)
+	if err != nil {
+		glog.Infof("Failed to deserialize the node data: %v", err)
+		return rsa.PublicKey{}, unavailable
+	}
+	if err := crypto.VerifyVirtualKeyID(node.ID, node.PublicKey, node.VNode); err != nil {
+		glog.Infof("successor id does not match key: %v", err)
+		return rsa.PublicKey{}, unavailable
+	}
+
+	glog.Infof("connecting to node with the public key")
+	// OKAY, NOW connect to it, and get the file
+	// figure out where to connect to, by asking self
+	st, err := NewTransportContext(ctx, s.network, "tcp", node.Addr, NodeType, s.id, node.PublicKey, s.PrivateKey)
+	if err != nil {
+		glog.Infof("ERR: %v", err)
+		return rsa.PublicKey{}, unavailable
+	}
+
+	glog.Infof("server id is : %+v", s.id)
+	response, err := st.RoundTripContext(ctx, &Request{
+		Header: Header{
+			Key:  id,
+			From: s.id,
+		},
+		Method: GetPublicKeyMethod,
+	})
+	st.Close()
+	if ErrorCodeOf(err) == NotFound {
+		glog.Infof("user is not registered: %v\n", err)
+		return rsa.PublicKey{}, &ResponseError{
+			Code: Unauthenticated, Message: "user is not registered"}
+	} else if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return rsa.PublicKey{}, unavailable
+	}
+	glog.Infof("response from file post: %+v", response)
+
+	// response.data has the pem, need to read that
+	pubKey, err := crypto.ReadPublicKeyAsPem(bytes.NewBuffer(response.Data))
+	if err != nil {
+		glog.Infof("ERR: %v\n", err)
+		return rsa.PublicKey{}, &ResponseError{
+			Code: Unauthenticated, Message: "user key is invalid"}
+	}
+	return pubKey, nil
+}
+
+// verify - check the request was sent by the holder of key.  A request
+// sent over a session is vouched for by the key the session was set up
+// with, otherwise the request has to be signed with key.
+func (sr serverRequest) verify(key *rsa.PublicKey) error {
+	if sr.session != nil {
+		if !sr.session.peerKey.Equal(key) {
+			return errors.New("session was set up with another key")
+		}
+		return nil
+	}
+	return crypto.Verify(key, sr.em.Header.Signature, sr.raw)
+}
+
+// respond - answer the request in sr with response, followed by the
+// response body as a stream if it has one.  The response is encrypted in
+// the version of the protocol the request was, over its session if it came
+// over one.  Whatever is left unread of the request body is read first, so
+// the client is not left writing to us while we write to it.  false is
+// returned if the connection can not be used any further.
+func (s *Server) respond(sr serverRequest, response Response) bool {
+	defer response.Close()
+	if body, ok := sr.request.body.(*streamReader); ok {
+		if err := body.drain(); err != nil {
+			glog.Infof("failed to read request body: %v", err)
+			return false
+		}
+	}
+	if response.body != nil {
+		key, err := newStreamKey(sr.em.Version)
+		if err != nil {
+			glog.Infof("ERR: %v", err)
+			return false
+		}
+		response.StreamKey = key
+	}
+	if err := encryptAndEncode(sr.encoder, sr.session, response, sr.em.Version, NodeType, sr.em.Header.PubKey, s.id, s.PrivateKey); err != nil {
+		glog.Infof("failed to send response: %v", err)
+		return false
+	}
+	if response.body != nil {
+		if err := writeStream(sr.encoder, sr.em.Version, response.StreamKey, response.body, nil); err != nil {
+			glog.Infof("failed to send response body: %v", err)
+			return false
+		}
+	}
+	return true
 }
 
-// Handle - add handlers to the server
-func (s *Server) Handle(method RequestMethod, fn Handler) {
+// Handle - add handlers to the server, requests for method go through
+// middleware, in order, after the middleware of the server
+func (s *Server) Handle(method RequestMethod, fn Handler, middleware ...Middleware) {
 	s.handlerMapMu.Lock()
 	defer s.handlerMapMu.Unlock()
-	s.handlerMap[method] = fn
+	s.handlerMap[method] = chain(fn, middleware)
 }
 
-func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *rsa.PublicKey, from models.Identifier, selfKey *rsa.PrivateKey) error {
+// Use - send every request through middleware, in order, before the
+// middleware of its method.  A server starts out recovering from panics,
+// logging, and authenticating, so middleware added here can go by the
+// caller of the request.
+func (s *Server) Use(middleware ...Middleware) {
+	s.handlerMapMu.Lock()
+	defer s.handlerMapMu.Unlock()
+	// requests being handled hold on to the middleware they started with,
+	// so it is copied rather than appended to
+	s.middleware = append(append([]Middleware{}, s.middleware...), middleware...)
+}
+
+// encryptAndEncode - send payload encrypted under sess, or if there is no
+// session, signed and encrypted for peerKey in version of the protocol
+func encryptAndEncode(enc encoder, sess *session, payload interface{}, version uint8, t CallerType, peerKey *rsa.PublicKey, from models.Identifier, selfKey *rsa.PrivateKey) error {
 	// create a buffer for the request to be serialized to
 	buf := bytes.NewBuffer([]byte{})
 
@@ -387,6 +842,23 @@ func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *r
 		return errors.Wrap(err, "failure encoding request: ")
 	}
 
+	if sess != nil {
+		em := &EncryptedMessage{
+			Version: SessionVersion,
+			Header: Header{
+				Type: t,
+				From: from,
+			},
+		}
+		if err := sess.seal(em, buf.Bytes()); err != nil {
+			return errors.Wrap(err, "failure generating ciphertext: ")
+		}
+		if err := enc.Encode(em); err != nil {
+			return errors.Wrap(err, "failure encoding request: ")
+		}
+		return nil
+	}
+
 	// sign the request bytes
 	signature, err := crypto.Sign(selfKey, buf.Bytes())
 
@@ -399,14 +871,8 @@ func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *r
 		glog.Infof("failed to generate session key: %s", err)
 		return errors.Wrap(err, "failure generating session: ")
 	}
-	// encrypt with AES
-	ciphertext, iv, err := crypto.Encrypt(plaintextKey, buf.Bytes())
-	if err != nil {
-		glog.Infof("failed to generate ciphertext: %s", err)
-		return errors.Wrap(err, "failure generating ciphertext: ")
-	}
-
 	respEM := &EncryptedMessage{
+		Version: version,
 		Header: Header{
 			Type:      t,
 			PubKey:    selfKey.Public().(*rsa.PublicKey),
@@ -414,8 +880,11 @@ func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *r
 			Signature: signature,
 		},
 		SessionKey: ciphertextKey,
-		IV:         iv,
-		CipherText: ciphertext,
+	}
+	// encrypt with AES, the header bound to the ciphertext
+	if err := respEM.seal(plaintextKey, buf.Bytes()); err != nil {
+		glog.Infof("failed to generate ciphertext: %s", err)
+		return errors.Wrap(err, "failure generating ciphertext: ")
 	}
 
 	// serialize request
@@ -425,7 +894,7 @@ func encryptAndEncode(enc encoder, payload interface{}, t CallerType, peerKey *r
 	return nil
 }
 
-func decryptAndDecodeResponse(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMessage, *Response, []byte, error) {
+func decryptAndDecodeResponse(dec decoder, sess *session, selfKey *rsa.PrivateKey) (*EncryptedMessage, *Response, []byte, error) {
 	var em = new(EncryptedMessage)
 	err := dec.Decode(em)
 	if err != nil {
@@ -433,26 +902,22 @@ func decryptAndDecodeResponse(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedM
 		return em, nil, nil, errors.Wrap(err, "failed to decrypt response")
 	}
 
+	if em.Versions != nil {
+		return em, nil, nil, &versionError{accepted: em.Versions}
+	}
+
 	// validate response
 	if err := em.Validate(); err != nil {
 		return em, nil, nil, errors.Wrap(err, "failure validating response: ")
 	}
 
-	// em now has our encrypted message,
-	// decrypt session key
-	sessionKey, err := crypto.DecryptRSA(selfKey, em.SessionKey)
-	if err != nil {
-		glog.Infof("Invalid Session Key - ERR: %v\n", err)
-		return em, nil, nil, errors.Wrap(err, "invalid session key")
+	if em.Handshake != nil {
+		return em, nil, nil, errors.New("unexpected handshake in response")
 	}
 
-	glog.Infof("session key is: %v from %v", sessionKey, em.SessionKey)
-
-	// now decrypt the actual payload
-	payload, err := crypto.Decrypt(sessionKey, em.CipherText, em.IV)
+	payload, err := openMessage(em, sess, selfKey)
 	if err != nil {
-		glog.Infof("Invalid Ciphertext - ERR: %v\n", err)
-		return em, nil, nil, errors.Wrap(err, "invalid ciphertext")
+		return em, nil, nil, err
 	}
 
 	// now decode the request from the payload bytes
@@ -470,7 +935,9 @@ func decryptAndDecodeResponse(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedM
 	return em, response, payload, nil
 }
 
-func decryptAndDecodeRequest(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMessage, *Request, []byte, error) {
+// decryptAndDecodeRequest - read the next request, a handshake is returned
+// as it is, for the caller to set up the session with
+func decryptAndDecodeRequest(dec decoder, sess *session, selfKey *rsa.PrivateKey) (*EncryptedMessage, *Request, []byte, error) {
 	var em = new(EncryptedMessage)
 	err := dec.Decode(em)
 	if err != nil {
@@ -483,21 +950,13 @@ func decryptAndDecodeRequest(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMe
 		return em, nil, nil, errors.Wrap(err, "failure validating response: ")
 	}
 
-	// em now has our encrypted message,
-	// decrypt session key
-	sessionKey, err := crypto.DecryptRSA(selfKey, em.SessionKey)
-	if err != nil {
-		glog.Infof("Invalid Session Key - ERR: %v\n", err)
-		return em, nil, nil, errors.Wrap(err, "invalid session key")
+	if em.Handshake != nil {
+		return em, nil, nil, nil
 	}
 
-	glog.Infof("session key is: %v from %v", sessionKey, em.SessionKey)
-
-	// now decrypt the actual payload
-	payload, err := crypto.Decrypt(sessionKey, em.CipherText, em.IV)
+	payload, err := openMessage(em, sess, selfKey)
 	if err != nil {
-		glog.Infof("Invalid Ciphertext - ERR: %v\n", err)
-		return em, nil, nil, errors.Wrap(err, "invalid ciphertext")
+		return em, nil, nil, err
 	}
 
 	// now decode the request from the payload bytes
@@ -516,3 +975,41 @@ func decryptAndDecodeRequest(dec decoder, selfKey *rsa.PrivateKey) (*EncryptedMe
 	}
 	return em, request, payload, nil
 }
+
+// openMessage - decrypt the payload of em, with sess if it was sent over a
+// session, otherwise with the session key it carries, encrypted for selfKey
+func openMessage(em *EncryptedMessage, sess *session, selfKey *rsa.PrivateKey) ([]byte, error) {
+	if em.Version >= SessionVersion {
+		if sess == nil {
+			return nil, errors.New("message sent outside of a session")
+		}
+		payload, err := sess.open(em)
+		if err != nil {
+			glog.Infof("Invalid Ciphertext - ERR: %v\n", err)
+			return nil, errors.Wrap(err, "invalid ciphertext")
+		}
+		// the message is vouched for by the key the session was set up
+		// with
+		em.Header.PubKey = sess.peerKey
+		return payload, nil
+	}
+	if sess != nil {
+		return nil, errors.New("message sent outside of the session")
+	}
+
+	// em now has our encrypted message,
+	// decrypt session key
+	sessionKey, err := crypto.DecryptRSA(selfKey, em.SessionKey)
+	if err != nil {
+		glog.Infof("Invalid Session Key - ERR: %v\n", err)
+		return nil, errors.Wrap(err, "invalid session key")
+	}
+
+	// now decrypt the actual payload
+	payload, err := em.open(sessionKey)
+	if err != nil {
+		glog.Infof("Invalid Ciphertext - ERR: %v\n", err)
+		return nil, errors.Wrap(err, "invalid ciphertext")
+	}
+	return payload, nil
+}
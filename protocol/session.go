@@ -0,0 +1,251 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+const trafficKeyLen = 32
+
+// rekeyAfter - how many messages each end sends under a traffic key before
+// moving on to the next one
+var rekeyAfter uint64 = 1 << 16
+
+// Handshake - the key exchange at the start of a connection in the session
+// version of the protocol.  Each end sends an ephemeral key, signed with its
+// identity key, and the traffic keys for the rest of the connection are
+// derived from the two.  The ephemeral keys are thrown away once the
+// session is set up, so recorded traffic can not be read even if the
+// identity keys are later compromised.
+type Handshake struct {
+	EphemeralKey []byte
+	Timestamp    int64
+	// Audience - the id of the key the other end is expected to hold
+	Audience models.Identifier
+}
+
+// session - the traffic keys of a connection, one for each direction
+type session struct {
+	// peerKey - the identity key the other end set up the session with,
+	// which vouches for every message sent over it
+	peerKey *rsa.PublicKey
+	send    *trafficKey
+	recv    *trafficKey
+}
+
+// newSession - derive the traffic keys of a session from our ephemeral key
+// and the ephemeral key of the other end.  transcript is everything that
+// was signed in the handshake, so both ends only agree on the keys if they
+// saw the same handshake.
+func newSession(key *ecdh.PrivateKey, peerEphemeralKey, transcript []byte, peerKey *rsa.PublicKey, client bool) (*session, error) {
+	shared, err := crypto.SharedSecret(key, peerEphemeralKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := sha256.Sum256(transcript)
+	clientKey, err := newTrafficKey(shared, salt[:], "peerstore client traffic")
+	if err != nil {
+		return nil, err
+	}
+	serverKey, err := newTrafficKey(shared, salt[:], "peerstore server traffic")
+	if err != nil {
+		return nil, err
+	}
+	if client {
+		return &session{peerKey: peerKey, send: clientKey, recv: serverKey}, nil
+	}
+	return &session{peerKey: peerKey, send: serverKey, recv: clientKey}, nil
+}
+
+// seal - encrypt plaintext into em under the session
+func (s *session) seal(em *EncryptedMessage, plaintext []byte) error {
+	em.CipherText = s.send.aead.Seal(
+		nil, s.send.nonce(), plaintext, em.additionalData())
+	return s.send.advance()
+}
+
+// open - decrypt the plaintext of em, which has to be the next message the
+// other end sent under the session
+func (s *session) open(em *EncryptedMessage) ([]byte, error) {
+	plaintext, err := s.recv.aead.Open(
+		nil, s.recv.nonce(), em.CipherText, em.additionalData())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to authenticate message: ")
+	}
+	if err := s.recv.advance(); err != nil {
+		return nil, err
+	}
+	return plaintext, nil
+}
+
+// trafficKey - the key messages in one direction of a session are
+// encrypted with
+type trafficKey struct {
+	secret []byte
+	aead   cipher.AEAD
+	// seq - the number of messages sent under the key so far
+	seq uint64
+}
+
+// newTrafficKey - start using the key derived from secret, salt and info as
+// a traffic key
+func newTrafficKey(secret, salt []byte, info string) (*trafficKey, error) {
+	secret, err := crypto.HKDF(secret, salt, info, trafficKeyLen)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := crypto.NewGCM(secret)
+	if err != nil {
+		return nil, err
+	}
+	return &trafficKey{secret: secret, aead: aead}, nil
+}
+
+// nonce - the nonce of the next message, which is its place in the
+// session, so a message can not be dropped, replayed or sent out of order
+// without the ones after it failing to open
+func (tk *trafficKey) nonce() []byte {
+	nonce := make([]byte, tk.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], tk.seq)
+	return nonce
+}
+
+// advance - move on to the next message, and to the next key once the
+// current one has been used rekeyAfter times.  The next key is derived from
+// the current one, which is then forgotten.
+func (tk *trafficKey) advance() error {
+	tk.seq++
+	if tk.seq < rekeyAfter {
+		return nil
+	}
+	next, err := newTrafficKey(tk.secret, nil, "peerstore rekey")
+	if err != nil {
+		return errors.Wrap(err, "failed to rekey: ")
+	}
+	*tk = *next
+	return nil
+}
+
+// handshakeTranscript - what of a handshake message gets signed, which is
+// all of it but the signature
+func handshakeTranscript(em *EncryptedMessage) []byte {
+	unsigned := *em
+	unsigned.Header.Signature = nil
+
+	var buf = bytes.NewBuffer(unsigned.additionalData())
+	var size, timestamp [8]byte
+	binary.BigEndian.PutUint64(size[:], uint64(len(em.Handshake.EphemeralKey)))
+	binary.BigEndian.PutUint64(timestamp[:], uint64(em.Handshake.Timestamp))
+	buf.Write(size[:])
+	buf.Write(em.Handshake.EphemeralKey)
+	buf.Write(timestamp[:])
+	buf.Write(em.Handshake.Audience[:])
+	return buf.Bytes()
+}
+
+// newHandshake - a handshake message from the holder of key, with a fresh
+// ephemeral key, meant for the holder of the key with id audience
+func newHandshake(t CallerType, from models.Identifier, key *rsa.PrivateKey, audience models.Identifier) (*EncryptedMessage, *ecdh.PrivateKey, error) {
+	ephemeralKey, err := crypto.GenerateEphemeralKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &EncryptedMessage{
+		Version: SessionVersion,
+		Header: Header{
+			Type:   t,
+			From:   from,
+			PubKey: publicKey(key),
+		},
+		Handshake: &Handshake{
+			EphemeralKey: ephemeralKey.PublicKey().Bytes(),
+			Timestamp:    time.Now().UnixNano(),
+			Audience:     audience,
+		},
+	}, ephemeralKey, nil
+}
+
+// clientHandshake - set up a session over pc with the server holding
+// peerKey, proving we hold selfKey
+func clientHandshake(pc *pooledConn, t CallerType, from models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*session, error) {
+	audience, err := crypto.KeyID(peerKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive server id: ")
+	}
+	hello, ephemeralKey, err := newHandshake(t, from, selfKey, audience)
+	if err != nil {
+		return nil, err
+	}
+	if hello.Header.Signature, err = crypto.Sign(selfKey, handshakeTranscript(hello)); err != nil {
+		return nil, err
+	}
+	if err := pc.enc.Encode(hello); err != nil {
+		return nil, errors.Wrap(err, "failed to send handshake: ")
+	}
+
+	var reply = new(EncryptedMessage)
+	if err := pc.dec.Decode(reply); err != nil {
+		return nil, errors.Wrap(err, "failed to read handshake: ")
+	}
+	if reply.Versions != nil {
+		return nil, &versionError{version: SessionVersion, accepted: reply.Versions}
+	}
+	if reply.Handshake == nil {
+		return nil, errors.New("server did not answer the handshake")
+	}
+	transcript := append(handshakeTranscript(hello), handshakeTranscript(reply)...)
+	if err := crypto.Verify(peerKey, reply.Header.Signature, transcript); err != nil {
+		return nil, errors.Wrap(err, "server failed to prove its identity: ")
+	}
+	return newSession(ephemeralKey, reply.Handshake.EphemeralKey, transcript, peerKey, true)
+}
+
+// acceptHandshake - answer the handshake a client started with hello, and
+// set up a session with it
+func (s *Server) acceptHandshake(enc encoder, hello *EncryptedMessage) (*session, error) {
+	if hello.Header.PubKey == nil {
+		return nil, errors.New("handshake is missing the client key")
+	}
+	if err := crypto.Verify(
+		hello.Header.PubKey, hello.Header.Signature, handshakeTranscript(hello)); err != nil {
+		return nil, errors.Wrap(err, "failed to verify handshake: ")
+	}
+	if hello.Handshake.Audience != s.id {
+		return nil, errors.New("handshake is meant for another server")
+	}
+	// the ephemeral key is random, so it doubles as the nonce of the
+	// handshake
+	if len(hello.Handshake.EphemeralKey) < NonceSize {
+		return nil, errors.New("handshake has an invalid ephemeral key")
+	}
+	if err := s.replay.check(hello.Handshake.EphemeralKey[:NonceSize],
+		time.Unix(0, hello.Handshake.Timestamp), time.Now()); err != nil {
+		return nil, err
+	}
+
+	clientID, err := crypto.KeyID(hello.Header.PubKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to derive client id: ")
+	}
+	reply, ephemeralKey, err := newHandshake(NodeType, s.id, s.PrivateKey, clientID)
+	if err != nil {
+		return nil, err
+	}
+	transcript := append(handshakeTranscript(hello), handshakeTranscript(reply)...)
+	if reply.Header.Signature, err = crypto.Sign(s.PrivateKey, transcript); err != nil {
+		return nil, err
+	}
+	if err := enc.Encode(reply); err != nil {
+		return nil, errors.Wrap(err, "failed to answer handshake: ")
+	}
+	return newSession(ephemeralKey, hello.Handshake.EphemeralKey, transcript, hello.Header.PubKey, false)
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func TestSession(t *testing.T) {
+	network := NewMemoryNetwork()
+	// rekey every few messages, so the test crosses a few keys
+	defer func(n uint64) { rekeyAfter = n }(rekeyAfter)
+	rekeyAfter = 3
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "session-server", t.TempDir(), 4, 4)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	s.Handle(PingMethod, s.PingHandler)
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	tr, err := NewTransportWithTimeout(
+		network, "tcp", "session-server", NodeType, s.id, &key.PublicKey, key, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+
+	// one connection at a time, so every ping goes over the same session
+	for i := 0; i < 10; i++ {
+		resp, err := tr.RoundTrip(&Request{
+			Header: Header{From: s.id, Type: NodeType},
+			Method: PingMethod,
+		})
+		if err != nil || resp.Status != Success {
+			t.Fatalf("ping %d failed: %v, %+v", i, err, resp)
+		}
+	}
+	pc := network.Pool().get(tr.key)
+	if pc == nil || pc.session == nil {
+		t.Fatal("expected the pooled connection to keep its session")
+	}
+	if pc.session.send.seq >= rekeyAfter {
+		t.Errorf("expected the traffic key to be rekeyed, seq is %d", pc.session.send.seq)
+	}
+	pc.Close()
+
+	// a server which can not prove it holds the expected key is refused
+	other, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the transport connects as soon as it is created, which is when the
+	// handshake fails
+	impostor, err := NewTransportWithTimeout(
+		network, "tcp", "session-server", NodeType, s.id, &other.PublicKey, key, 5*time.Second)
+	if err == nil {
+		impostor.Close()
+		t.Error("expected the handshake with the wrong server key to fail")
+	}
+}
@@ -0,0 +1,139 @@
+package protocol
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func TestShutdown(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// start - serve with a single worker, slow pings are answered once
+	// release is closed
+	start := func(addr string) (*Server, chan struct{}, chan struct{}, chan struct{}) {
+		s, err := NewServer(network, key, nil, addr, t.TempDir(), 4, 1)
+		if err != nil {
+			t.Fatalf("failed to create server: %v", err)
+		}
+		started, release := make(chan struct{}, 4), make(chan struct{})
+		s.Handle(PingMethod, func(ctx context.Context, r *Request) Response {
+			if string(r.Data) == "slow" {
+				started <- struct{}{}
+				<-release
+			}
+			return Response{Status: Success}
+		})
+		served := make(chan struct{})
+		go func() {
+			s.Serve(make(chan bool), make(chan bool))
+			close(served)
+		}()
+		return s, started, release, served
+	}
+	ping := func(s *Server, data string) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			tr, err := NewTransportWithTimeout(
+				network, "tcp", s.addr, NodeType, s.id, &key.PublicKey, key, 5*time.Second)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer tr.Close()
+			_, err = tr.RoundTrip(&Request{
+				Header: Header{From: s.id, Type: NodeType},
+				Method: PingMethod,
+				Data:   []byte(data),
+			})
+			errs <- err
+		}()
+		return errs
+	}
+	shutdown := func(s *Server, timeout time.Duration) chan error {
+		errs := make(chan error, 1)
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			errs <- s.Shutdown(ctx)
+		}()
+		return errs
+	}
+
+	s, started, release, served := start("shutdown-server")
+	if err := <-ping(s, "fast"); err != nil {
+		t.Fatalf("failed to ping: %v", err)
+	}
+	idle, err := network.Dial("tcp", s.addr, &key.PublicKey, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+
+	// one request is being answered, and another is queued behind it
+	inFlight := ping(s, "slow")
+	<-started
+	queued := ping(s, "slow")
+	for deadline := time.Now().Add(5 * time.Second); len(s.requestChan) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("request was never queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	hooked := make(chan struct{})
+	s.OnShutdown(func(ctx context.Context) {
+		// the hook is bound by the deadline of the shutdown
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("expected the hook to be given the shutdown deadline")
+		}
+		close(hooked)
+	})
+	stopped := shutdown(s, 5*time.Second)
+	<-hooked
+
+	// idle connections are hung up on, and no new ones are accepted
+	idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := idle.Read(make([]byte, 1)); err == nil {
+		t.Error("expected the idle connection to be closed")
+	}
+	if err := <-ping(s, "fast"); err == nil {
+		t.Error("expected a new connection to be refused")
+	}
+	select {
+	case err := <-stopped:
+		t.Fatalf("expected shutdown to wait on the requests, got %v", err)
+	default:
+	}
+
+	// the requests which were read are answered before shutting down
+	close(release)
+	if err := <-inFlight; err != nil {
+		t.Errorf("expected the request in flight to be answered: %v", err)
+	}
+	if err := <-queued; err != nil {
+		t.Errorf("expected the queued request to be answered: %v", err)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("expected a clean shutdown: %v", err)
+	}
+	<-served
+
+	// requests still being answered at the deadline are hung up on
+	s, started, release, served = start("stuck-server")
+	defer close(release)
+	stuck := ping(s, "slow")
+	<-started
+	if err := <-shutdown(s, 100*time.Millisecond); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to give up on the stuck request, got %v", err)
+	}
+	if err := <-stuck; err == nil {
+		t.Error("expected the stuck request to fail")
+	}
+}
@@ -0,0 +1,245 @@
+package protocol
+
+import (
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"io"
+	"io/ioutil"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	gob.Register(Frame{})
+}
+
+const (
+	// FrameSize - the most data carried by one frame of a stream
+	FrameSize = 64 * 1024
+	// streamKeyLen - the length of a stream key, an aes256 key
+	streamKeyLen = 32
+	// legacyStreamKeyLen - the length of a stream key of a LegacyVersion
+	// message, an aes256 key followed by a key for the frame MACs
+	legacyStreamKeyLen = 64
+)
+
+// Frame - one chunk of the stream following a request or response whose
+// body is too big to send in Data.  Frames are encrypted with the stream key
+// carried in the message they follow, which was itself encrypted for the
+// receiver.  Frames are numbered and the last is marked, and both are
+// authenticated along with the data, so frames can not be dropped,
+// reordered, or the stream cut short.  Frames are sealed with aes256 in gcm
+// mode, the nonce carried in IV, streams following LegacyVersion messages
+// are encrypted in cbc mode under a MAC.
+type Frame struct {
+	Seq        uint64
+	End        bool
+	IV         []byte
+	CipherText []byte
+	MAC        []byte
+}
+
+// keyLen - the length of the key of a stream following a message in version
+func keyLen(version uint8) int {
+	if version == LegacyVersion {
+		return legacyStreamKeyLen
+	}
+	return streamKeyLen
+}
+
+// newStreamKey - generate a key for a new stream following a message in
+// version
+func newStreamKey(version uint8) ([]byte, error) {
+	key := make([]byte, keyLen(version))
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate stream key: ")
+	}
+	return key, nil
+}
+
+// frameHeader - the position of a frame in the stream, authenticated along
+// with its data
+func frameHeader(f *Frame) []byte {
+	header := make([]byte, 9)
+	binary.BigEndian.PutUint64(header[:8], f.Seq)
+	if f.End {
+		header[8] = 1
+	}
+	return header
+}
+
+// frameMAC - the MAC over everything in a LegacyVersion frame
+func frameMAC(key []byte, f *Frame) []byte {
+	mac := hmac.New(sha256.New, key[32:])
+	mac.Write(frameHeader(f))
+	mac.Write(f.IV)
+	mac.Write(f.CipherText)
+	return mac.Sum(nil)
+}
+
+// sealFrame - encrypt data into f, as version does
+func sealFrame(version uint8, key []byte, f *Frame, data []byte) error {
+	var err error
+	if version == LegacyVersion {
+		f.CipherText, f.IV, err = crypto.Encrypt(key[:32], data)
+		if err != nil {
+			return err
+		}
+		f.MAC = frameMAC(key, f)
+		return nil
+	}
+	f.CipherText, f.IV, err = crypto.EncryptGCM(key, data, frameHeader(f))
+	return err
+}
+
+// openFrame - check and decrypt the data of f, as version does
+func openFrame(version uint8, key []byte, f *Frame) ([]byte, error) {
+	if version == LegacyVersion {
+		if !hmac.Equal(f.MAC, frameMAC(key, f)) {
+			return nil, errors.New("frame failed verification")
+		}
+		if len(f.IV) != aes.BlockSize {
+			return nil, errors.New("frame has an invalid iv")
+		}
+		return crypto.Decrypt(key[:32], f.CipherText, f.IV)
+	}
+	return crypto.DecryptGCM(key, f.CipherText, f.IV, frameHeader(f))
+}
+
+// writeStream - send everything read from body as frames following a
+// message in version, ending with an empty frame marked as the end.  extend,
+// if not nil, is called before every frame, to push back any deadline on the
+// connection.
+func writeStream(enc encoder, version uint8, key []byte, body io.Reader, extend func() error) error {
+	if len(key) != keyLen(version) {
+		return errors.New("stream key is the wrong size")
+	}
+	buf := make([]byte, FrameSize)
+	for seq := uint64(0); ; seq++ {
+		n, err := io.ReadFull(body, buf)
+		end := err == io.EOF || err == io.ErrUnexpectedEOF
+		if err != nil && !end {
+			return errors.Wrap(err, "failed to read stream body: ")
+		}
+		if end && n > 0 {
+			// send what we have, and the end marker after it
+			if err := writeFrame(enc, version, key, seq, false, buf[:n], extend); err != nil {
+				return err
+			}
+			seq++
+			n = 0
+		}
+		if err := writeFrame(enc, version, key, seq, end, buf[:n], extend); err != nil {
+			return err
+		}
+		if end {
+			return nil
+		}
+	}
+}
+
+// writeFrame - encrypt and send a single frame
+func writeFrame(enc encoder, version uint8, key []byte, seq uint64, end bool, data []byte, extend func() error) error {
+	f := &Frame{
+		Seq: seq,
+		End: end,
+	}
+	if err := sealFrame(version, key, f, append([]byte{}, data...)); err != nil {
+		return errors.Wrap(err, "failed to encrypt frame: ")
+	}
+	if extend != nil {
+		if err := extend(); err != nil {
+			return errors.Wrap(err, "failed to extend deadline: ")
+		}
+	}
+	if err := enc.Encode(f); err != nil {
+		return errors.Wrap(err, "failed to encode frame: ")
+	}
+	return nil
+}
+
+// streamReader - reads the body of a request or response from the frames
+// following it
+type streamReader struct {
+	dec     decoder
+	version uint8
+	key     []byte
+	seq     uint64
+	buf     []byte
+	err     error
+	extend  func() error
+}
+
+// newStreamReader - read the frames of the stream with key, following a
+// message in version, off dec.  extend, if not nil, is called before every
+// frame, to push back any deadline on the connection.
+func newStreamReader(dec decoder, version uint8, key []byte, extend func() error) *streamReader {
+	sr := &streamReader{
+		dec:     dec,
+		version: version,
+		key:     key,
+		extend:  extend,
+	}
+	if len(key) != keyLen(version) {
+		sr.err = errors.New("stream key is the wrong size")
+	}
+	return sr
+}
+
+// Read - read the body, io.EOF is only returned once the end frame has
+// arrived
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for len(sr.buf) == 0 {
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		sr.buf, sr.err = sr.next()
+	}
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+	return n, nil
+}
+
+// next - read and check the next frame
+func (sr *streamReader) next() ([]byte, error) {
+	if sr.extend != nil {
+		if err := sr.extend(); err != nil {
+			return nil, errors.Wrap(err, "failed to extend deadline: ")
+		}
+	}
+	f := new(Frame)
+	if err := sr.dec.Decode(f); err != nil {
+		return nil, errors.Wrap(err, "failed to decode frame: ")
+	}
+	data, err := openFrame(sr.version, sr.key, f)
+	if err != nil {
+		return nil, errors.Wrap(err, "frame failed verification: ")
+	}
+	if f.Seq != sr.seq {
+		return nil, errors.Errorf("expected frame %d, got %d", sr.seq, f.Seq)
+	}
+	sr.seq++
+	if f.End {
+		return data, io.EOF
+	}
+	return data, nil
+}
+
+// finished - whether the whole stream has been read
+func (sr *streamReader) finished() bool {
+	return sr.err == io.EOF && len(sr.buf) == 0
+}
+
+// drain - read whatever is left of the stream, so the next message on the
+// connection can be read
+func (sr *streamReader) drain() error {
+	if _, err := io.Copy(ioutil.Discard, sr); err != nil {
+		return errors.Wrap(err, "failed to drain stream: ")
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package protocol
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	network := NewMemoryNetwork()
+
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "stream-server", t.TempDir(), 16, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	// answer with the body of the request
+	s.Handle(PostFileMethod, func(ctx context.Context, r *Request) Response {
+		data, err := ioutil.ReadAll(r.Body())
+		if err != nil {
+			return NewErrorResponse(Internal, "failed to read body")
+		}
+		response := Response{Status: Success}
+		response.SetBody(bytes.NewReader(data))
+		return response
+	})
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+
+	tr, err := NewTransportWithTimeout(
+		network, "tcp", "stream-server", NodeType, s.id, &key.PublicKey, key, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to create transport: %v", err)
+	}
+	defer tr.Close()
+
+	body := make([]byte, 10*FrameSize+123)
+	rand.Read(body)
+	newRequest := func() *Request {
+		r := &Request{
+			Header: Header{From: s.id, Type: NodeType},
+			Method: PostFileMethod,
+		}
+		r.SetBody(bytes.NewReader(body))
+		return r
+	}
+
+	resp, err := tr.RoundTripStream(newRequest())
+	if err != nil || resp.Status != Success {
+		t.Fatalf("stream round trip failed: %v, %+v", err, resp.Status)
+	}
+	data, err := ioutil.ReadAll(resp.Body())
+	resp.Close()
+	if err != nil || !bytes.Equal(data, body) {
+		t.Errorf("streamed body differs, read %d bytes: %v", len(data), err)
+	}
+
+	// the connection went back to the pool, and RoundTrip reads the stream
+	// into Data
+	resp, err = tr.RoundTrip(newRequest())
+	if err != nil || resp.Status != Success || !bytes.Equal(resp.Data, body) {
+		t.Errorf("round trip failed: %v, read %d bytes", err, len(resp.Data))
+	}
+	network.Pool().mu.Lock()
+	idle := len(network.Pool().idle[tr.key])
+	network.Pool().mu.Unlock()
+	if idle != 1 {
+		t.Errorf("expected the connection to be reused, %d are idle", idle)
+	}
+}
+
+func TestStreamFrames(t *testing.T) {
+	for _, version := range []uint8{LegacyVersion, GCMVersion} {
+		key, err := newStreamKey(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf = new(bytes.Buffer)
+		if err := writeStream(gob.NewEncoder(buf), version, key,
+			bytes.NewReader([]byte("frames")), nil); err != nil {
+			t.Fatalf("version %d failed to write stream: %v", version, err)
+		}
+		dec := gob.NewDecoder(buf)
+		f, end := new(Frame), new(Frame)
+		if err := dec.Decode(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := dec.Decode(end); err != nil {
+			t.Fatal(err)
+		}
+
+		// a frame passed off as the end of the stream is rejected
+		f.End = true
+		if _, err := openFrame(version, key, f); err == nil {
+			t.Errorf("version %d accepted a frame with a changed end", version)
+		}
+		f.End = false
+		if data, err := openFrame(version, key, f); err != nil || string(data) != "frames" {
+			t.Errorf("version %d failed to open frame: %v", version, err)
+		}
+		if _, err := openFrame(version, key, end); err != nil {
+			t.Errorf("version %d failed to open end frame: %v", version, err)
+		}
+	}
+}
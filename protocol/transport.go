@@ -1,12 +1,18 @@
 package protocol
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/rsa"
+	"encoding/binary"
 	"encoding/gob"
-	"net"
+	"io/ioutil"
+	"sync"
+	"time"
 
 	"github.com/golang/glog"
+	"github.com/husobee/peerstore/crypto"
 	"github.com/husobee/peerstore/models"
 	"github.com/pkg/errors"
 )
@@ -29,56 +35,318 @@ type decoder interface {
 }
 
 // Transport - a transport structure that will implement RoundTripper
-// transport will also handle all encryption/decryption of the messages
+// transport will also handle all encryption/decryption of the messages.
+// Connections are taken from the pool of the network for each round trip and
+// put back afterwards, so RoundTrip can be called from many goroutines at once.
 type Transport struct {
 	Type    CallerType
-	conn    net.Conn
+	network Network
+	proto   string
+	addr    string
 	from    models.Identifier
 	peerKey *rsa.PublicKey
 	selfKey *rsa.PrivateKey
-	enc     encoder
-	dec     decoder
+	timeout time.Duration
+	key     poolKey
+	// conn - the connection set up when the transport was created, held
+	// for the first round trip
+	conn   *pooledConn
+	connMu *sync.Mutex
 }
 
-// Close - close the connection transport
+// Close - close the connection transport, the connection is put back in the
+// pool if it was never used
 func (t *Transport) Close() {
+	if t == nil || t.connMu == nil {
+		return
+	}
+	t.connMu.Lock()
+	defer t.connMu.Unlock()
 	if t.conn != nil {
-		t.conn.Close()
+		t.network.Pool().put(t.key, t.conn)
 		t.conn = nil
 	}
 }
 
-// NewTransport - create a new transport structure
-func NewTransport(proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*Transport, error) {
-	conn, err := net.Dial(proto, addr)
-	enc := gob.NewEncoder(conn)
-	dec := gob.NewDecoder(conn)
-	return &Transport{
+// NewTransport - create a new transport structure, dialing over network
+func NewTransport(network Network, proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*Transport, error) {
+	return newTransport(context.Background(), network, proto, addr, t, id, peerKey, selfKey, 0)
+}
+
+// NewTransportContext - create a new transport structure, giving up on the
+// connection once ctx is done
+func NewTransportContext(ctx context.Context, network Network, proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey) (*Transport, error) {
+	return newTransport(ctx, network, proto, addr, t, id, peerKey, selfKey, 0)
+}
+
+// NewTransportWithTimeout - create a new transport structure, giving up on
+// the connection, as well as any round trip on it, after timeout
+func NewTransportWithTimeout(network Network, proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey, timeout time.Duration) (*Transport, error) {
+	transport, err := newTransport(context.Background(), network, proto, addr, t, id, peerKey, selfKey, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// newTransport - create a new transport, and make sure we can reach addr
+// by setting up the connection for the first round trip, a zero timeout
+// never gives up
+func newTransport(ctx context.Context, network Network, proto, addr string, t CallerType, id models.Identifier, peerKey *rsa.PublicKey, selfKey *rsa.PrivateKey, timeout time.Duration) (*Transport, error) {
+	transport := &Transport{
 		Type:    t,
-		conn:    conn,
-		enc:     enc,
-		dec:     dec,
-		selfKey: selfKey,
-		peerKey: peerKey,
+		network: network,
+		proto:   proto,
+		addr:    addr,
 		from:    id,
-	}, err
+		peerKey: peerKey,
+		selfKey: selfKey,
+		timeout: timeout,
+		key:     newPoolKey(addr, peerKey, selfKey),
+		connMu:  new(sync.Mutex),
+	}
+	conn, err := transport.connect(ctx)
+	transport.conn = conn
+	return transport, err
+}
+
+// connect - an idle connection from the pool, or a new one, giving up on
+// dialing it once ctx is done.  A new connection falls back to older
+// versions of the protocol until one is found the peer accepts.
+func (t *Transport) connect(ctx context.Context) (*pooledConn, error) {
+	if pc := t.network.Pool().get(t.key); pc != nil {
+		return pc, nil
+	}
+	for {
+		version := t.network.Pool().version(t.key)
+		pc, err := t.dial(ctx, version)
+		if err == nil || !t.fallBack(err, version, true) {
+			return pc, err
+		}
+	}
+}
+
+// dial - a new connection, speaking version of the protocol
+func (t *Transport) dial(ctx context.Context, version uint8) (*pooledConn, error) {
+	timeout := t.timeout
+	if deadline := earliestDeadline(ctx, t.timeout); !deadline.IsZero() {
+		if timeout = time.Until(deadline); timeout <= 0 {
+			return nil, errors.Wrap(context.DeadlineExceeded, "failed to dial: ")
+		}
+	}
+	conn, err := t.network.Dial(t.proto, t.addr, publicKey(t.selfKey), timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial: ")
+	}
+	pc := newPooledConn(conn)
+	pc.version = version
+	if version >= SessionVersion {
+		if err := t.handshake(ctx, pc); err != nil {
+			pc.Close()
+			return nil, err
+		}
+	}
+	return pc, nil
+}
+
+// handshake - set up the session the rest of the messages over pc are
+// encrypted with
+func (t *Transport) handshake(ctx context.Context, pc *pooledConn) error {
+	cd := newConnDeadline(ctx, pc, t.timeout)
+	if err := cd.extend(); err != nil {
+		cd.done()
+		return errors.Wrap(err, "failed to set deadline: ")
+	}
+	sess, err := clientHandshake(pc, t.Type, t.from, t.peerKey, t.selfKey)
+	if !cd.done() && err == nil {
+		err = errors.New("failed to clear deadline")
+	}
+	if err != nil {
+		return errors.Wrap(cd.err(err), "failed handshake: ")
+	}
+	pc.session = sess
+	return nil
+}
+
+// acquire - the connection to use for a round trip, the one held since the
+// transport was created if no other round trip has taken it
+func (t *Transport) acquire(ctx context.Context) (*pooledConn, error) {
+	t.connMu.Lock()
+	pc := t.conn
+	t.conn = nil
+	t.connMu.Unlock()
+	if pc != nil {
+		return pc, nil
+	}
+	return t.connect(ctx)
 }
 
 // RoundTrip - Implementation of a round tripper interface,
 // effectively this is how the request will be serialized,
-// and put on the wire, and how the response will be deserialized
+// and put on the wire, and how the response will be deserialized.
+// A streamed response is read into Data, use RoundTripStream to read it as
+// it arrives, rather than holding all of it in memory.  If the request
+// failed on the server the response is returned along with a
+// *ResponseError saying why.
 func (t *Transport) RoundTrip(request *Request) (Response, error) {
-	err := encryptAndEncode(t.enc, request, t.Type, t.peerKey, t.from, t.selfKey)
+	return t.RoundTripContext(context.Background(), request)
+}
+
+// RoundTripContext - perform the request like RoundTrip, giving up on it
+// once ctx is done, in which case the error of ctx is returned.  The
+// deadline of ctx is sent along with the request, so the server gives up on
+// it as well.
+func (t *Transport) RoundTripContext(ctx context.Context, request *Request) (Response, error) {
+	response, err := t.roundTrip(ctx, request)
+	if err != nil {
+		return response, err
+	}
+	if response.StreamKey != nil {
+		data, err := ioutil.ReadAll(response.Body())
+		response.Close()
+		if err != nil {
+			return Response{}, errors.Wrap(contextError(ctx, err), "failure reading response stream: ")
+		}
+		response.Data = data
+		response.body = nil
+	}
+	return response, nil
+}
+
+// RoundTripStream - perform the request like RoundTrip, but leave a streamed
+// response to be read from its Body, the response has to be closed once the
+// caller is done with it
+func (t *Transport) RoundTripStream(request *Request) (Response, error) {
+	return t.RoundTripStreamContext(context.Background(), request)
+}
+
+// RoundTripStreamContext - perform the request like RoundTripStream, giving
+// up on it, and on reading the streamed response, once ctx is done
+func (t *Transport) RoundTripStreamContext(ctx context.Context, request *Request) (Response, error) {
+	return t.roundTrip(ctx, request)
+}
+
+// roundTrip - send the request, streaming its body after it if it has one,
+// and read the response, leaving any stream following it unread
+func (t *Transport) roundTrip(ctx context.Context, request *Request) (Response, error) {
+	original := request
+	if err := ctx.Err(); err != nil {
+		return Response{}, errors.Wrap(err, "failure connecting: ")
+	}
+	pc, err := t.acquire(ctx)
+	if err != nil {
+		return Response{}, errors.Wrap(err, "failure connecting: ")
+	}
+	// streams can take much longer than a single message, so the timeout
+	// applies to each frame of them, the deadline of ctx to all of it
+	cd := newConnDeadline(ctx, pc, t.timeout)
+	fail := func() {
+		cd.done()
+		pc.Close()
+	}
+	if err := cd.extend(); err != nil {
+		fail()
+		return Response{}, errors.Wrap(err, "failed to set deadline: ")
+	}
+
+	// stamp a copy of the request, so the same request can be sent again
+	stamped := *request
+	if stamped.Header.Nonce, err = newNonce(); err != nil {
+		fail()
+		return Response{}, err
+	}
+	stamped.Header.Timestamp = time.Now().UnixNano()
+	stamped.Header.Audience = models.Identifier(t.key.peer)
+	if deadline, ok := ctx.Deadline(); ok {
+		stamped.Header.Timeout = int64(time.Until(deadline))
+	}
+	if request.body != nil {
+		if stamped.StreamKey, err = newStreamKey(pc.version); err != nil {
+			fail()
+			return Response{}, err
+		}
+	}
+	request = &stamped
+	err = encryptAndEncode(pc.enc, pc.session, request, pc.version, t.Type, t.peerKey, t.from, t.selfKey)
+	if err == nil && request.body != nil {
+		err = writeStream(pc.enc, pc.version, request.StreamKey, request.body, cd.extend)
+	}
 	if err != nil {
+		// the gob stream is broken part way through a message, so the
+		// connection can not be used again
+		fail()
 		glog.Infof("failed to encrypt and encode in roundtrip: %s", err)
-		return Response{}, errors.Wrap(err, "failure encoding request: ")
+		return Response{}, errors.Wrap(cd.err(err), "failure encoding request: ")
 	}
-	_, response, _, err := decryptAndDecodeResponse(t.dec, t.selfKey)
+	em, response, _, err := decryptAndDecodeResponse(pc.dec, pc.session, t.selfKey)
 	if err != nil {
+		fail()
 		glog.Infof("failed to decrypt and decode in roundtrip: %s", err)
-		return Response{}, errors.Wrap(err, "failure decoding response: ")
+		// a connection with a session has already been accepted in its
+		// version by the handshake, and a body which has been sent can not
+		// be sent again
+		fresh := !pc.answered && pc.session == nil
+		if request.body == nil && t.fallBack(err, pc.version, fresh) {
+			return t.roundTrip(ctx, original)
+		}
+		return Response{}, errors.Wrap(cd.err(err), "failure decoding response: ")
+	}
+	pc.answered = true
+
+	if response.StreamKey != nil {
+		// the connection goes back to the pool once the stream is read
+		response.body = &responseStream{
+			streamReader: newStreamReader(pc.dec, em.Version, response.StreamKey, cd.extend),
+			transport:    t,
+			conn:         pc,
+			deadline:     cd,
+		}
+	} else {
+		t.release(pc, cd)
 	}
-	return *response, err
+	if err := response.Err(); err != nil {
+		// nobody is going to read the body of a failed request
+		response.Close()
+		response.body = nil
+		return *response, err
+	}
+	return *response, nil
+}
+
+// release - put a connection back in the pool after a round trip, unless
+// the round trip was given up on part way through
+func (t *Transport) release(pc *pooledConn, cd *connDeadline) {
+	if !cd.done() {
+		pc.Close()
+		return
+	}
+	t.network.Pool().put(t.key, pc)
+}
+
+// responseStream - the body of a streamed response, which holds on to the
+// connection it is read from until it is closed
+type responseStream struct {
+	*streamReader
+	transport *Transport
+	conn      *pooledConn
+	deadline  *connDeadline
+}
+
+// Close - put the connection back in the pool if the whole stream was read,
+// otherwise the rest of the stream is still on its way, so the connection
+// is closed rather than read through
+func (rs *responseStream) Close() error {
+	if rs.conn == nil {
+		return nil
+	}
+	if rs.finished() {
+		rs.transport.release(rs.conn, rs.deadline)
+	} else {
+		rs.deadline.done()
+		rs.conn.Close()
+	}
+	rs.conn = nil
+	return nil
 }
 
 type CallerType uint8
@@ -95,6 +363,7 @@ type Header struct {
 	Key          models.Identifier
 	From         models.Identifier
 	FromAddr     string
+	To           models.Identifier
 	Type         CallerType
 	PubKey       *rsa.PublicKey
 	SignedBy     models.Identifier
@@ -105,6 +374,16 @@ type Header struct {
 	Clock        uint64
 	Secret       []byte
 	SharedWith   []SharedSecret
+	// Nonce, Timestamp and Audience - set by the transport on every
+	// request, and signed along with it, so the server can turn away a
+	// request it has seen before, or which was meant for another server
+	Nonce     []byte
+	Timestamp int64
+	Audience  models.Identifier
+	// Timeout - how long the sender will wait on the response, in
+	// nanoseconds, the server gives up on the request once it has passed.
+	// Zero if the sender waits as long as the server lets it.
+	Timeout int64
 }
 
 type SharedSecret struct {
@@ -117,26 +396,124 @@ func (h *Header) Validate() error {
 	return nil
 }
 
+const (
+	// LegacyVersion - messages from peers which predate versioning, which
+	// are encrypted with aes256 in cbc mode, nothing but the signature over
+	// the plaintext vouching for them
+	LegacyVersion uint8 = 0
+	// GCMVersion - messages encrypted with aes256 in gcm mode, with the
+	// header of the message authenticated along with the ciphertext
+	GCMVersion uint8 = 1
+	// SessionVersion - connections start with a Handshake, and messages
+	// are encrypted with the traffic keys agreed on in it, rather than each
+	// being signed and given a key of its own with rsa
+	SessionVersion uint8 = 2
+	// LatestVersion - the newest version of the protocol we understand
+	LatestVersion = SessionVersion
+)
+
+var (
+	// SendVersion - the version of the protocol requests are first sent
+	// with, servers answer in the version they were asked in.  Peers which
+	// do not accept it are fallen back to older versions, down to
+	// MinVersion, see fallBack.
+	SendVersion = LatestVersion
+	// MinVersion - the oldest version of the protocol we accept messages
+	// in, or fall back to sending in.  Lower this to LegacyVersion while
+	// some of the peers we talk to are yet to be upgraded.
+	MinVersion = GCMVersion
+)
+
 // EncryptedMessage - this will be the "wrapper" to add
 // encryption to the messages.  The transport will pack
 // the existing request/response into this encrypted message
 type EncryptedMessage struct {
+	// Version - how the message is encrypted, peers which predate it
+	// leave it out, which decodes as LegacyVersion
+	Version    uint8
 	Header     Header
 	SessionKey []byte
 	IV         []byte
 	CipherText []byte
+	// Handshake - set on the messages setting up a session
+	Handshake *Handshake
+	// Versions - set by a server in place of an answer to a message in a
+	// version it does not accept
+	Versions *VersionRange
 }
 
 // Validate - Implement validate for the header validation
 func (em *EncryptedMessage) Validate() error {
+	if em.Version < MinVersion || em.Version > LatestVersion {
+		return &versionError{version: em.Version}
+	}
+	if em.Version >= SessionVersion {
+		// the keys are those of the session the message is sent over
+		if em.Handshake == nil && len(em.CipherText) == 0 {
+			return errors.New("invalid ciphertext in encrypted message")
+		}
+		return nil
+	}
+	if em.Handshake != nil {
+		return errors.New("handshake in a protocol version without sessions")
+	}
 	if em.SessionKey == nil || len(em.SessionKey) == 0 {
 		return errors.New("invalid session id in encrypted message")
 	}
 	if em.IV == nil || len(em.IV) == 0 {
 		return errors.New("invalid iv in encrypted message")
 	}
-	if em.CipherText == nil || len(em.CipherText)%aes.BlockSize != 0 {
+	if em.Version == LegacyVersion &&
+		(em.CipherText == nil || len(em.CipherText)%aes.BlockSize != 0) {
 		return errors.New("invalid ciphertext in encrypted message")
 	}
 	return nil
 }
+
+// additionalData - everything in the message but the ciphertext, which is
+// authenticated along with it.  Each field is written out in a fixed order,
+// as gob output depends on what else the encoding process has seen.
+func (em *EncryptedMessage) additionalData() []byte {
+	var buf = new(bytes.Buffer)
+	writeField := func(b []byte) {
+		var size [4]byte
+		binary.BigEndian.PutUint32(size[:], uint32(len(b)))
+		buf.Write(size[:])
+		buf.Write(b)
+	}
+	buf.WriteByte(em.Version)
+	buf.WriteByte(byte(em.Header.Type))
+	buf.Write(em.Header.From[:])
+	if em.Header.PubKey != nil {
+		var e [8]byte
+		binary.BigEndian.PutUint64(e[:], uint64(em.Header.PubKey.E))
+		writeField(em.Header.PubKey.N.Bytes())
+		writeField(e[:])
+	} else {
+		writeField(nil)
+		writeField(nil)
+	}
+	writeField(em.Header.Signature)
+	writeField(em.SessionKey)
+	return buf.Bytes()
+}
+
+// seal - encrypt plaintext into the message with key, in the version of
+// the message
+func (em *EncryptedMessage) seal(key, plaintext []byte) error {
+	var err error
+	if em.Version == LegacyVersion {
+		em.CipherText, em.IV, err = crypto.Encrypt(key, plaintext)
+	} else {
+		em.CipherText, em.IV, err = crypto.EncryptGCM(key, plaintext, em.additionalData())
+	}
+	return err
+}
+
+// open - decrypt the plaintext of the message with key
+func (em *EncryptedMessage) open(key []byte) ([]byte, error) {
+	if em.Version == LegacyVersion {
+		return crypto.Decrypt(key, em.CipherText, em.IV)
+	}
+	return crypto.DecryptGCM(key, em.CipherText, em.IV, em.additionalData())
+}
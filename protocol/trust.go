@@ -0,0 +1,73 @@
+package protocol
+
+import (
+	"encoding/gob"
+	"fmt"
+	"os"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/husobee/peerstore/models"
+	"github.com/pkg/errors"
+)
+
+// TrustedNodesFile - the file under the data path the trusted nodes are kept
+// in, so a restarted server still knows who it can talk to
+const TrustedNodesFile = "trustednodes"
+
+// saveTrustedNodes - write the trusted nodes to the data path, the caller
+// must hold the trusted nodes lock
+func (s *Server) saveTrustedNodes() error {
+	nodes := []models.Node{}
+	for _, node := range s.trustedNodes {
+		if node.Addr != "" {
+			nodes = append(nodes, node)
+		}
+	}
+
+	path := fmt.Sprintf("%s/%s", s.DataPath(), TrustedNodesFile)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Wrap(err, "failed to create trusted nodes file: ")
+	}
+	if err := gob.NewEncoder(f).Encode(nodes); err != nil {
+		f.Close()
+		return errors.Wrap(err, "failed to encode trusted nodes: ")
+	}
+	if err := f.Close(); err != nil {
+		return errors.Wrap(err, "failed to close trusted nodes file: ")
+	}
+	// rename so a crash part way through never leaves a broken file behind
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return errors.Wrap(err, "failed to replace trusted nodes file: ")
+	}
+	return nil
+}
+
+// loadTrustedNodes - read the trusted nodes saved in the data path, there
+// are none if the server has never run there before.  Nodes whose ID does
+// not match their key are dropped.
+func loadTrustedNodes(dataPath string) ([]models.Node, error) {
+	f, err := os.Open(fmt.Sprintf("%s/%s", dataPath, TrustedNodesFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open trusted nodes file: ")
+	}
+	defer f.Close()
+
+	nodes := []models.Node{}
+	if err := gob.NewDecoder(f).Decode(&nodes); err != nil {
+		return nil, errors.Wrap(err, "failed to decode trusted nodes: ")
+	}
+
+	trusted := []models.Node{}
+	for _, node := range nodes {
+		if node.PublicKey == nil || crypto.VerifyVirtualKeyID(
+			node.ID, node.PublicKey, node.VNode) != nil {
+			continue
+		}
+		trusted = append(trusted, node)
+	}
+	return trusted, nil
+}
@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// versionRecheck - how long a peer found not to accept SendVersion is spoken
+// to in an older version before SendVersion is tried on it again, so peers
+// are spoken to in the newer version once they are upgraded
+const versionRecheck = 10 * time.Minute
+
+// VersionRange - the versions of the protocol a server accepts, sent back in
+// place of an answer to a message in a version outside of them, so the
+// sender can fall back to one the server does accept.  It is not
+// authenticated, the sender never falls back below its own MinVersion.
+type VersionRange struct {
+	Min    uint8
+	Latest uint8
+}
+
+// versionError - a message was not accepted in the version of the protocol
+// it was sent in, accepted is what the peer told us it does accept, nil if
+// we do not know
+type versionError struct {
+	version  uint8
+	accepted *VersionRange
+}
+
+// Error - implement error
+func (e *versionError) Error() string {
+	if e.accepted != nil {
+		return fmt.Sprintf("protocol version %d is not accepted, versions %d to %d are",
+			e.version, e.accepted.Min, e.accepted.Latest)
+	}
+	if e.version < MinVersion {
+		return fmt.Sprintf("protocol version %d is no longer accepted", e.version)
+	}
+	return fmt.Sprintf("unknown protocol version %d", e.version)
+}
+
+// fallbackVersion - the version to try after version was not accepted by a
+// peer which accepts the versions in accepted, nil if the peer did not say.
+// false is returned if there is no version we both accept left to try.
+func fallbackVersion(version uint8, accepted *VersionRange) (uint8, bool) {
+	if version == LegacyVersion {
+		return version, false
+	}
+	next := version - 1
+	if accepted != nil {
+		if accepted.Latest >= version || accepted.Latest < accepted.Min {
+			return version, false
+		}
+		next = accepted.Latest
+	}
+	if next < MinVersion {
+		return version, false
+	}
+	return next, true
+}
+
+// fallBack - after version was tried on the peer and failed with err, fall
+// back to an older version if the peer told us it does not accept version.
+// Peers which predate versioning just hang up instead, so while we accept
+// LegacyVersion, a hang up on the first message of a fresh connection falls
+// back to it.  The version is remembered by the pool for the transports to
+// the peer after us.  true is returned if there is an older version to try
+// again in.
+func (t *Transport) fallBack(err error, version uint8, fresh bool) bool {
+	var accepted *VersionRange
+	switch cause := errors.Cause(err).(type) {
+	case *versionError:
+		accepted = cause.accepted
+	default:
+		if !fresh || MinVersion != LegacyVersion ||
+			(cause != io.EOF && cause != io.ErrUnexpectedEOF) {
+			return false
+		}
+		accepted = &VersionRange{Min: LegacyVersion, Latest: LegacyVersion}
+	}
+	next, ok := fallbackVersion(version, accepted)
+	if !ok {
+		return false
+	}
+	glog.Infof("%s did not accept protocol version %d, falling back to %d: %v",
+		t.addr, version, next, err)
+	t.network.Pool().fellBack(t.key, next)
+	return true
+}
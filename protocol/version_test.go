@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+	"time"
+
+	"github.com/husobee/peerstore/crypto"
+	"github.com/pkg/errors"
+)
+
+func TestEncryptedMessageVersions(t *testing.T) {
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := crypto.KeyID(&key.PublicKey)
+	request := &Request{
+		Header: Header{From: id, Type: NodeType},
+		Method: PingMethod,
+		Data:   []byte("ping"),
+	}
+	encode := func(version uint8) *EncryptedMessage {
+		var buf = new(bytes.Buffer)
+		if err := encryptAndEncode(gob.NewEncoder(buf), nil, request, version,
+			NodeType, &key.PublicKey, id, key); err != nil {
+			t.Fatalf("failed to encode version %d: %v", version, err)
+		}
+		var em = new(EncryptedMessage)
+		if err := gob.NewDecoder(buf).Decode(em); err != nil {
+			t.Fatal(err)
+		}
+		return em
+	}
+	decode := func(em *EncryptedMessage) (*EncryptedMessage, *Request, error) {
+		var buf = new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(em); err != nil {
+			t.Fatal(err)
+		}
+		em, r, _, err := decryptAndDecodeRequest(gob.NewDecoder(buf), nil, key)
+		return em, r, err
+	}
+
+	MinVersion = LegacyVersion
+	defer func() { MinVersion = GCMVersion }()
+	for _, version := range []uint8{LegacyVersion, GCMVersion} {
+		em, r, err := decode(encode(version))
+		if err != nil || string(r.Data) != "ping" {
+			t.Errorf("version %d failed to round trip: %v", version, err)
+		} else if em.Version != version {
+			t.Errorf("expected version %d, got %d", version, em.Version)
+		}
+	}
+
+	// the header is bound to the ciphertext
+	em := encode(GCMVersion)
+	em.Header.Type = UserType
+	if _, _, err := decode(em); err == nil {
+		t.Error("expected a message with a changed header to be rejected")
+	}
+	// as is the version, a message can not be passed off as legacy
+	em = encode(GCMVersion)
+	em.Version = LegacyVersion
+	if _, _, err := decode(em); err == nil {
+		t.Error("expected a message with a changed version to be rejected")
+	}
+
+	MinVersion = GCMVersion
+	if _, _, err := decode(encode(LegacyVersion)); err == nil {
+		t.Error("expected legacy messages to be rejected")
+	}
+}
+
+func TestFallbackVersion(t *testing.T) {
+	for _, c := range []struct {
+		version  uint8
+		accepted *VersionRange
+		min      uint8
+		next     uint8
+		ok       bool
+	}{
+		{SessionVersion, nil, GCMVersion, GCMVersion, true},
+		{GCMVersion, nil, GCMVersion, GCMVersion, false},
+		{GCMVersion, nil, LegacyVersion, LegacyVersion, true},
+		{LegacyVersion, nil, LegacyVersion, LegacyVersion, false},
+		{SessionVersion, &VersionRange{LegacyVersion, LegacyVersion}, LegacyVersion, LegacyVersion, true},
+		// never below our own minimum, whatever the peer says
+		{SessionVersion, &VersionRange{LegacyVersion, LegacyVersion}, GCMVersion, SessionVersion, false},
+		// nor to a version the peer says it does accept
+		{GCMVersion, &VersionRange{LegacyVersion, SessionVersion}, LegacyVersion, GCMVersion, false},
+	} {
+		MinVersion = c.min
+		next, ok := fallbackVersion(c.version, c.accepted)
+		if next != c.next || ok != c.ok {
+			t.Errorf("fallback from %d, accepting %+v, min %d: expected %d %v, got %d %v",
+				c.version, c.accepted, c.min, c.next, c.ok, next, ok)
+		}
+	}
+	MinVersion = GCMVersion
+
+	// a server tells the sender of a message it does not accept which
+	// versions it does
+	network := NewMemoryNetwork()
+	key, err := crypto.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewServer(network, key, nil, "version-server", t.TempDir(), 16, 2)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	quit, done := make(chan bool), make(chan bool)
+	go s.Serve(quit, done)
+	defer func() {
+		quit <- true
+		<-done
+	}()
+	conn, err := network.Dial("tcp", "version-server", &key.PublicKey, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	request := &Request{
+		Header: Header{From: s.id, Type: NodeType},
+		Method: PingMethod,
+	}
+	if err := encryptAndEncode(gob.NewEncoder(conn), nil, request, LegacyVersion,
+		NodeType, &key.PublicKey, s.id, key); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, err = decryptAndDecodeResponse(gob.NewDecoder(conn), nil, key)
+	verr, ok := errors.Cause(err).(*versionError)
+	if !ok || verr.accepted == nil || verr.accepted.Min != GCMVersion ||
+		verr.accepted.Latest != LatestVersion {
+		t.Errorf("expected the accepted versions, got %v", err)
+	}
+}